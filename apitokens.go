@@ -0,0 +1,227 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scopes of API tokens
+const (
+	scopeStarsWrite    = "stars:write"
+	scopeCommentsWrite = "comments:write"
+)
+
+var apiTokenScopes = []string{scopeStarsWrite, scopeCommentsWrite}
+
+// apiTokenPrefix tells API tokens apart from JWTs in the Authorization header
+const apiTokenPrefix = "ka_"
+
+// apiTokenTouchInterval limits how often the last use of a token is saved
+var apiTokenTouchInterval = time.Minute
+
+// maxAPITokenNameLength is the maximum length of the name of an API token
+const maxAPITokenNameLength = 100
+
+// apiToken is a personal token letting automation act as its user, limited
+// to its scopes. Only the hash of the token is stored.
+type apiToken struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	Name       string        `json:"name" bson:"name"`
+	Scopes     []string      `json:"scopes" bson:"scopes"`
+	User       *User         `json:"-" bson:"user"`
+	Hash       string        `json:"-" bson:"hash"`
+	CreatedAt  time.Time     `json:"created_at" bson:"created_at"`
+	LastUsedAt *time.Time    `json:"last_used_at" bson:"last_used_at,omitempty"`
+	// Only returned when the token is created
+	Token string `json:"token,omitempty" bson:"-"`
+}
+
+// hashAPIToken returns the stored hash of a token. Tokens are random, so a
+// plain hash is enough to keep them secret.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// errInvalidAPIToken is returned for unknown or revoked API tokens
+var errInvalidAPIToken = &authError{reason: "invalid API token"}
+
+// userFromAPIToken returns the user of the API token, limited to its scopes
+func userFromAPIToken(token string) (*User, error) {
+	t, err := store.FindAPIToken(hashAPIToken(token))
+	if err == errNotFound {
+		return nil, errInvalidAPIToken
+	}
+	if err != nil {
+		return nil, &authError{reason: "could not check API token", cause: err}
+	}
+	// Revoking the tokens of a user covers their API tokens too
+	if err := revocationCache.check(t.User.ID, "", t.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	now := getTimestamp()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= apiTokenTouchInterval {
+		if err := store.TouchAPIToken(t.ID, now); err != nil {
+			log.WithError(err).WithFields(log.Fields{"token": t.ID.Hex()}).Error("could not record API token use")
+		}
+	}
+
+	user := *t.User
+	user.scopes = t.Scopes
+	if user.scopes == nil {
+		user.scopes = []string{}
+	}
+	return &user, nil
+}
+
+// hasScope returns whether the user may do what the scope allows. Users
+// authenticated with a session rather than an API token have every scope.
+func (u *User) hasScope(scope string) bool {
+	return u.scopes == nil || containsString(u.scopes, scope)
+}
+
+// requireScope responds with 403 and returns false if the user lacks the
+// scope
+func requireScope(w http.ResponseWriter, u *User, scope string) bool {
+	if u.hasScope(scope) {
+		return true
+	}
+	response.NewErrorResponse(http.StatusForbidden, "API token lacks the "+scope+" scope").Write(w)
+	return false
+}
+
+// getSessionUser returns the user of the request, rejecting API tokens so
+// that they can't be used to manage tokens
+func getSessionUser(w http.ResponseWriter, req *http.Request) (*User, bool) {
+	currentUser, err := getCurrentUser(req)
+	if err != nil {
+		writeUnauthorized(w, err)
+		return nil, false
+	}
+	if currentUser.scopes != nil {
+		response.NewErrorResponse(http.StatusForbidden, "API tokens can't manage API tokens").Write(w)
+		return nil, false
+	}
+	return currentUser, true
+}
+
+// validateAPIToken checks the name and scopes of a new token
+func validateAPIToken(t *apiToken) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(t.Name) > maxAPITokenNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxAPITokenNameLength)
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("scopes are required, among %s", strings.Join(apiTokenScopes, ", "))
+	}
+	for _, s := range t.Scopes {
+		if !containsString(apiTokenScopes, s) {
+			return fmt.Errorf("unknown scope %q, expected one of %s", s, strings.Join(apiTokenScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// ListAPITokens returns the API tokens of the current user
+func ListAPITokens(w http.ResponseWriter, req *http.Request) {
+	currentUser, ok := getSessionUser(w, req)
+	if !ok {
+		return
+	}
+	tokens, err := store.ListAPITokens(currentUser.ID)
+	if err != nil {
+		log.WithError(err).Error("could not fetch API tokens")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	if tokens == nil {
+		tokens = []*apiToken{}
+	}
+	response.NewDataResponse(tokens).Write(w)
+}
+
+// CreateAPIToken creates an API token for the current user. The token is
+// only returned by this request.
+func CreateAPIToken(w http.ResponseWriter, req *http.Request) {
+	currentUser, ok := getSessionUser(w, req)
+	if !ok {
+		return
+	}
+
+	var t apiToken
+	if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+	if err := validateAPIToken(&t); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+
+	t.ID = getNewObjectID()
+	t.User = &User{ID: currentUser.ID, Name: currentUser.Name, Email: currentUser.Email}
+	t.CreatedAt = getTimestamp()
+	t.LastUsedAt = nil
+	t.Token = apiTokenPrefix + randomString()
+	t.Hash = hashAPIToken(t.Token)
+	if err := store.CreateAPIToken(t); err != nil {
+		log.WithError(err).Error("could not insert API token")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	response.NewDataResponse(t).WithCode(http.StatusCreated).Write(w)
+}
+
+// DeleteAPIToken revokes an API token of the current user
+func DeleteAPIToken(w http.ResponseWriter, req *http.Request, params Params) {
+	currentUser, ok := getSessionUser(w, req)
+	if !ok {
+		return
+	}
+	if !bson.IsObjectIdHex(params["tokenId"]) {
+		response.NewErrorResponse(http.StatusNotFound, "API token not found").Write(w)
+		return
+	}
+	err := store.DeleteAPIToken(currentUser.ID, bson.ObjectIdHex(params["tokenId"]))
+	if err == errNotFound {
+		response.NewErrorResponse(http.StatusNotFound, "API token not found").Write(w)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("could not delete API token")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
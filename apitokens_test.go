@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPITokens(t *testing.T) {
+	store = newMemoryStore()
+	oldVerifier := jwtVerifier
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	defer func() { jwtVerifier = oldVerifier }()
+	now := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	oldGetTimestamp := getTimestamp
+	getTimestamp = func() time.Time { return now }
+	defer func() { getTimestamp = oldGetTimestamp }()
+	r := newRouter()
+
+	user := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	session := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(user))
+	do := func(method, path, credentials, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		if credentials != "" {
+			req.Header.Set("Authorization", "Bearer "+credentials)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/v1/tokens", session, `{"name": "Release bot", "scopes": ["comments:write"]}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Data apiToken `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.True(t, strings.HasPrefix(created.Data.Token, "ka_"))
+	assert.Equal(t, []string{scopeCommentsWrite}, created.Data.Scopes)
+	assert.NotContains(t, w.Body.String(), "hash")
+
+	// Only the hash is stored
+	stored, err := store.FindAPIToken(hashAPIToken(created.Data.Token))
+	require.NoError(t, err)
+	assert.Empty(t, stored.Token)
+	assert.Equal(t, user.Name, stored.User.Name)
+
+	// The token can comment as the user, but not star
+	w = do("POST", "/v1/comments/stable/wordpress", created.Data.Token, `{"text": "wordpress 1.2.3 released"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var cm struct {
+		Data comment `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&cm))
+	assert.Equal(t, user.ID, cm.Data.Author.ID)
+	w = do("PUT", "/v1/stars", created.Data.Token, `{"id": "stable/wordpress", "has_starred": true}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "API token lacks the stars:write scope")
+
+	// Tokens can't manage tokens
+	assert.Equal(t, http.StatusForbidden, do("GET", "/v1/tokens", created.Data.Token, "").Code)
+
+	// Listing shows when the token was last used, but not the token
+	w = do("GET", "/v1/tokens", session, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Data []apiToken `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Data, 1)
+	assert.Empty(t, list.Data[0].Token)
+	require.NotNil(t, list.Data[0].LastUsedAt)
+	assert.True(t, now.Equal(*list.Data[0].LastUsedAt))
+
+	// Other users can't revoke the token
+	other := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(&User{ID: bson.NewObjectId(), Name: "Morty"}))
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/v1/tokens/"+created.Data.ID.Hex(), other, "").Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/v1/tokens/"+created.Data.ID.Hex(), session, "").Code)
+	w = do("POST", "/v1/comments/stable/wordpress", created.Data.Token, `{"text": "Hello"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid API token")
+}
+
+func TestAPITokenLastUseIsThrottled(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	now := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	oldGetTimestamp := getTimestamp
+	getTimestamp = func() time.Time { return now }
+	defer func() { getTimestamp = oldGetTimestamp }()
+
+	recent := now.Add(-10 * time.Second)
+	stored := apiToken{ID: bson.NewObjectId(), Scopes: []string{scopeStarsWrite}, User: &User{ID: bson.NewObjectId(), Name: "Bot"}, LastUsedAt: &recent}
+	found := func(args mock.Arguments) { *args.Get(0).(*apiToken) = stored }
+	m.On("One", &apiToken{}).Return(nil).Run(found).Once()
+	user, err := userFromAPIToken("ka_token")
+	require.NoError(t, err)
+	assert.True(t, user.hasScope(scopeStarsWrite))
+	assert.False(t, user.hasScope(scopeCommentsWrite))
+	m.AssertNotCalled(t, "UpdateId", mock.Anything, mock.Anything)
+
+	stale := now.Add(-time.Hour)
+	stored.LastUsedAt = &stale
+	m.On("One", &apiToken{}).Return(nil).Run(found).Once()
+	m.On("UpdateId", stored.ID, bson.M{"$set": bson.M{"last_used_at": now}}).Return(nil)
+	_, err = userFromAPIToken("ka_token")
+	require.NoError(t, err)
+	m.AssertExpectations(t)
+
+	m.On("One", &apiToken{}).Return(mgo.ErrNotFound)
+	_, err = userFromAPIToken("ka_revoked")
+	assert.Equal(t, errInvalidAPIToken, err)
+}
+
+func TestValidateAPIToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token apiToken
+		err   string
+	}{
+		{"valid", apiToken{Name: " CI ", Scopes: []string{scopeStarsWrite, scopeCommentsWrite}}, ""},
+		{"no name", apiToken{Name: " ", Scopes: []string{scopeStarsWrite}}, "name is required"},
+		{"long name", apiToken{Name: strings.Repeat("a", 101), Scopes: []string{scopeStarsWrite}}, "name must be at most 100 characters"},
+		{"no scopes", apiToken{Name: "CI"}, "scopes are required, among stars:write, comments:write"},
+		{"unknown scope", apiToken{Name: "CI", Scopes: []string{"admin"}}, `unknown scope "admin", expected one of stars:write, comments:write`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAPIToken(&tt.token)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "CI", tt.token.Name)
+		})
+	}
+}
@@ -0,0 +1,409 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+type userClaims struct {
+	*User
+	Email string
+	// Roles of the user besides user, e.g. moderator or admin
+	Roles []string `json:"roles,omitempty"`
+	registeredClaims
+}
+
+// registeredClaims are the RFC 7519 claims checked by the verifier. Unlike
+// jwt.StandardClaims, the audience may be a single string or an array.
+type registeredClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	TokenID   string   `json:"jti,omitempty"`
+}
+
+// Valid is called by jwt-go when parsing, the claims are validated against
+// the claimsPolicy of the verifier instead
+func (c registeredClaims) Valid() error {
+	return nil
+}
+
+// has returns whether the named claim is set
+func (c registeredClaims) has(name string) bool {
+	switch name {
+	case "iss":
+		return c.Issuer != ""
+	case "sub":
+		return c.Subject != ""
+	case "aud":
+		return len(c.Audience) > 0
+	case "exp":
+		return c.ExpiresAt != 0
+	case "nbf":
+		return c.NotBefore != 0
+	case "iat":
+		return c.IssuedAt != 0
+	case "jti":
+		return c.TokenID != ""
+	}
+	return false
+}
+
+// audience is the aud claim, encoded as a string if it has a single value
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// registeredClaimNames are the claims that can be required
+var registeredClaimNames = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}
+
+// claimsPolicy is what the registered claims of a token must satisfy
+type claimsPolicy struct {
+	// Accepted iss values, any if empty
+	Issuers []string
+	// Accepted aud values, the token must have one of them unless empty
+	Audiences []string
+	// Clock skew allowed when checking exp, nbf and iat
+	Leeway time.Duration
+	// Claims that must be set
+	Required []string
+}
+
+// check returns the reason the claims don't satisfy the policy at now
+func (p claimsPolicy) check(c registeredClaims, now time.Time) error {
+	for _, name := range p.Required {
+		if !c.has(name) {
+			return &authError{reason: fmt.Sprintf("token is missing the %s claim", name)}
+		}
+	}
+	if c.ExpiresAt != 0 && now.Add(-p.Leeway).Unix() > c.ExpiresAt {
+		return &authError{reason: errTokenExpired}
+	}
+	if c.NotBefore != 0 && now.Add(p.Leeway).Unix() < c.NotBefore {
+		return &authError{reason: errTokenNotValidYet}
+	}
+	if c.IssuedAt != 0 && now.Add(p.Leeway).Unix() < c.IssuedAt {
+		return &authError{reason: errTokenIssuedInFuture}
+	}
+	if len(p.Issuers) > 0 && !containsString(p.Issuers, c.Issuer) {
+		return &authError{reason: errTokenIssuer, cause: fmt.Errorf("issuer %q", c.Issuer)}
+	}
+	if len(p.Audiences) > 0 && !containsAny(p.Audiences, c.Audience) {
+		return &authError{reason: errTokenAudience, cause: fmt.Errorf("audience %q", []string(c.Audience))}
+	}
+	return nil
+}
+
+// validateClaimNames checks that the required claims are registered ones
+func validateClaimNames(names []string) error {
+	for _, name := range names {
+		if !containsString(registeredClaimNames, name) {
+			return fmt.Errorf("unsupported required claim %q, expected one of %s", name, strings.Join(registeredClaimNames, ", "))
+		}
+	}
+	return nil
+}
+
+// Reasons returned to clients when authentication fails
+const (
+	errTokenMalformed      = "malformed token"
+	errTokenUnverifiable   = "token signature could not be verified"
+	errTokenSignature      = "invalid token signature"
+	errTokenExpired        = "token has expired"
+	errTokenNotValidYet    = "token is not valid yet"
+	errTokenIssuedInFuture = "token was issued in the future"
+	errTokenIssuer         = "token issuer is not accepted"
+	errTokenAudience       = "token audience is not accepted"
+	errTokenNoUser         = "token does not identify a user"
+)
+
+// authError is an authentication failure. Its reason is returned to the
+// client, while the cause, which may reveal the configuration, is only logged.
+type authError struct {
+	reason string
+	cause  error
+}
+
+func (e *authError) Error() string {
+	if e.cause != nil {
+		return e.reason + ": " + e.cause.Error()
+	}
+	return e.reason
+}
+
+// writeUnauthorized responds with 401 and the reason authentication failed
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	message := "unauthorized"
+	if ae, ok := err.(*authError); ok {
+		message = ae.reason
+	}
+	log.WithError(err).Debug("request not authenticated")
+	response.NewErrorResponse(http.StatusUnauthorized, message).Write(w)
+}
+
+// Signing algorithms accepted by default for each kind of key
+var (
+	hmacAlgorithms      = []string{"HS256", "HS384", "HS512"}
+	publicKeyAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+// tokenVerifier checks the signature of the JWTs identifying users, signed
+// either with a shared HMAC key or with a private key whose public key is in
+// a key set
+type tokenVerifier struct {
+	algorithms []string
+	hmacKey    []byte
+	keys       *keySet
+	policy     claimsPolicy
+}
+
+// jwtVerifier verifies the tokens of every request, it is configured in main
+var jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms}
+
+// newTokenVerifier returns a verifier using the HMAC key and public keys, any
+// of which may be empty. If algorithms is empty, those of the configured keys
+// are allowed.
+func newTokenVerifier(hmacKey string, keys *keySet, algorithms []string) (*tokenVerifier, error) {
+	if len(algorithms) == 0 {
+		if hmacKey != "" {
+			algorithms = append(algorithms, hmacAlgorithms...)
+		}
+		if keys != nil {
+			algorithms = append(algorithms, publicKeyAlgorithms...)
+		}
+	}
+	for _, alg := range algorithms {
+		if jwt.GetSigningMethod(alg) == nil || alg == "none" {
+			return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+		}
+	}
+	v := &tokenVerifier{algorithms: algorithms, keys: keys}
+	if hmacKey != "" {
+		v.hmacKey = []byte(hmacKey)
+	}
+	return v, nil
+}
+
+// keyFunc returns the key verifying the token
+func (v *tokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if v.hmacKey == nil {
+			return nil, errors.New("JWT_KEY not set")
+		}
+		return v.hmacKey, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		if v.keys == nil {
+			return nil, errors.New("no public keys configured")
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, err := v.keys.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.alg != "" && key.alg != alg {
+			return nil, fmt.Errorf("key %q is for %s, not %s", kid, key.alg, alg)
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+			if _, ok := key.key.(*ecdsa.PublicKey); !ok {
+				return nil, fmt.Errorf("key %q is not an ECDSA key", kid)
+			}
+		} else if _, ok := key.key.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("key %q is not an RSA key", kid)
+		}
+		return key.key, nil
+	}
+	return nil, fmt.Errorf("unexpected signing method: %v", alg)
+}
+
+// verifiableClaims are claims embedding the registered ones
+type verifiableClaims interface {
+	jwt.Claims
+	registered() registeredClaims
+}
+
+func (c registeredClaims) registered() registeredClaims {
+	return c
+}
+
+// verify checks the signature and registered claims of the token, decoding
+// its claims into claims
+func (v *tokenVerifier) verify(tokenString string, claims verifiableClaims) error {
+	parser := &jwt.Parser{ValidMethods: v.algorithms, SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(tokenString, claims, v.keyFunc)
+	if err != nil {
+		reason := errTokenMalformed
+		if ve, ok := err.(*jwt.ValidationError); ok {
+			switch {
+			case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+				reason = errTokenUnverifiable
+			case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+				reason = errTokenSignature
+			}
+		}
+		return &authError{reason: reason, cause: err}
+	}
+	if !token.Valid {
+		return &authError{reason: errTokenMalformed}
+	}
+	return v.policy.check(claims.registered(), time.Now())
+}
+
+// parse verifies the token and returns its claims
+func (v *tokenVerifier) parse(tokenString string) (*userClaims, error) {
+	claims := &userClaims{}
+	if err := v.verify(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.User == nil {
+		return nil, &authError{reason: errTokenNoUser}
+	}
+	return claims, nil
+}
+
+// user returns the user identified by the claims
+func (c *userClaims) user() *User {
+	c.User.Email = c.Email
+	c.User.role = highestRole(c.Roles)
+	return c.User
+}
+
+// userFromToken returns the user identified by the token
+func (v *tokenVerifier) userFromToken(tokenString string) (*User, error) {
+	claims, err := v.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	return claims.user(), nil
+}
+
+// authCookieName is the cookie holding the token of browser sessions
+var authCookieName = "ka_auth"
+
+// errNoToken is returned for requests without credentials
+var errNoToken = &authError{reason: "no authorization header or cookie"}
+
+// tokenFromRequest returns the token of the request and whether it was sent
+// as a bearer token. The Authorization header takes precedence: if a request
+// has one, the cookie is never used, even if the header is invalid.
+func tokenFromRequest(req *http.Request) (string, bool, error) {
+	if header := req.Header.Get("Authorization"); header != "" {
+		parts := strings.SplitN(header, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return "", true, &authError{reason: "unsupported authorization scheme, expected Bearer"}
+		}
+		token := strings.TrimSpace(parts[1])
+		if token == "" {
+			return "", true, &authError{reason: "empty bearer token"}
+		}
+		return token, true, nil
+	}
+
+	cookie, err := req.Cookie(authCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false, errNoToken
+	}
+	return cookie.Value, false, nil
+}
+
+// getCurrentUser returns the user authenticated by the request
+var getCurrentUser = func(req *http.Request) (*User, error) {
+	if u, ok := req.Context().Value(currentUserKey).(*User); ok {
+		return u, nil
+	}
+	token, bearer, err := tokenFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	// API tokens are only accepted in the Authorization header
+	if bearer && strings.HasPrefix(token, apiTokenPrefix) {
+		return userFromAPIToken(token)
+	}
+	claims, err := jwtVerifier.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := revocationCache.check(claims.User.ID, claims.TokenID, time.Unix(claims.IssuedAt, 0)); err != nil {
+		return nil, err
+	}
+	return claims.user(), nil
+}
+
+// splitList splits a comma-separated flag value, ignoring empty elements
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny returns whether any of values is in list
+func containsAny(list []string, values []string) bool {
+	for _, v := range values {
+		if containsString(list, v) {
+			return true
+		}
+	}
+	return false
+}
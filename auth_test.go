@@ -0,0 +1,375 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKeysOnce sync.Once
+	testRSAKey   *rsa.PrivateKey
+	testECKey    *ecdsa.PrivateKey
+)
+
+// testKeys returns an RSA and an ECDSA key, generated once for all tests
+func testKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	testKeysOnce.Do(func() {
+		var err error
+		testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		testECKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+	})
+	return testRSAKey, testECKey
+}
+
+// testClaims returns the claims of a user token valid for an hour
+func testClaims(u *User) *userClaims {
+	return &userClaims{
+		User:             u,
+		Email:            u.Email,
+		registeredClaims: registeredClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	}
+}
+
+// signToken signs the claims with the key, setting the kid header if not empty
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+func TestTokenVerifierHMAC(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	v, err := newTokenVerifier("secret", nil, nil)
+	require.NoError(t, err)
+	user := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+
+	got, err := v.userFromToken(signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(user)))
+	require.NoError(t, err)
+	assert.Equal(t, user, got)
+
+	_, err = v.userFromToken(signToken(t, jwt.SigningMethodHS256, []byte("other"), "", testClaims(user)))
+	assert.Error(t, err)
+	_, err = v.userFromToken(signToken(t, jwt.SigningMethodRS256, rsaKey, "", testClaims(user)))
+	assert.EqualError(t, err, "invalid token signature: signing method RS256 is invalid")
+}
+
+func TestTokenVerifierPublicKeys(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	keys := newKeySet(staticKeys{
+		"rsa-1": {key: &rsaKey.PublicKey},
+		"ec-1":  {key: &ecKey.PublicKey, alg: "ES256"},
+	})
+	require.NoError(t, keys.Refresh())
+	user := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+
+	tests := []struct {
+		name       string
+		algorithms []string
+		token      string
+		err        string
+	}{
+		{"RS256", nil, signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", testClaims(user)), ""},
+		{"PS256", nil, signToken(t, jwt.SigningMethodPS256, rsaKey, "rsa-1", testClaims(user)), ""},
+		{"ES256", nil, signToken(t, jwt.SigningMethodES256, ecKey, "ec-1", testClaims(user)), ""},
+		{"not allowed", []string{"ES256"}, signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", testClaims(user)),
+			"invalid token signature: signing method RS256 is invalid"},
+		{"unknown kid", nil, signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-2", testClaims(user)),
+			`token signature could not be verified: unknown key "rsa-2"`},
+		{"no kid with several keys", nil, signToken(t, jwt.SigningMethodRS256, rsaKey, "", testClaims(user)),
+			`token signature could not be verified: unknown key ""`},
+		{"wrong key type", nil, signToken(t, jwt.SigningMethodRS256, rsaKey, "ec-1", testClaims(user)),
+			`token signature could not be verified: key "ec-1" is for ES256, not RS256`},
+		{"RSA key for ECDSA", nil, signToken(t, jwt.SigningMethodES256, ecKey, "rsa-1", testClaims(user)),
+			`token signature could not be verified: key "rsa-1" is not an ECDSA key`},
+		// The public key must not be usable as an HMAC secret
+		{"HMAC with public key", nil, signToken(t, jwt.SigningMethodHS256, []byte("rsa-1"), "rsa-1", testClaims(user)),
+			"invalid token signature: signing method HS256 is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newTokenVerifier("", keys, tt.algorithms)
+			require.NoError(t, err)
+			got, err := v.userFromToken(tt.token)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, user, got)
+		})
+	}
+}
+
+func TestNewTokenVerifier(t *testing.T) {
+	keys := newKeySet(staticKeys{})
+	tests := []struct {
+		name       string
+		hmacKey    string
+		keys       *keySet
+		algorithms []string
+		want       []string
+		err        string
+	}{
+		{"HMAC key", "secret", nil, nil, hmacAlgorithms, ""},
+		{"public keys", "", keys, nil, publicKeyAlgorithms, ""},
+		{"both", "secret", keys, nil, append(append([]string{}, hmacAlgorithms...), publicKeyAlgorithms...), ""},
+		{"explicit", "secret", keys, []string{"RS256", "ES256"}, []string{"RS256", "ES256"}, ""},
+		{"unsupported", "", keys, []string{"RS256", "none"}, nil, `unsupported signing algorithm "none"`},
+		{"unknown", "", keys, []string{"XS256"}, nil, `unsupported signing algorithm "XS256"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newTokenVerifier(tt.hmacKey, tt.keys, tt.algorithms)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v.algorithms)
+		})
+	}
+}
+
+func TestGetCurrentUserFromCookie(t *testing.T) {
+	_, ecKey := testKeys(t)
+	keys := newKeySet(staticKeys{"ec-1": {key: &ecKey.PublicKey}})
+	require.NoError(t, keys.Refresh())
+	oldVerifier := jwtVerifier
+	var err error
+	jwtVerifier, err = newTokenVerifier("", keys, []string{"ES256"})
+	require.NoError(t, err)
+	defer func() { jwtVerifier = oldVerifier }()
+
+	user := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "ka_auth", Value: signToken(t, jwt.SigningMethodES256, ecKey, "ec-1", testClaims(user))})
+	got, err := getCurrentUser(req)
+	require.NoError(t, err)
+	assert.Equal(t, user, got)
+
+	_, err = getCurrentUser(httptest.NewRequest("GET", "/", nil))
+	assert.Error(t, err)
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		cookie     *http.Cookie
+		wantToken  string
+		wantBearer bool
+		err        string
+	}{
+		{"bearer", "Bearer header-token", nil, "header-token", true, ""},
+		{"lowercase scheme", "bearer header-token", nil, "header-token", true, ""},
+		{"cookie", "", &http.Cookie{Name: "ka_auth", Value: "cookie-token"}, "cookie-token", false, ""},
+		{"header takes precedence", "Bearer header-token", &http.Cookie{Name: "ka_auth", Value: "cookie-token"}, "header-token", true, ""},
+		{"invalid header doesn't fall back", "Basic dXNlcjpwYXNz", &http.Cookie{Name: "ka_auth", Value: "cookie-token"}, "", true,
+			"unsupported authorization scheme, expected Bearer"},
+		{"empty bearer", "Bearer ", nil, "", true, "empty bearer token"},
+		{"other cookie", "", &http.Cookie{Name: "session", Value: "cookie-token"}, "", false, "no authorization header or cookie"},
+		{"nothing", "", nil, "", false, "no authorization header or cookie"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			token, bearer, err := tokenFromRequest(req)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantToken, token)
+			assert.Equal(t, tt.wantBearer, bearer)
+		})
+	}
+}
+
+func TestGetCurrentUserFromBearerToken(t *testing.T) {
+	oldVerifier, oldCookieName := jwtVerifier, authCookieName
+	var err error
+	jwtVerifier, err = newTokenVerifier("secret", nil, nil)
+	require.NoError(t, err)
+	authCookieName = "session"
+	defer func() { jwtVerifier, authCookieName = oldVerifier, oldCookieName }()
+
+	alice := &User{ID: bson.NewObjectId(), Name: "Alice", Email: "alice@example.com"}
+	bob := &User{ID: bson.NewObjectId(), Name: "Bob", Email: "bob@example.com"}
+	aliceToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(alice))
+	bobToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(bob))
+
+	req := httptest.NewRequest("PUT", "/v1/stars", nil)
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	req.AddCookie(&http.Cookie{Name: "session", Value: bobToken})
+	got, err := getCurrentUser(req)
+	require.NoError(t, err)
+	assert.Equal(t, alice, got)
+
+	// The cookie name is configurable
+	req = httptest.NewRequest("PUT", "/v1/stars", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: bobToken})
+	got, err = getCurrentUser(req)
+	require.NoError(t, err)
+	assert.Equal(t, bob, got)
+
+	req = httptest.NewRequest("PUT", "/v1/stars", nil)
+	req.AddCookie(&http.Cookie{Name: "ka_auth", Value: bobToken})
+	_, err = getCurrentUser(req)
+	assert.Equal(t, errNoToken, err)
+}
+
+func TestClaimsPolicy(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	policy := claimsPolicy{
+		Issuers:   []string{"https://accounts.example.com", "https://kubeapps.example.com"},
+		Audiences: []string{"ratesvc"},
+		Leeway:    time.Minute,
+		Required:  []string{"sub", "exp"},
+	}
+	valid := registeredClaims{
+		Issuer:    "https://kubeapps.example.com",
+		Subject:   "rick",
+		Audience:  audience{"hub", "ratesvc"},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	tests := []struct {
+		name   string
+		change func(c *registeredClaims)
+		err    string
+	}{
+		{"valid", func(c *registeredClaims) {}, ""},
+		{"missing sub", func(c *registeredClaims) { c.Subject = "" }, "token is missing the sub claim"},
+		{"missing exp", func(c *registeredClaims) { c.ExpiresAt = 0 }, "token is missing the exp claim"},
+		{"expired", func(c *registeredClaims) { c.ExpiresAt = now.Add(-2 * time.Minute).Unix() }, "token has expired"},
+		{"expired within leeway", func(c *registeredClaims) { c.ExpiresAt = now.Add(-30 * time.Second).Unix() }, ""},
+		{"not valid yet", func(c *registeredClaims) { c.NotBefore = now.Add(2 * time.Minute).Unix() }, "token is not valid yet"},
+		{"not before within leeway", func(c *registeredClaims) { c.NotBefore = now.Add(30 * time.Second).Unix() }, ""},
+		{"issued in the future", func(c *registeredClaims) { c.IssuedAt = now.Add(2 * time.Minute).Unix() }, "token was issued in the future"},
+		{"other issuer", func(c *registeredClaims) { c.Issuer = "https://evil.example.com" },
+			`token issuer is not accepted: issuer "https://evil.example.com"`},
+		{"other audience", func(c *registeredClaims) { c.Audience = audience{"hub"} }, `token audience is not accepted: audience ["hub"]`},
+		{"no audience", func(c *registeredClaims) { c.Audience = nil }, "token audience is not accepted: audience []"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.change(&c)
+			err := policy.check(c, now)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	// Without issuers and audiences, any are accepted
+	assert.NoError(t, claimsPolicy{}.check(registeredClaims{Issuer: "anyone"}, now))
+	assert.NoError(t, validateClaimNames([]string{"sub", "jti"}))
+	assert.EqualError(t, validateClaimNames([]string{"email"}),
+		`unsupported required claim "email", expected one of iss, sub, aud, exp, nbf, iat, jti`)
+}
+
+func TestAudienceClaim(t *testing.T) {
+	var c registeredClaims
+	require.NoError(t, json.Unmarshal([]byte(`{"aud": "ratesvc"}`), &c))
+	assert.Equal(t, audience{"ratesvc"}, c.Audience)
+	require.NoError(t, json.Unmarshal([]byte(`{"aud": ["hub", "ratesvc"]}`), &c))
+	assert.Equal(t, audience{"hub", "ratesvc"}, c.Audience)
+	assert.Error(t, json.Unmarshal([]byte(`{"aud": 1}`), &c))
+
+	data, err := json.Marshal(registeredClaims{Audience: audience{"ratesvc"}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"aud": "ratesvc"}`, string(data))
+}
+
+func TestUnauthorizedReasons(t *testing.T) {
+	oldVerifier := jwtVerifier
+	var err error
+	jwtVerifier, err = newTokenVerifier("secret", nil, nil)
+	require.NoError(t, err)
+	jwtVerifier.policy = claimsPolicy{Issuers: []string{"kubeapps"}, Audiences: []string{"ratesvc"}, Required: []string{"exp"}}
+	defer func() { jwtVerifier = oldVerifier }()
+
+	user := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	claims := func(change func(c *userClaims)) *userClaims {
+		c := testClaims(user)
+		c.Issuer = "kubeapps"
+		c.Audience = audience{"ratesvc"}
+		change(c)
+		return c
+	}
+	sign := func(c *userClaims) string {
+		return signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", c)
+	}
+	tests := []struct {
+		name    string
+		token   string
+		message string
+	}{
+		{"no token", "", "no authorization header or cookie"},
+		{"malformed", "not-a-jwt", "malformed token"},
+		{"wrong key", signToken(t, jwt.SigningMethodHS256, []byte("other"), "", claims(func(*userClaims) {})), "invalid token signature"},
+		{"expired", sign(claims(func(c *userClaims) { c.ExpiresAt = time.Now().Add(-time.Hour).Unix() })), "token has expired"},
+		{"no expiry", sign(claims(func(c *userClaims) { c.ExpiresAt = 0 })), "token is missing the exp claim"},
+		{"issuer", sign(claims(func(c *userClaims) { c.Issuer = "elsewhere" })), "token issuer is not accepted"},
+		{"audience", sign(claims(func(c *userClaims) { c.Audience = audience{"monocular"} })), "token audience is not accepted"},
+		{"no user", sign(claims(func(c *userClaims) { c.User = nil })), "token does not identify a user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("PUT", "/v1/stars", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			UpdateStar(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			var body response.ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.message, body.Message)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// badgeMaxAge is how long CDNs and browsers may cache a badge
+var badgeMaxAge = 5 * time.Minute
+
+// Named colors accepted by the color and labelColor query params
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"grey":        "#555",
+	"lightgrey":   "#9f9f9f",
+}
+
+var hexColor = regexp.MustCompile(`^([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// badge describes a shields-style badge with a label and a message
+type badge struct {
+	Label      string
+	Message    string
+	Color      string
+	LabelColor string
+	Style      string
+}
+
+// Layout computed from the badge text, in pixels
+type badgeLayout struct {
+	badge
+	LabelWidth   int
+	MessageWidth int
+	Width        int
+	Height       int
+	Radius       int
+	Gradient     bool
+}
+
+var badgeTemplate = template.Must(template.New("badge").Funcs(template.FuncMap{
+	"escape": template.HTMLEscapeString,
+	"half":   func(n int) int { return n / 2 },
+	"add":    func(a, b int) int { return a + b },
+}).Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" role="img" aria-label="{{escape .Label}}: {{escape .Message}}">
+<title>{{escape .Label}}: {{escape .Message}}</title>
+{{- if .Gradient}}
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+{{- end}}
+<clipPath id="r"><rect width="{{.Width}}" height="{{.Height}}" rx="{{.Radius}}" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="{{.LabelWidth}}" height="{{.Height}}" fill="{{.LabelColor}}"/>
+<rect x="{{.LabelWidth}}" width="{{.MessageWidth}}" height="{{.Height}}" fill="{{.Color}}"/>
+{{- if .Gradient}}
+<rect width="{{.Width}}" height="{{.Height}}" fill="url(#s)"/>
+{{- end}}
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{half .LabelWidth}}" y="{{add (half .Height) 4}}">{{escape .Label}}</text>
+<text x="{{add .LabelWidth (half .MessageWidth)}}" y="{{add (half .Height) 4}}">{{escape .Message}}</text>
+</g>
+</svg>
+`))
+
+// GetStarsBadge renders an SVG badge with the star count of an item
+func GetStarsBadge(w http.ResponseWriter, req *http.Request, params Params) {
+	// Items nobody has interacted with yet have no stars
+	var stars int
+	if it, err := storedItem(params); err == nil {
+		stars = len(it.StargazersIDs)
+	}
+
+	b, err := newBadge(req, "stars", "★ "+formatCount(stars))
+	if err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+	writeBadge(w, req, b)
+}
+
+// GetRatingBadge renders an SVG badge with the number of Stargazers of a
+// version of an item, given by the version query param as a version or a
+// range. It defaults to the latest version anybody starred.
+func GetRatingBadge(w http.ResponseWriter, req *http.Request, params Params) {
+	spec := req.URL.Query().Get("version")
+	matchVersion, err := versionMatcher(spec)
+	if err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+
+	var stars int
+	if it, err := storedItem(params); err == nil {
+		if spec == "" {
+			spec = latestVersion(it)
+			matchVersion, _ = versionMatcher(spec)
+		}
+		// Stars without a version don't rate any version
+		if spec != "" {
+			for version, n := range countByVersion(it) {
+				if matchVersion(version) {
+					stars += n
+				}
+			}
+		}
+	}
+
+	message := "★ " + formatCount(stars)
+	if spec != "" {
+		message += " (" + spec + ")"
+	}
+	b, err := newBadge(req, "rating", message)
+	if err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+	writeBadge(w, req, b)
+}
+
+// newBadge applies the style, color, labelColor and label query options
+func newBadge(req *http.Request, label, message string) (badge, error) {
+	q := req.URL.Query()
+	b := badge{Label: label, Message: message, Color: badgeColors["blue"], LabelColor: badgeColors["grey"], Style: "flat"}
+	if l := q.Get("label"); l != "" {
+		b.Label = l
+	}
+	if s := q.Get("style"); s != "" {
+		if s != "flat" && s != "flat-square" && s != "plastic" {
+			return b, fmt.Errorf("unsupported style %q", s)
+		}
+		b.Style = s
+	}
+	var err error
+	if c := q.Get("color"); c != "" {
+		if b.Color, err = parseBadgeColor(c); err != nil {
+			return b, err
+		}
+	}
+	if c := q.Get("labelColor"); c != "" {
+		if b.LabelColor, err = parseBadgeColor(c); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// writeBadge renders the badge with headers allowing CDNs to cache it
+func writeBadge(w http.ResponseWriter, req *http.Request, b badge) {
+	var buf bytes.Buffer
+	if err := badgeTemplate.Execute(&buf, b.layout()); err != nil {
+		log.WithError(err).Error("could not render badge")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(buf.Bytes()))
+	maxAge := int(badgeMaxAge.Seconds())
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, s-maxage=%d, stale-while-revalidate=%d", maxAge, maxAge, maxAge))
+	w.Header().Set("ETag", etag)
+	if notModified(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func (b badge) layout() badgeLayout {
+	l := badgeLayout{badge: b, Height: 20, Radius: 3, Gradient: true}
+	switch b.Style {
+	case "flat-square":
+		l.Radius = 0
+		l.Gradient = false
+	case "plastic":
+		l.Height = 18
+		l.Radius = 4
+	}
+	// 5px of padding on each side of the text
+	l.LabelWidth = textWidth(b.Label) + 10
+	l.MessageWidth = textWidth(b.Message) + 10
+	l.Width = l.LabelWidth + l.MessageWidth
+	return l
+}
+
+func parseBadgeColor(c string) (string, error) {
+	if named, ok := badgeColors[c]; ok {
+		return named, nil
+	}
+	c = strings.TrimPrefix(c, "#")
+	if hexColor.MatchString(c) {
+		return "#" + c, nil
+	}
+	return "", fmt.Errorf("invalid color %q", c)
+}
+
+// textWidth approximates the width in pixels of the text rendered in 11px Verdana
+func textWidth(s string) int {
+	width := 0.0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("il.,:;'|!", r):
+			width += 3.5
+		case strings.ContainsRune("fjrt()[] ", r):
+			width += 4.5
+		case strings.ContainsRune("mwMW", r):
+			width += 10.5
+		case r >= 'A' && r <= 'Z':
+			width += 7.5
+		case r < 128:
+			width += 7
+		default:
+			// Symbols such as ★
+			width += 10
+		}
+	}
+	return int(width + 0.5)
+}
+
+// formatCount abbreviates large counts, e.g. 1234 becomes 1.2k
+func formatCount(n int) string {
+	switch {
+	case n >= 1000000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/1000000), ".0") + "M"
+	case n >= 1000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/1000), ".0") + "k"
+	}
+	return fmt.Sprint(n)
+}
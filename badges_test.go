@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func badgesRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/v1/badges/stars/{repo}/{chartName}.svg").Handler(WithParams(GetStarsBadge))
+	r.Methods("GET").Path("/v1/badges/rating/{repo}/{chartName}.svg").Handler(WithParams(GetRatingBadge))
+	return r
+}
+
+func TestGetStarsBadge(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress", StargazersIDs: []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId()}}
+	})
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantLabel string
+		wantColor string
+	}{
+		{"default", "", http.StatusOK, "stars: ★ 2", "#007ec6"},
+		{"custom label", "?label=likes", http.StatusOK, "likes: ★ 2", "#007ec6"},
+		{"named color", "?color=brightgreen", http.StatusOK, "stars: ★ 2", "#4c1"},
+		{"hex color", "?color=ff0000&style=flat-square", http.StatusOK, "stars: ★ 2", "#ff0000"},
+		{"invalid color", "?color=notacolor", http.StatusBadRequest, "", ""},
+		{"invalid style", "?style=wavy", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/v1/badges/stars/stable/wordpress.svg"+tt.query, nil)
+			badgesRouter().ServeHTTP(w, req)
+			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, "image/svg+xml; charset=utf-8", w.Header().Get("Content-Type"))
+			assert.Equal(t, "public, max-age=300, s-maxage=300, stale-while-revalidate=300", w.Header().Get("Cache-Control"))
+
+			var svg struct {
+				Label string `xml:"aria-label,attr"`
+				Rects []struct {
+					Fill string `xml:"fill,attr"`
+				} `xml:"g>rect"`
+			}
+			require.NoError(t, xml.NewDecoder(w.Body).Decode(&svg))
+			assert.Equal(t, tt.wantLabel, svg.Label)
+			require.True(t, len(svg.Rects) >= 2)
+			assert.Equal(t, tt.wantColor, svg.Rects[1].Fill)
+		})
+	}
+}
+
+func TestGetStarsBadgeInexistantItem(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("One", &item{}).Return(errors.New("not found"))
+
+	w := httptest.NewRecorder()
+	badgesRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/badges/stars/stable/wordpress.svg", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "★ 0")
+}
+
+func TestGetRatingBadge(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	alice, bob, carol, dave := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{
+			ID:            "stable/wordpress",
+			StargazersIDs: []bson.ObjectId{alice, bob, carol, dave},
+			StargazerVersions: map[string]string{
+				alice.Hex(): "1.2.0",
+				bob.Hex():   "1.10.0",
+				carol.Hex(): "1.10.0",
+			},
+		}
+	})
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantLabel string
+	}{
+		{"latest version", "", http.StatusOK, "rating: ★ 2 (1.10.0)"},
+		{"version", "?version=1.2.0", http.StatusOK, "rating: ★ 1 (1.2.0)"},
+		{"range", "?version=>=1.0,<2.0", http.StatusOK, "rating: ★ 3 (>=1.0,<2.0)"},
+		{"unstarred version", "?version=2.0.0", http.StatusOK, "rating: ★ 0 (2.0.0)"},
+		{"custom label", "?label=rating%20for", http.StatusOK, "rating for: ★ 2 (1.10.0)"},
+		{"invalid version", "?version=latest", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/v1/badges/rating/stable/wordpress.svg"+tt.query, nil)
+			badgesRouter().ServeHTTP(w, req)
+			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, "image/svg+xml; charset=utf-8", w.Header().Get("Content-Type"))
+			var svg struct {
+				Label string `xml:"aria-label,attr"`
+			}
+			require.NoError(t, xml.NewDecoder(w.Body).Decode(&svg))
+			assert.Equal(t, tt.wantLabel, svg.Label)
+		})
+	}
+}
+
+func TestGetRatingBadgeWithoutVersions(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress", StargazersIDs: []bson.ObjectId{bson.NewObjectId()}}
+	})
+
+	w := httptest.NewRecorder()
+	badgesRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/badges/rating/stable/wordpress.svg", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `aria-label="rating: ★ 0"`)
+}
+
+func TestGetStarsBadgeNotModified(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("One", &item{}).Return(errors.New("not found"))
+
+	w := httptest.NewRecorder()
+	badgesRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/badges/stars/stable/wordpress.svg", nil))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/badges/stars/stable/wordpress.svg", nil)
+	req.Header.Set("If-None-Match", etag)
+	badgesRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func Test_formatCount(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1k"},
+		{1234, "1.2k"},
+		{2500000, "2.5M"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, formatCount(tt.n))
+	}
+}
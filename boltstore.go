@@ -0,0 +1,538 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	itemsBucket = []byte("items")
+	// API tokens by ID, and their IDs by hash
+	apiTokensBucket      = []byte("api_tokens")
+	apiTokenHashesBucket = []byte("api_token_hashes")
+	revocationsBucket    = []byte("revocations")
+	sanctionsBucket      = []byte("sanctions")
+)
+
+// boltStore keeps items in an embedded bbolt database file, each item being
+// stored BSON-encoded like a MongoDB document. Writes are serialized by
+// bbolt, so concurrent requests are safe.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens the database at path, creating it if needed
+func newBoltStore(path string) (*boltStore, error) {
+	// Fail instead of waiting forever if another process has the file open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{itemsBucket, apiTokensBucket, apiTokenHashesBucket, revocationsBucket, sanctionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// get returns the stored item, without following aliases
+func (s *boltStore) get(tx *bolt.Tx, id string) (*item, error) {
+	data := tx.Bucket(itemsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, errNotFound
+	}
+	var it item
+	if err := bson.Unmarshal(data, &it); err != nil {
+		return nil, fmt.Errorf("could not decode item %q: %v", id, err)
+	}
+	return &it, nil
+}
+
+// find returns the stored item, following aliases
+func (s *boltStore) find(tx *bolt.Tx, id string) (*item, error) {
+	for i := 0; i < maxAliasHops; i++ {
+		it, err := s.get(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if it.AliasOf == "" {
+			return it, nil
+		}
+		id = it.AliasOf
+	}
+	return nil, fmt.Errorf("too many aliases resolving item %q", id)
+}
+
+func (s *boltStore) put(tx *bolt.Tx, it *item) error {
+	data, err := bson.Marshal(it)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(itemsBucket).Put([]byte(it.ID), data)
+}
+
+// update runs fn on the stored item with the given ID and saves it
+func (s *boltStore) update(id string, fn func(it *item) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		it, err := s.get(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(it); err != nil {
+			return err
+		}
+		return s.put(tx, it)
+	})
+}
+
+func (s *boltStore) GetItem(id string) (*item, error) {
+	var it *item
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		it, err = s.find(tx, id)
+		return err
+	})
+	return it, err
+}
+
+// list returns the charts of the repo, or every item if the repo is empty,
+// sorted by ID
+func (s *boltStore) list(tx *bolt.Tx, repo string) ([]*item, error) {
+	var prefix []byte
+	if repo != "" {
+		prefix = []byte(repo + "/")
+	}
+
+	items := []*item{}
+	c := tx.Bucket(itemsBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var it item
+		if err := bson.Unmarshal(v, &it); err != nil {
+			return nil, fmt.Errorf("could not decode item %q: %v", k, err)
+		}
+		if it.AliasOf == "" && (repo == "" || isItemType(&it, "chart")) {
+			items = append(items, &it)
+		}
+	}
+	return items, nil
+}
+
+func (s *boltStore) ListItems(repo string) ([]*item, error) {
+	var items []*item
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		items, err = s.list(tx, repo)
+		return err
+	})
+	return items, err
+}
+
+func (s *boltStore) ListAliases() (map[string]string, error) {
+	aliases := map[string]string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(itemsBucket).ForEach(func(k, v []byte) error {
+			var it item
+			if err := bson.Unmarshal(v, &it); err != nil {
+				return fmt.Errorf("could not decode item %q: %v", k, err)
+			}
+			if it.AliasOf != "" {
+				aliases[it.ID] = it.AliasOf
+			}
+			return nil
+		})
+	})
+	return aliases, err
+}
+
+func (s *boltStore) CreateItem(it item) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(itemsBucket).Get([]byte(it.ID)) != nil {
+			return fmt.Errorf("item %q already exists", it.ID)
+		}
+		return s.put(tx, &it)
+	})
+}
+
+// upsert runs fn on the stored item with the given ID, following aliases,
+// or on a new item of the given type if it doesn't exist, and saves it
+func (s *boltStore) upsert(id, itemType string, fn func(it *item)) (*item, error) {
+	var it *item
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		it, err = s.find(tx, id)
+		if err == errNotFound {
+			it = &item{ID: id, Type: itemType}
+		} else if err != nil {
+			return err
+		}
+		fn(it)
+		return s.put(tx, it)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (s *boltStore) AddStar(itemID, itemType string, userID bson.ObjectId, version string) (*item, bool, error) {
+	var changed bool
+	it, err := s.upsert(itemID, itemType, func(it *item) {
+		changed = !hasStarred(it, &User{ID: userID})
+		addStargazer(it, userID, version)
+	})
+	return it, changed, err
+}
+
+func (s *boltStore) RemoveStar(itemID, itemType string, userID bson.ObjectId) (*item, bool, error) {
+	var changed bool
+	it, err := s.upsert(itemID, itemType, func(it *item) {
+		changed = hasStarred(it, &User{ID: userID})
+		removeStargazer(it, userID)
+	})
+	return it, changed, err
+}
+
+func (s *boltStore) AddComment(itemID, itemType string, cm comment) error {
+	_, err := s.upsert(itemID, itemType, func(it *item) {
+		it.Comments = append(it.Comments, cm)
+	})
+	return err
+}
+
+func (s *boltStore) UpdateComment(itemID string, commentID bson.ObjectId, text string, updatedAt time.Time) error {
+	return s.update(itemID, func(it *item) error {
+		return editComment(it, commentID, text, updatedAt)
+	})
+}
+
+func (s *boltStore) DeleteComment(itemID string, commentID bson.ObjectId) error {
+	return s.update(itemID, func(it *item) error {
+		return removeComment(it, commentID)
+	})
+}
+
+// stats returns the counts of the charts of the repo, or of every chart if
+// the repo is empty
+func (s *boltStore) stats(repo string, hiddenAuthors []bson.ObjectId) ([]itemStats, error) {
+	items, err := s.ListItems(repo)
+	if err != nil {
+		return nil, err
+	}
+	var stats []itemStats
+	for _, it := range items {
+		if isItemType(it, "chart") {
+			stats = append(stats, statsOf(it, hiddenAuthors))
+		}
+	}
+	return stats, nil
+}
+
+func (s *boltStore) ListRepos(hiddenAuthors []bson.ObjectId) ([]repoStats, error) {
+	stats, err := s.stats("", hiddenAuthors)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateRepos(stats), nil
+}
+
+func (s *boltStore) GetRepoStats(repo string, limit int, hiddenAuthors []bson.ObjectId) (*repoStats, error) {
+	stats, err := s.stats(repo, hiddenAuthors)
+	if err != nil {
+		return nil, err
+	}
+	rs := aggregateRepoStats(repo, stats, limit)
+	if rs == nil {
+		return nil, errNotFound
+	}
+	return rs, nil
+}
+
+func (s *boltStore) MergeItems(fromID, toID string) (*item, error) {
+	if fromID == toID {
+		return nil, errMergeIntoItself
+	}
+
+	var to *item
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		from, err := s.get(tx, fromID)
+		if err != nil {
+			return fmt.Errorf("could not find item %q: %v", fromID, err)
+		}
+
+		to, err = s.find(tx, toID)
+		if err != nil {
+			to = &item{ID: toID, Type: from.Type}
+		}
+		if err := mergeInto(from, to); err != nil {
+			return err
+		}
+
+		if err := s.put(tx, to); err != nil {
+			return fmt.Errorf("could not update item %q: %v", to.ID, err)
+		}
+		return s.put(tx, &item{ID: fromID, Type: from.Type, AliasOf: to.ID})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return to, nil
+}
+
+func (s *boltStore) getAPIToken(tx *bolt.Tx, id []byte) (*apiToken, error) {
+	data := tx.Bucket(apiTokensBucket).Get(id)
+	if data == nil {
+		return nil, errNotFound
+	}
+	var t apiToken
+	if err := bson.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("could not decode API token %s: %v", id, err)
+	}
+	return &t, nil
+}
+
+func (s *boltStore) putAPIToken(tx *bolt.Tx, t *apiToken) error {
+	data, err := bson.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(apiTokensBucket).Put([]byte(t.ID.Hex()), data)
+}
+
+func (s *boltStore) CreateAPIToken(t apiToken) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(apiTokensBucket).Get([]byte(t.ID.Hex())) != nil {
+			return fmt.Errorf("API token %s already exists", t.ID.Hex())
+		}
+		if err := tx.Bucket(apiTokenHashesBucket).Put([]byte(t.Hash), []byte(t.ID.Hex())); err != nil {
+			return err
+		}
+		return s.putAPIToken(tx, &t)
+	})
+}
+
+func (s *boltStore) ListAPITokens(userID bson.ObjectId) ([]*apiToken, error) {
+	var tokens []*apiToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiTokensBucket).ForEach(func(k, v []byte) error {
+			t, err := s.getAPIToken(tx, k)
+			if err != nil {
+				return err
+			}
+			if userID == "" || (t.User != nil && t.User.ID == userID) {
+				tokens = append(tokens, t)
+			}
+			return nil
+		})
+	})
+	sortByCreation(tokens, func(i int) (time.Time, bson.ObjectId) { return tokens[i].CreatedAt, tokens[i].ID })
+	return tokens, err
+}
+
+func (s *boltStore) FindAPIToken(hash string) (*apiToken, error) {
+	var t *apiToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(apiTokenHashesBucket).Get([]byte(hash))
+		if id == nil {
+			return errNotFound
+		}
+		var err error
+		t, err = s.getAPIToken(tx, id)
+		return err
+	})
+	return t, err
+}
+
+func (s *boltStore) DeleteAPIToken(userID, id bson.ObjectId) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t, err := s.getAPIToken(tx, []byte(id.Hex()))
+		if err != nil {
+			return err
+		}
+		if t.User == nil || t.User.ID != userID {
+			return errNotFound
+		}
+		if err := tx.Bucket(apiTokenHashesBucket).Delete([]byte(t.Hash)); err != nil {
+			return err
+		}
+		return tx.Bucket(apiTokensBucket).Delete([]byte(id.Hex()))
+	})
+}
+
+func (s *boltStore) TouchAPIToken(id bson.ObjectId, usedAt time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t, err := s.getAPIToken(tx, []byte(id.Hex()))
+		if err != nil {
+			return err
+		}
+		t.LastUsedAt = &usedAt
+		return s.putAPIToken(tx, t)
+	})
+}
+
+func (s *boltStore) CreateRevocation(r revocation) error {
+	data, err := bson.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(revocationsBucket).Get([]byte(r.ID.Hex())) != nil {
+			return fmt.Errorf("revocation %s already exists", r.ID.Hex())
+		}
+		return tx.Bucket(revocationsBucket).Put([]byte(r.ID.Hex()), data)
+	})
+}
+
+func (s *boltStore) ListRevocations(now time.Time) ([]*revocation, error) {
+	var list []*revocation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(revocationsBucket).ForEach(func(k, v []byte) error {
+			var r revocation
+			if err := bson.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("could not decode revocation %s: %v", k, err)
+			}
+			if r.inEffect(now) {
+				list = append(list, &r)
+			}
+			return nil
+		})
+	})
+	sortByCreation(list, func(i int) (time.Time, bson.ObjectId) { return list[i].CreatedAt, list[i].ID })
+	return list, err
+}
+
+func (s *boltStore) DeleteRevocation(id bson.ObjectId) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(revocationsBucket)
+		if b.Get([]byte(id.Hex())) == nil {
+			return errNotFound
+		}
+		return b.Delete([]byte(id.Hex()))
+	})
+}
+
+func (s *boltStore) CreateSanction(sn sanction) error {
+	data, err := bson.Marshal(sn)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(sanctionsBucket).Get([]byte(sn.ID.Hex())) != nil {
+			return fmt.Errorf("sanction %s already exists", sn.ID.Hex())
+		}
+		return tx.Bucket(sanctionsBucket).Put([]byte(sn.ID.Hex()), data)
+	})
+}
+
+func (s *boltStore) ListSanctions(now time.Time) ([]*sanction, error) {
+	var list []*sanction
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sanctionsBucket).ForEach(func(k, v []byte) error {
+			var sn sanction
+			if err := bson.Unmarshal(v, &sn); err != nil {
+				return fmt.Errorf("could not decode sanction %s: %v", k, err)
+			}
+			if sn.inEffect(now) {
+				list = append(list, &sn)
+			}
+			return nil
+		})
+	})
+	sortByCreation(list, func(i int) (time.Time, bson.ObjectId) { return list[i].CreatedAt, list[i].ID })
+	return list, err
+}
+
+func (s *boltStore) DeleteSanction(id bson.ObjectId) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sanctionsBucket)
+		if b.Get([]byte(id.Hex())) == nil {
+			return errNotFound
+		}
+		return b.Delete([]byte(id.Hex()))
+	})
+}
+
+// Snapshot writes a consistent copy of the database to w, which can be
+// opened with --storage=bolt to restore it. Writes aren't blocked meanwhile.
+func (s *boltStore) Snapshot(w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// SnapshotFile atomically replaces the file at path with a snapshot
+func (s *boltStore) SnapshotFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := s.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// SnapshotEvery writes a snapshot to path at every interval until stop is
+// closed
+func (s *boltStore) SnapshotEvery(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SnapshotFile(path); err != nil {
+				log.WithError(err).WithField("path", path).Error("could not write snapshot")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ratesvc")
+	require.NoError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	n := 0
+	testStore(t, func(t *testing.T) Store {
+		n++
+		s, err := newBoltStore(filepath.Join(dir, fmt.Sprintf("%d.bolt", n)))
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestBoltStoreConcurrentWriters(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := newBoltStore(filepath.Join(dir, "ratesvc.bolt"))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart"}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := s.AddStar("stable/wordpress", "chart", bson.NewObjectId(), "")
+			assert.NoError(t, err)
+			assert.NoError(t, s.AddComment("stable/wordpress", "chart", comment{ID: bson.NewObjectId(), Text: "Hello", CreatedAt: time.Now()}))
+		}()
+	}
+	wg.Wait()
+
+	it, err := s.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	assert.Len(t, it.StargazersIDs, 20)
+	assert.Len(t, it.Comments, 20)
+}
+
+func TestBoltStoreSnapshot(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := newBoltStore(filepath.Join(dir, "ratesvc.bolt"))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart", StargazersIDs: []bson.ObjectId{bson.NewObjectId()}}))
+
+	snapshot := filepath.Join(dir, "snapshot.bolt")
+	require.NoError(t, s.SnapshotFile(snapshot))
+	// Later writes aren't part of the snapshot
+	_, _, err = s.AddStar("stable/wordpress", "chart", bson.NewObjectId(), "")
+	require.NoError(t, err)
+
+	restored, err := newBoltStore(snapshot)
+	require.NoError(t, err)
+	defer restored.Close()
+	it, err := restored.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	assert.Len(t, it.StargazersIDs, 1)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2, "temporary snapshot files are removed")
+}
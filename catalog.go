@@ -0,0 +1,224 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// errUnknownItem is returned when creating an item the catalogue doesn't know
+var errUnknownItem = errors.New("item not found")
+
+// itemValidator checks that items exist before they are created
+type itemValidator interface {
+	ItemExists(itemType, id string) bool
+}
+
+// validator is only set when a catalogue is configured, otherwise any item ID
+// is accepted
+var validator itemValidator
+
+// checkItemExists returns errUnknownItem if a validator is configured and
+// doesn't know the item
+func checkItemExists(itemType, id string) error {
+	if validator != nil && !validator.ItemExists(itemType, id) {
+		return errUnknownItem
+	}
+	return nil
+}
+
+// catalogSource loads the IDs of the charts in a catalogue
+type catalogSource interface {
+	Load() (map[string]struct{}, error)
+}
+
+// catalog is an itemValidator that keeps the chart IDs of a catalogue source
+// in memory. Only charts are validated, other item types are always accepted.
+type catalog struct {
+	source catalogSource
+
+	mu     sync.RWMutex
+	charts map[string]struct{}
+}
+
+// newCatalog returns a catalog for the given source, which is either the path
+// of a Helm index.yaml file or a directory of them, or an HTTP(S) URL
+func newCatalog(source string) *catalog {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return &catalog{source: &httpCatalogSource{url: source, client: &http.Client{Timeout: 30 * time.Second}}}
+	}
+	return &catalog{source: &fileCatalogSource{path: source}}
+}
+
+// ItemExists returns true if the chart is in the catalogue
+func (c *catalog) ItemExists(itemType, id string) bool {
+	if itemType != "chart" {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.charts[id]
+	return ok
+}
+
+// Refresh reloads the catalogue, keeping the previous data if it fails
+func (c *catalog) Refresh() error {
+	charts, err := c.source.Load()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.charts = charts
+	c.mu.Unlock()
+	log.WithFields(log.Fields{"charts": len(charts)}).Info("loaded catalogue")
+	return nil
+}
+
+// RefreshEvery reloads the catalogue periodically until stop is closed
+func (c *catalog) RefreshEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Refresh(); err != nil {
+				log.WithError(err).Error("could not refresh catalogue")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// helmIndex is the subset of a Helm repository index.yaml we need
+type helmIndex struct {
+	Entries map[string]interface{} `yaml:"entries"`
+}
+
+// fileCatalogSource reads Helm index files. The repo name of each index is
+// the name of the file without extension, or of its directory if the file is
+// called index.yaml.
+type fileCatalogSource struct {
+	path string
+}
+
+func (s *fileCatalogSource) Load() (map[string]struct{}, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	charts := map[string]struct{}{}
+	if !info.IsDir() {
+		return charts, loadIndexFile(s.path, charts)
+	}
+
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		path := filepath.Join(s.path, f.Name())
+		if f.IsDir() {
+			path = filepath.Join(path, "index.yaml")
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				continue
+			}
+		} else if ext := filepath.Ext(f.Name()); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		if err := loadIndexFile(path, charts); err != nil {
+			return nil, err
+		}
+	}
+	return charts, nil
+}
+
+// loadIndexFile adds the charts of a Helm index file to charts
+func loadIndexFile(path string, charts map[string]struct{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var index helmIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	base := filepath.Base(path)
+	repo := strings.TrimSuffix(base, filepath.Ext(base))
+	if repo == "index" {
+		// Relative paths like index.yaml have no directory name of their own
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		repo = filepath.Base(filepath.Dir(abs))
+	}
+	for name := range index.Entries {
+		charts[repo+"/"+name] = struct{}{}
+	}
+	return nil
+}
+
+// httpCatalogSource fetches the list of charts from an endpoint with the same
+// response format as the hub's chart service, e.g. /v1/charts:
+//	{
+//		"data": [{"id": "stable/wordpress"}, ...]
+//	}
+type httpCatalogSource struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpCatalogSource) Load() (map[string]struct{}, error) {
+	res, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", res.StatusCode, s.url)
+	}
+
+	var body struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", s.url, err)
+	}
+
+	charts := map[string]struct{}{}
+	for _, c := range body.Data {
+		charts[c.ID] = struct{}{}
+	}
+	return charts, nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testIndex = `apiVersion: v1
+entries:
+  wordpress:
+  - name: wordpress
+    version: 0.7.5
+  drupal:
+  - name: drupal
+    version: 0.11.3
+`
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func TestFileCatalogSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "stable.yaml"), testIndex)
+	writeFile(t, filepath.Join(dir, "incubator", "index.yaml"), "entries:\n  foo: []\n")
+	writeFile(t, filepath.Join(dir, "README.md"), "not an index")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "empty"), 0755))
+
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{"named file", filepath.Join(dir, "stable.yaml"), []string{"stable/wordpress", "stable/drupal"}},
+		{"index file", filepath.Join(dir, "incubator", "index.yaml"), []string{"incubator/foo"}},
+		{"directory", dir, []string{"stable/wordpress", "stable/drupal", "incubator/foo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			charts, err := (&fileCatalogSource{path: tt.path}).Load()
+			require.NoError(t, err)
+			assert.Len(t, charts, len(tt.want))
+			for _, id := range tt.want {
+				assert.Contains(t, charts, id)
+			}
+		})
+	}
+
+	_, err = (&fileCatalogSource{path: filepath.Join(dir, "missing.yaml")}).Load()
+	assert.Error(t, err)
+
+	// The repo of an index file given by a bare relative path is still the
+	// name of its directory
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(filepath.Join(dir, "incubator")))
+	defer os.Chdir(wd)
+	charts, err := (&fileCatalogSource{path: "index.yaml"}).Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"incubator/foo": {}}, charts)
+}
+
+func TestHTTPCatalogSource(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"data": [{"id": "stable/wordpress"}, {"id": "stable/drupal"}]}`))
+	}))
+	defer ts.Close()
+
+	c := newCatalog(ts.URL)
+	require.NoError(t, c.Refresh())
+	assert.True(t, c.ItemExists("chart", "stable/wordpress"))
+	assert.False(t, c.ItemExists("chart", "stable/wordpres"))
+	// Only charts are in the catalogue
+	assert.True(t, c.ItemExists("function", "hello"))
+
+	// Failed refreshes keep the previous data
+	status = http.StatusInternalServerError
+	assert.Error(t, c.Refresh())
+	assert.True(t, c.ItemExists("chart", "stable/wordpress"))
+}
+
+func TestUnknownItemsAreRejected(t *testing.T) {
+	var m mock.Mock
+	m.On("One", &item{}).Return(errors.New("not found"))
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	c := &catalog{charts: map[string]struct{}{"stable/wordpress": {}}}
+	validator = c
+	defer func() { validator = nil }()
+
+	t.Run("star", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/v1/stars", bytes.NewBufferString(`{"id": "stable/wordpres", "has_starred": true}`))
+		UpdateStar(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("comment", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/comments/stable/wordpres", bytes.NewBufferString(`{"text": "Hello"}`))
+		CreateComment(w, req, Params{"repo": "stable", "chartName": "wordpres"})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+	m.AssertNotCalled(t, "Insert", mock.Anything)
+	m.AssertNotCalled(t, "Apply", mock.Anything, mock.Anything)
+
+	t.Run("known chart", func(t *testing.T) {
+		onUpsertItem(&m, "chart", bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}}, nil)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/v1/stars", bytes.NewBufferString(`{"id": "stable/wordpress", "has_starred": true}`))
+		UpdateStar(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+	})
+}
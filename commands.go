@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// runCommand runs an administrative subcommand instead of the server
+func runCommand(args []string, out io.Writer) error {
+	switch args[0] {
+	case "merge-items":
+		if len(args) != 3 {
+			return errors.New("usage: ratesvc merge-items <from-id> <to-id>")
+		}
+		it, err := store.MergeItems(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "merged %s into %s: %d stars, %d comments\n", args[1], it.ID, len(it.StargazersIDs), len(it.Comments))
+		return nil
+	case "export":
+		if len(args) > 2 {
+			return errors.New("usage: ratesvc export [<file>]")
+		}
+		w := out
+		if len(args) == 2 && args[1] != "-" {
+			f, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		bw := bufio.NewWriter(w)
+		if err := exportData(store, bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "Report what would be imported without writing anything")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("usage: ratesvc import [--dry-run] <file>")
+		}
+		var r io.Reader = os.Stdin
+		if fs.Arg(0) != "-" {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		stats, err := importData(store, r, *dryRun)
+		if *dryRun {
+			fmt.Fprintf(out, "would import %s\n", stats)
+		} else {
+			fmt.Fprintf(out, "imported %s\n", stats)
+		}
+		return err
+	case "snapshot":
+		if len(args) != 2 {
+			return errors.New("usage: ratesvc --storage=bolt snapshot <file>")
+		}
+		bs, ok := store.(*boltStore)
+		if !ok {
+			return errors.New("snapshots are only supported by the bolt storage")
+		}
+		if err := bs.SnapshotFile(args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "wrote snapshot to %s\n", args[1])
+		return nil
+	case "migrate":
+		return runMigrate(args, out)
+	case "indexes":
+		return runIndexes(args, out)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// runMigrate applies, reverts or lists the MongoDB migrations
+func runMigrate(args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: ratesvc migrate up|down|status")
+	}
+	ms, ok := store.(*mongoStore)
+	if !ok {
+		return errors.New("migrations are only used by the mongo storage, SQL schemas are migrated when opening the database")
+	}
+	m := newMigrator(ms.session)
+
+	switch args[1] {
+	case "up":
+		applied, err := m.Up()
+		for _, mg := range applied {
+			fmt.Fprintf(out, "applied migration %d: %s\n", mg.Version, mg.Description)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "no pending migrations")
+		}
+		return err
+	case "down":
+		mg, err := m.Down()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "reverted migration %d: %s\n", mg.Version, mg.Description)
+		return nil
+	case "status":
+		status, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%d\t%s\t%s\n", s.Version, state, s.Description)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[1])
+}
+
+// runIndexes ensures the declared MongoDB indexes or reports the drift
+// between them and the existing indexes
+func runIndexes(args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: ratesvc indexes ensure|status")
+	}
+	ms, ok := store.(*mongoStore)
+	if !ok {
+		return errors.New("indexes are only managed for the mongo storage, SQL indexes are created by the schema migrations")
+	}
+	db, closer := ms.session.DB()
+	defer closer()
+
+	var drift []indexDrift
+	var err error
+	switch args[1] {
+	case "ensure":
+		drift, err = ensureIndexes(db)
+	case "status":
+		drift, err = indexesDrift(db)
+	default:
+		return fmt.Errorf("unknown indexes command %q, expected ensure or status", args[1])
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		fmt.Fprintln(out, d)
+	}
+	if len(drift) == 0 {
+		fmt.Fprintln(out, "indexes match the declared ones")
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsConfig is the cross-origin resource sharing policy of the /v1 routes
+type corsConfig struct {
+	// Origins allowed to call the API, "*" for any
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// Whether browsers send cookies with cross-origin requests
+	AllowCredentials bool
+	// How long browsers may cache preflight responses, not sent if zero
+	MaxAge time.Duration
+}
+
+// cors answers preflight requests and adds the CORS headers to responses. It
+// runs before the router, which doesn't route OPTIONS requests.
+type cors struct {
+	config         corsConfig
+	anyOrigin      bool
+	origins        map[string]bool
+	methods        map[string]bool
+	headers        map[string]bool
+	allowedMethods string
+}
+
+func newCORS(config corsConfig) (*cors, error) {
+	c := &cors{config: config, origins: map[string]bool{}, methods: map[string]bool{}, headers: map[string]bool{}}
+	for _, o := range config.AllowedOrigins {
+		if o == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		origin := normalizeOrigin(o)
+		if origin == "" {
+			return nil, errors.New("invalid CORS origin " + strconv.Quote(o) + ", expected scheme://host[:port]")
+		}
+		c.origins[origin] = true
+	}
+	// Any site could then act as the logged in user
+	if c.anyOrigin && config.AllowCredentials {
+		return nil, errors.New("CORS credentials can't be allowed for any origin")
+	}
+	var methods []string
+	for _, m := range config.AllowedMethods {
+		m = strings.ToUpper(m)
+		c.methods[m] = true
+		methods = append(methods, m)
+	}
+	c.allowedMethods = strings.Join(methods, ", ")
+	for _, h := range config.AllowedHeaders {
+		c.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return c, nil
+}
+
+// originAllowed returns whether the origin may call the API
+func (c *cors) originAllowed(origin string) bool {
+	return c.anyOrigin || c.origins[normalizeOrigin(origin)]
+}
+
+// allowedHeaders returns the requested headers if they are all allowed
+func (c *cors) allowedHeaders(requested string) (string, bool) {
+	var headers []string
+	for _, h := range strings.Split(requested, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if !c.headers[http.CanonicalHeaderKey(h)] {
+			return "", false
+		}
+		headers = append(headers, h)
+	}
+	return strings.Join(headers, ", "), true
+}
+
+// ServeHTTP implements negroni.Handler
+func (c *cors) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	origin := req.Header.Get("Origin")
+	if !strings.HasPrefix(req.URL.Path, "/v1/") || origin == "" {
+		next(w, req)
+		return
+	}
+	// Responses depend on the origin, so caches must not share them
+	w.Header().Add("Vary", "Origin")
+
+	preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+	if !preflight {
+		if c.originAllowed(origin) {
+			c.allowOrigin(w, origin)
+		}
+		next(w, req)
+		return
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	// Without the CORS headers, browsers don't send the actual request
+	method := strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	headers, headersAllowed := c.allowedHeaders(req.Header.Get("Access-Control-Request-Headers"))
+	if c.originAllowed(origin) && c.methods[method] && headersAllowed {
+		c.allowOrigin(w, origin)
+		w.Header().Set("Access-Control-Allow-Methods", c.allowedMethods)
+		if headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		if c.config.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.config.MaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *cors) allowOrigin(w http.ResponseWriter, origin string) {
+	if c.anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.config.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/negroni"
+)
+
+func corsServer(t *testing.T, config corsConfig) http.Handler {
+	c, err := newCORS(config)
+	require.NoError(t, err)
+	n := negroni.New(c)
+	n.UseHandler(newRouter())
+	return n
+}
+
+func TestCORSPreflight(t *testing.T) {
+	store = newMemoryStore()
+	h := corsServer(t, corsConfig{
+		AllowedOrigins:   []string{"https://hub.example.com"},
+		AllowedMethods:   []string{"GET", "PUT", "delete"},
+		AllowedHeaders:   []string{"Authorization", "content-type"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+		allowed bool
+	}{
+		{"allowed", "https://hub.example.com", "PUT", "authorization, Content-Type", true},
+		{"lowercase method", "https://hub.example.com", "delete", "", true},
+		{"other origin", "https://evil.example.com", "PUT", "", false},
+		{"method not allowed", "https://hub.example.com", "PATCH", "", false},
+		{"header not allowed", "https://hub.example.com", "PUT", "X-Requested-With", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("OPTIONS", "/v1/stars", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNoContent, w.Code)
+			assert.Contains(t, w.Header()["Vary"], "Origin")
+			if !tt.allowed {
+				assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+				assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+				return
+			}
+			assert.Equal(t, tt.origin, w.Header().Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+			assert.Equal(t, "GET, PUT, DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+			assert.Equal(t, tt.headers, w.Header().Get("Access-Control-Allow-Headers"))
+			assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+		})
+	}
+}
+
+func TestCORSRequests(t *testing.T) {
+	store = newMemoryStore()
+	h := corsServer(t, corsConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}})
+
+	req := httptest.NewRequest("GET", "/v1/repos", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+
+	// Same-origin requests and other routes are left alone
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/repos", nil))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	req = httptest.NewRequest("OPTIONS", "/live", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestNewCORSErrors(t *testing.T) {
+	_, err := newCORS(corsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	assert.EqualError(t, err, "CORS credentials can't be allowed for any origin")
+	_, err = newCORS(corsConfig{AllowedOrigins: []string{"hub.example.com"}})
+	assert.EqualError(t, err, `invalid CORS origin "hub.example.com", expected scheme://host[:port]`)
+}
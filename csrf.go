@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// trustedOrigins are the origins, besides the service's own, allowed to make
+// cookie-authenticated writes, e.g. https://hub.example.com
+var trustedOrigins []string
+
+// normalizeOrigin returns the scheme://host[:port] of a URL in lower case,
+// or "" if it has none
+func normalizeOrigin(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// originAllowed returns whether the origin is the service's own or trusted.
+// The scheme of the service isn't known behind proxies, so only the hosts of
+// same-site requests are compared.
+func originAllowed(origin string, req *http.Request) bool {
+	origin = normalizeOrigin(origin)
+	if origin == "" {
+		return false
+	}
+	if strings.EqualFold(origin[strings.Index(origin, "://")+3:], req.Host) {
+		return true
+	}
+	for _, o := range trustedOrigins {
+		if normalizeOrigin(o) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the Origin of the request, or that of its Referer
+// for browsers that don't send Origin
+func requestOrigin(req *http.Request) string {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	return req.Header.Get("Referer")
+}
+
+// isSafeMethod returns whether the method doesn't change state
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// csrfProtection rejects state-changing requests authenticated by the session
+// cookie unless they come from an allowed origin. Browsers attach cookies to
+// cross-site requests, but never an Authorization header, so bearer token
+// requests can't be forged.
+func csrfProtection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isSafeMethod(req.Method) || req.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if _, err := req.Cookie(authCookieName); err != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if origin := requestOrigin(req); !originAllowed(origin, req) {
+			log.WithFields(log.Fields{"origin": origin, "path": req.URL.Path}).Info("rejected cross-site request")
+			response.NewErrorResponse(http.StatusForbidden, "cross-site request rejected").Write(w)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// checkSocketOrigin only lets allowed origins open WebSockets, which are
+// authenticated by the session cookie too
+func checkSocketOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	// Non-browser clients don't send an Origin
+	return origin == "" || originAllowed(origin, req)
+}
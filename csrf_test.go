@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	store = newMemoryStore()
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	oldOrigins := trustedOrigins
+	trustedOrigins = []string{"https://Hub.example.com/"}
+	defer func() { getCurrentUser, trustedOrigins = oldGetCurrentUser, oldOrigins }()
+	r := newRouter()
+
+	tests := []struct {
+		name    string
+		method  string
+		cookie  bool
+		headers map[string]string
+		allowed bool
+	}{
+		{"cross-site", "PUT", true, map[string]string{"Origin": "https://evil.example.com"}, false},
+		{"cross-site referer", "PUT", true, map[string]string{"Referer": "https://evil.example.com/page"}, false},
+		{"opaque origin", "PUT", true, map[string]string{"Origin": "null"}, false},
+		{"no origin", "PUT", true, nil, false},
+		{"same origin", "PUT", true, map[string]string{"Origin": "http://ratesvc.example.com"}, true},
+		{"trusted origin", "PUT", true, map[string]string{"Origin": "https://hub.example.com"}, true},
+		{"trusted referer", "PUT", true, map[string]string{"Referer": "https://hub.example.com/charts/stable/wordpress"}, true},
+		{"other scheme", "PUT", true, map[string]string{"Origin": "http://hub.example.com"}, false},
+		{"bearer token", "PUT", true, map[string]string{"Origin": "https://evil.example.com", "Authorization": "Bearer token"}, true},
+		{"no cookie", "PUT", false, map[string]string{"Origin": "https://evil.example.com"}, true},
+		{"safe method", "GET", true, map[string]string{"Origin": "https://evil.example.com"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://ratesvc.example.com/v1/stars", bytes.NewBufferString(`{"id": "stable/wordpress", "has_starred": true}`))
+			if tt.cookie {
+				req.AddCookie(&http.Cookie{Name: authCookieName, Value: "session"})
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if tt.allowed {
+				assert.NotEqual(t, http.StatusForbidden, w.Code, w.Body.String())
+			} else {
+				assert.Equal(t, http.StatusForbidden, w.Code)
+				assert.Contains(t, w.Body.String(), "cross-site request rejected")
+			}
+		})
+	}
+}
+
+func TestCheckSocketOrigin(t *testing.T) {
+	oldOrigins := trustedOrigins
+	trustedOrigins = []string{"https://hub.example.com"}
+	defer func() { trustedOrigins = oldOrigins }()
+
+	for origin, want := range map[string]bool{
+		"":                            true,
+		"https://ratesvc.example.com": true,
+		"https://hub.example.com":     true,
+		"https://evil.example.com":    false,
+	} {
+		req := httptest.NewRequest("GET", "http://ratesvc.example.com/v1/ws/comments/stable/wordpress", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		assert.Equal(t, want, checkSocketOrigin(req), origin)
+	}
+}
@@ -0,0 +1,491 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// exportSchemaVersion is the version of the export format, to be increased
+// whenever a change makes older imports read it wrong. Version 2 added API
+// tokens, revocations and sanctions, which version 1 exports don't have.
+const exportSchemaVersion = 2
+
+// Kinds of export records
+const (
+	recordHeader     = "header"
+	recordItem       = "item"
+	recordStar       = "star"
+	recordComment    = "comment"
+	recordAlias      = "alias"
+	recordAPIToken   = "api_token"
+	recordRevocation = "revocation"
+	recordSanction   = "sanction"
+)
+
+// exportRecord is a line of an export. The header comes first, each item is
+// followed by its stars and comments, then come aliases, API tokens,
+// revocations and sanctions.
+type exportRecord struct {
+	Kind string `json:"kind"`
+	// header
+	SchemaVersion int        `json:"schema_version,omitempty"`
+	ExportedAt    *time.Time `json:"exported_at,omitempty"`
+	// item and alias
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type,omitempty"`
+	AliasOf string `json:"alias_of,omitempty"`
+	// star and comment
+	ItemID string `json:"item_id,omitempty"`
+	// star
+	UserID bson.ObjectId `json:"user_id,omitempty"`
+	// star and comment
+	Version string `json:"version,omitempty"`
+	// comment
+	CommentID bson.ObjectId `json:"comment_id,omitempty"`
+	Text      string        `json:"text,omitempty"`
+	CreatedAt *time.Time    `json:"created_at,omitempty"`
+	UpdatedAt *time.Time    `json:"updated_at,omitempty"`
+	Author    *exportAuthor `json:"author,omitempty"`
+	// api_token
+	APIToken *exportAPIToken `json:"api_token,omitempty"`
+	// revocation
+	Revocation *revocation `json:"revocation,omitempty"`
+	// sanction
+	Sanction *sanction `json:"sanction,omitempty"`
+}
+
+// exportAuthor includes the email of the author, which the API hides
+type exportAuthor struct {
+	ID    bson.ObjectId `json:"id"`
+	Name  string        `json:"name"`
+	Email string        `json:"email,omitempty"`
+}
+
+// exportAPIToken includes the owner and hash of the token, which the API
+// hides. Tokens themselves are never stored, so they can't be exported.
+type exportAPIToken struct {
+	ID         bson.ObjectId `json:"id"`
+	Name       string        `json:"name"`
+	Scopes     []string      `json:"scopes"`
+	User       *exportAuthor `json:"user"`
+	Hash       string        `json:"hash"`
+	CreatedAt  time.Time     `json:"created_at"`
+	LastUsedAt *time.Time    `json:"last_used_at,omitempty"`
+}
+
+// importStats counts what an import changed
+type importStats struct {
+	Items, Stars, Comments, Aliases, APITokens, Revocations, Sanctions int
+}
+
+func (s importStats) String() string {
+	return fmt.Sprintf("%d items, %d stars, %d comments, %d aliases, %d API tokens, %d revocations, %d sanctions",
+		s.Items, s.Stars, s.Comments, s.Aliases, s.APITokens, s.Revocations, s.Sanctions)
+}
+
+// exportData writes every item of the store with its stars and comments,
+// followed by the API tokens and the revocations and sanctions in effect, as
+// JSON Lines
+func exportData(s Store, w io.Writer) error {
+	items, err := s.ListItems("")
+	if err != nil {
+		return err
+	}
+	aliases, err := s.ListAliases()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	now := getTimestamp().UTC()
+	if err := enc.Encode(exportRecord{Kind: recordHeader, SchemaVersion: exportSchemaVersion, ExportedAt: &now}); err != nil {
+		return err
+	}
+
+	for _, it := range items {
+		if err := enc.Encode(exportRecord{Kind: recordItem, ID: it.ID, Type: it.Type}); err != nil {
+			return err
+		}
+		for _, id := range it.StargazersIDs {
+			r := exportRecord{Kind: recordStar, ItemID: it.ID, UserID: id, Version: it.StargazerVersions[id.Hex()]}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		for _, cm := range it.Comments {
+			createdAt := cm.CreatedAt
+			r := exportRecord{
+				Kind:      recordComment,
+				ItemID:    it.ID,
+				CommentID: cm.ID,
+				Text:      cm.Text,
+				Version:   cm.Version,
+				CreatedAt: &createdAt,
+				UpdatedAt: cm.UpdatedAt,
+			}
+			if cm.Author != nil {
+				r.Author = &exportAuthor{ID: cm.Author.ID, Name: cm.Author.Name, Email: cm.Author.Email}
+			}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Sorted so that exports of the same data are identical
+	var from []string
+	for id := range aliases {
+		from = append(from, id)
+	}
+	sort.Strings(from)
+	for _, id := range from {
+		if err := enc.Encode(exportRecord{Kind: recordAlias, ID: id, AliasOf: aliases[id]}); err != nil {
+			return err
+		}
+	}
+
+	tokens, err := s.ListAPITokens("")
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		r := exportRecord{Kind: recordAPIToken, APIToken: &exportAPIToken{
+			ID:         t.ID,
+			Name:       t.Name,
+			Scopes:     t.Scopes,
+			Hash:       t.Hash,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: t.LastUsedAt,
+		}}
+		if t.User != nil {
+			r.APIToken.User = &exportAuthor{ID: t.User.ID, Name: t.User.Name, Email: t.User.Email}
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	revocations, err := s.ListRevocations(now)
+	if err != nil {
+		return err
+	}
+	for _, rv := range revocations {
+		if err := enc.Encode(exportRecord{Kind: recordRevocation, Revocation: rv}); err != nil {
+			return err
+		}
+	}
+
+	sanctions, err := s.ListSanctions(now)
+	if err != nil {
+		return err
+	}
+	for _, sn := range sanctions {
+		if err := enc.Encode(exportRecord{Kind: recordSanction, Sanction: sn}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importer applies export records to a store, skipping the data the store
+// already has so that an export can be imported again safely
+type importer struct {
+	store  Store
+	dryRun bool
+	stats  importStats
+	// Item the last records referred to, kept up to date with the changes
+	current *item
+	// Aliases of the store, loaded with the first alias record
+	aliases map[string]string
+	// IDs of the revocations and sanctions of the store, loaded with the
+	// first record of each kind
+	revocations, sanctions map[bson.ObjectId]bool
+}
+
+// importData reads an export and adds its data to the store. With dryRun,
+// nothing is written but the returned counts are the same.
+func importData(s Store, r io.Reader, dryRun bool) (importStats, error) {
+	im := &importer{store: s, dryRun: dryRun}
+	scanner := bufio.NewScanner(r)
+	// Comments may be long
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return im.stats, fmt.Errorf("line %d: %v", line, err)
+		}
+		if line == 1 {
+			if rec.Kind != recordHeader {
+				return im.stats, fmt.Errorf("line 1: missing export header")
+			}
+			// Older exports only lack some kinds of records
+			if rec.SchemaVersion < 1 || rec.SchemaVersion > exportSchemaVersion {
+				return im.stats, fmt.Errorf("line 1: unsupported schema version %d, expected at most %d", rec.SchemaVersion, exportSchemaVersion)
+			}
+			continue
+		}
+		if err := im.apply(&rec); err != nil {
+			return im.stats, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return im.stats, err
+	}
+	if line == 0 {
+		return im.stats, fmt.Errorf("empty export")
+	}
+	return im.stats, nil
+}
+
+func (im *importer) apply(rec *exportRecord) error {
+	switch rec.Kind {
+	case recordItem:
+		return im.importItem(rec)
+	case recordStar:
+		return im.importStar(rec)
+	case recordComment:
+		return im.importComment(rec)
+	case recordAlias:
+		return im.importAlias(rec)
+	case recordAPIToken:
+		return im.importAPIToken(rec)
+	case recordRevocation:
+		return im.importRevocation(rec)
+	case recordSanction:
+		return im.importSanction(rec)
+	}
+	return fmt.Errorf("unknown record kind %q", rec.Kind)
+}
+
+// load makes the item with the ID the current one
+func (im *importer) load(id string) error {
+	if im.current != nil && im.current.ID == id {
+		return nil
+	}
+	it, err := im.store.GetItem(id)
+	if err != nil {
+		return fmt.Errorf("could not find item %q: %v", id, err)
+	}
+	im.current = it
+	return nil
+}
+
+func (im *importer) importItem(rec *exportRecord) error {
+	if rec.ID == "" {
+		return fmt.Errorf("item without id")
+	}
+	it, err := im.store.GetItem(rec.ID)
+	if err == nil {
+		im.current = it
+		return nil
+	}
+	if err != errNotFound {
+		return err
+	}
+
+	im.current = &item{ID: rec.ID, Type: rec.Type}
+	im.stats.Items++
+	if im.dryRun {
+		return nil
+	}
+	return im.store.CreateItem(item{ID: rec.ID, Type: rec.Type})
+}
+
+func (im *importer) importStar(rec *exportRecord) error {
+	if !rec.UserID.Valid() {
+		return fmt.Errorf("star without user_id")
+	}
+	if err := im.load(rec.ItemID); err != nil {
+		return err
+	}
+
+	it := im.current
+	if hasStarred(it, &User{ID: rec.UserID}) {
+		if rec.Version == "" || it.StargazerVersions[rec.UserID.Hex()] == rec.Version {
+			return nil
+		}
+		setStargazerVersion(it, rec.UserID, rec.Version)
+		if im.dryRun {
+			return nil
+		}
+		_, _, err := im.store.AddStar(it.ID, it.Type, rec.UserID, rec.Version)
+		return err
+	}
+
+	addStargazer(it, rec.UserID, rec.Version)
+	im.stats.Stars++
+	if im.dryRun {
+		return nil
+	}
+	_, _, err := im.store.AddStar(it.ID, it.Type, rec.UserID, rec.Version)
+	return err
+}
+
+func (im *importer) importComment(rec *exportRecord) error {
+	if !rec.CommentID.Valid() || rec.CreatedAt == nil {
+		return fmt.Errorf("comment without comment_id or created_at")
+	}
+	if err := im.load(rec.ItemID); err != nil {
+		return err
+	}
+
+	it := im.current
+	for _, cm := range it.Comments {
+		if cm.ID == rec.CommentID {
+			return nil
+		}
+	}
+
+	cm := comment{ID: rec.CommentID, Text: rec.Text, Version: rec.Version, CreatedAt: *rec.CreatedAt, UpdatedAt: rec.UpdatedAt}
+	if rec.Author != nil {
+		cm.Author = &User{ID: rec.Author.ID, Name: rec.Author.Name, Email: rec.Author.Email}
+	}
+	it.Comments = append(it.Comments, cm)
+	im.stats.Comments++
+	if im.dryRun {
+		return nil
+	}
+	return im.store.AddComment(it.ID, it.Type, cm)
+}
+
+func (im *importer) importAlias(rec *exportRecord) error {
+	if rec.ID == "" || rec.AliasOf == "" {
+		return fmt.Errorf("alias without id or alias_of")
+	}
+	if im.aliases == nil {
+		aliases, err := im.store.ListAliases()
+		if err != nil {
+			return err
+		}
+		im.aliases = aliases
+	}
+	if _, ok := im.aliases[rec.ID]; ok {
+		return nil
+	}
+
+	im.aliases[rec.ID] = rec.AliasOf
+	im.current = nil
+	im.stats.Aliases++
+	if im.dryRun {
+		return nil
+	}
+	// Merging leaves the alias, moving anything stored under the old ID
+	if _, err := im.store.GetItem(rec.ID); err == errNotFound {
+		target, err := im.store.GetItem(rec.AliasOf)
+		if err != nil {
+			return fmt.Errorf("could not find item %q: %v", rec.AliasOf, err)
+		}
+		if err := im.store.CreateItem(item{ID: rec.ID, Type: target.Type}); err != nil {
+			return err
+		}
+	}
+	_, err := im.store.MergeItems(rec.ID, rec.AliasOf)
+	return err
+}
+
+func (im *importer) importAPIToken(rec *exportRecord) error {
+	t := rec.APIToken
+	if t == nil || !t.ID.Valid() || t.Hash == "" || t.User == nil {
+		return fmt.Errorf("api_token without id, hash or user")
+	}
+	if _, err := im.store.FindAPIToken(t.Hash); err == nil {
+		return nil
+	} else if err != errNotFound {
+		return err
+	}
+
+	im.stats.APITokens++
+	if im.dryRun {
+		return nil
+	}
+	return im.store.CreateAPIToken(apiToken{
+		ID:         t.ID,
+		Name:       t.Name,
+		Scopes:     t.Scopes,
+		User:       &User{ID: t.User.ID, Name: t.User.Name, Email: t.User.Email},
+		Hash:       t.Hash,
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+	})
+}
+
+func (im *importer) importRevocation(rec *exportRecord) error {
+	rv := rec.Revocation
+	if rv == nil || !rv.ID.Valid() {
+		return fmt.Errorf("revocation without id")
+	}
+	if im.revocations == nil {
+		// The zero time lists the lapsed revocations too
+		list, err := im.store.ListRevocations(time.Time{})
+		if err != nil {
+			return err
+		}
+		im.revocations = map[bson.ObjectId]bool{}
+		for _, r := range list {
+			im.revocations[r.ID] = true
+		}
+	}
+	if im.revocations[rv.ID] {
+		return nil
+	}
+
+	im.revocations[rv.ID] = true
+	im.stats.Revocations++
+	if im.dryRun {
+		return nil
+	}
+	return im.store.CreateRevocation(*rv)
+}
+
+func (im *importer) importSanction(rec *exportRecord) error {
+	sn := rec.Sanction
+	if sn == nil || !sn.ID.Valid() {
+		return fmt.Errorf("sanction without id")
+	}
+	if im.sanctions == nil {
+		// The zero time lists the lapsed sanctions too
+		list, err := im.store.ListSanctions(time.Time{})
+		if err != nil {
+			return err
+		}
+		im.sanctions = map[bson.ObjectId]bool{}
+		for _, s := range list {
+			im.sanctions[s.ID] = true
+		}
+	}
+	if im.sanctions[sn.ID] {
+		return nil
+	}
+
+	im.sanctions[sn.ID] = true
+	im.stats.Sanctions++
+	if im.dryRun {
+		return nil
+	}
+	return im.store.CreateSanction(*sn)
+}
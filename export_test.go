@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newExportFixture returns a store with an item with stars and comments, an
+// alias, an API token, a revocation and a sanction
+func newExportFixture(t *testing.T) Store {
+	s := newMemoryStore()
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	updatedAt := time.Date(2017, 11, 3, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, s.CreateItem(item{
+		ID:                "stable/wordpress",
+		Type:              "chart",
+		StargazersIDs:     []bson.ObjectId{alice, bob},
+		StargazerVersions: map[string]string{alice.Hex(): "1.0.0"},
+		Comments: []comment{
+			{ID: bson.NewObjectId(), Text: "Hello", CreatedAt: time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC),
+				Author: &User{ID: alice, Name: "Alice", Email: "alice@example.com"}, Version: "1.0.0"},
+			{ID: bson.NewObjectId(), Text: "World", CreatedAt: time.Date(2017, 11, 2, 0, 0, 0, 0, time.UTC), UpdatedAt: &updatedAt,
+				Author: &User{ID: bob, Name: "Bob"}},
+		},
+	}))
+	require.NoError(t, s.CreateItem(item{ID: "incubator/wordpress", Type: "chart"}))
+	_, err := s.MergeItems("incubator/wordpress", "stable/wordpress")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateItem(item{ID: itemKey("function", "hello"), Type: "function", StargazersIDs: []bson.ObjectId{bob}}))
+	createdAt := time.Date(2017, 11, 4, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, s.CreateAPIToken(apiToken{ID: bson.NewObjectId(), Name: "ci", Scopes: []string{scopeStarsWrite},
+		User: &User{ID: alice, Name: "Alice", Email: "alice@example.com"}, Hash: hashAPIToken("secret"), CreatedAt: createdAt}))
+	require.NoError(t, s.CreateRevocation(revocation{ID: bson.NewObjectId(), TokenID: "session-1", RevokedBy: alice, CreatedAt: createdAt}))
+	require.NoError(t, s.CreateSanction(sanction{ID: bson.NewObjectId(), UserID: bob, Kind: sanctionMute, CreatedBy: alice, CreatedAt: createdAt}))
+	return s
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	src := newExportFixture(t)
+	var export bytes.Buffer
+	require.NoError(t, exportData(src, &export))
+
+	lines := strings.Split(strings.TrimSpace(export.String()), "\n")
+	assert.Contains(t, lines[0], `"schema_version":2`)
+	assert.Len(t, lines, 12, "header, 2 items, 3 stars, 2 comments, 1 alias, 1 API token, 1 revocation and 1 sanction")
+
+	stores := map[string]func() (Store, error){
+		"memory": func() (Store, error) { return newMemoryStore(), nil },
+		"sqlite": func() (Store, error) { return newSQLiteStore(":memory:") },
+		"bolt":   func() (Store, error) { return newBoltStore(dir + "/ratesvc.bolt") },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			dst, err := newStore()
+			require.NoError(t, err)
+			stats, err := importData(dst, bytes.NewReader(export.Bytes()), false)
+			require.NoError(t, err)
+			assert.Equal(t, importStats{Items: 2, Stars: 3, Comments: 2, Aliases: 1, APITokens: 1, Revocations: 1, Sanctions: 1}, stats)
+
+			var reexport bytes.Buffer
+			require.NoError(t, exportData(dst, &reexport))
+			assert.Equal(t, lines[1:], strings.Split(strings.TrimSpace(reexport.String()), "\n")[1:])
+
+			it, err := dst.GetItem("incubator/wordpress")
+			require.NoError(t, err)
+			assert.Equal(t, "stable/wordpress", it.ID)
+			assert.Equal(t, "alice@example.com", it.Comments[0].Author.Email)
+			token, err := dst.FindAPIToken(hashAPIToken("secret"))
+			require.NoError(t, err)
+			assert.Equal(t, "alice@example.com", token.User.Email)
+		})
+	}
+}
+
+func TestImportIsIdempotent(t *testing.T) {
+	var export bytes.Buffer
+	require.NoError(t, exportData(newExportFixture(t), &export))
+
+	dst := newMemoryStore()
+	_, err := importData(dst, bytes.NewReader(export.Bytes()), false)
+	require.NoError(t, err)
+	stats, err := importData(dst, bytes.NewReader(export.Bytes()), false)
+	require.NoError(t, err)
+	assert.Equal(t, importStats{}, stats)
+
+	it, err := dst.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	assert.Len(t, it.StargazersIDs, 2)
+	assert.Len(t, it.Comments, 2)
+}
+
+func TestImportDryRun(t *testing.T) {
+	var export bytes.Buffer
+	require.NoError(t, exportData(newExportFixture(t), &export))
+
+	dst := newMemoryStore()
+	stats, err := importData(dst, bytes.NewReader(export.Bytes()), true)
+	require.NoError(t, err)
+	assert.Equal(t, importStats{Items: 2, Stars: 3, Comments: 2, Aliases: 1, APITokens: 1, Revocations: 1, Sanctions: 1}, stats)
+
+	items, err := dst.ListItems("")
+	require.NoError(t, err)
+	assert.Empty(t, items)
+	tokens, err := dst.ListAPITokens("")
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+func TestImportErrors(t *testing.T) {
+	header := `{"kind":"header","schema_version":1}` + "\n"
+	tests := []struct {
+		name  string
+		input string
+		error string
+	}{
+		{"empty", "", "empty export"},
+		{"no header", `{"kind":"item","id":"stable/wordpress"}`, "line 1: missing export header"},
+		{"newer schema", `{"kind":"header","schema_version":3}`, "line 1: unsupported schema version 3, expected at most 2"},
+		{"invalid json", header + `{"kind":`, "line 2: unexpected end of JSON input"},
+		{"unknown kind", header + `{"kind":"rating"}`, `line 2: unknown record kind "rating"`},
+		{"star of missing item", header + `{"kind":"star","item_id":"stable/wordpress","user_id":"5a0e9183833def3853088836"}`,
+			`line 2: could not find item "stable/wordpress": not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := importData(newMemoryStore(), strings.NewReader(tt.input), false)
+			require.Error(t, err)
+			assert.Equal(t, tt.error, err.Error())
+		})
+	}
+}
+
+func TestExportImportCommands(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	store = newExportFixture(t)
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"export", dir + "/export.jsonl"}, &out))
+
+	store = newMemoryStore()
+	out.Reset()
+	require.NoError(t, runCommand([]string{"import", "--dry-run", dir + "/export.jsonl"}, &out))
+	assert.Equal(t, "would import 2 items, 3 stars, 2 comments, 1 aliases, 1 API tokens, 1 revocations, 1 sanctions\n", out.String())
+
+	out.Reset()
+	require.NoError(t, runCommand([]string{"import", dir + "/export.jsonl"}, &out))
+	assert.Equal(t, "imported 2 items, 3 stars, 2 comments, 1 aliases, 1 API tokens, 1 revocations, 1 sanctions\n", out.String())
+}
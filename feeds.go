@@ -0,0 +1,279 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum number of comments included in a feed
+const feedSize = 50
+
+// feedComment is a comment together with the ID of the item it belongs to
+type feedComment struct {
+	itemID string
+	comment
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// GetItemCommentsFeed returns an Atom or RSS feed of the recent comments on an item
+func GetItemCommentsFeed(w http.ResponseWriter, req *http.Request, params Params) {
+	itemType, itemID := itemFromParams(params)
+	key := itemKey(itemType, itemID)
+	var comments []feedComment
+	if it, err := storedItem(params); err == nil {
+		for _, cm := range it.Comments {
+			if !commentHidden(cm, nil) {
+				comments = append(comments, feedComment{itemIDOf(it), cm})
+			}
+		}
+	}
+
+	writeCommentsFeed(w, req, params["format"], "Comments on "+itemID, "urn:ratesvc:comments:"+key, comments)
+}
+
+// GetRepoCommentsFeed returns an Atom or RSS feed of the recent comments on
+// all the charts of a repo
+func GetRepoCommentsFeed(w http.ResponseWriter, req *http.Request, params Params) {
+	repo := params["repo"]
+	items, err := store.ListItems(repo)
+	if err != nil {
+		log.WithError(err).Error("could not fetch repo items")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+
+	var comments []feedComment
+	for _, it := range items {
+		for _, cm := range it.Comments {
+			if !commentHidden(cm, nil) {
+				comments = append(comments, feedComment{it.ID, cm})
+			}
+		}
+	}
+
+	writeCommentsFeed(w, req, params["format"], "Comments on "+repo, "urn:ratesvc:comments:"+repo, comments)
+}
+
+// writeCommentsFeed renders the most recent comments in the given format,
+// replying with 304 Not Modified if the client's copy is still fresh
+func writeCommentsFeed(w http.ResponseWriter, req *http.Request, format, title, feedID string, comments []feedComment) {
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].CreatedAt.After(comments[j].CreatedAt)
+	})
+	if len(comments) > feedSize {
+		comments = comments[:feedSize]
+	}
+
+	var updated time.Time
+	h := md5.New()
+	io.WriteString(h, format)
+	for _, cm := range comments {
+		if t := commentUpdatedAt(cm.comment); t.After(updated) {
+			updated = t
+		}
+		fmt.Fprintf(h, "%s:%d", cm.ID.Hex(), commentUpdatedAt(cm.comment).UnixNano())
+	}
+	etag := fmt.Sprintf(`W/"%x"`, h.Sum(nil))
+
+	w.Header().Set("ETag", etag)
+	if !updated.IsZero() {
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+	if notModified(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var feed interface{}
+	switch format {
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		feed = newAtomFeed(requestURL(req), title, feedID, updated, comments)
+	case "rss":
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		feed = newRSSFeed(requestURL(req), title, updated, comments)
+	default:
+		response.NewErrorResponse(http.StatusNotFound, "unknown feed format").Write(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		log.WithError(err).Error("could not encode feed")
+	}
+}
+
+func newAtomFeed(selfURL, title, feedID string, updated time.Time, comments []feedComment) atomFeed {
+	// Atom requires an update time, even for feeds without entries
+	if updated.IsZero() {
+		updated = getTimestamp()
+	}
+	feed := atomFeed{
+		ID:      feedID,
+		Title:   title,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Link:    atomLink{Rel: "self", Href: selfURL},
+	}
+	for _, cm := range comments {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        "urn:ratesvc:comment:" + cm.ID.Hex(),
+			Title:     commentTitle(cm),
+			Published: cm.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:   commentUpdatedAt(cm.comment).UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: commentAuthorName(cm.comment)},
+			Content:   atomContent{Type: "text", Body: cm.Text},
+		})
+	}
+	return feed
+}
+
+func newRSSFeed(selfURL, title string, updated time.Time, comments []feedComment) rssFeed {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        selfURL,
+			Description: title,
+		},
+	}
+	if !updated.IsZero() {
+		feed.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, cm := range comments {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       commentTitle(cm),
+			Description: cm.Text,
+			GUID:        rssGUID{Value: "urn:ratesvc:comment:" + cm.ID.Hex()},
+			PubDate:     cm.CreatedAt.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return feed
+}
+
+// notModified returns whether If-None-Match lists the ETag, or is *. ETags
+// are compared weakly, as RFC 7232 requires for If-None-Match.
+// If-Modified-Since is ignored: deleting the newest comment moves
+// Last-Modified backwards, so only the ETag tells whether a copy is fresh.
+func notModified(req *http.Request, etag string) bool {
+	for _, tag := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || (tag != "" && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestURL reconstructs the absolute URL of the request
+func requestURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+func commentTitle(cm feedComment) string {
+	return fmt.Sprintf("%s commented on %s", commentAuthorName(cm.comment), cm.itemID)
+}
+
+func commentAuthorName(cm comment) string {
+	if cm.Author == nil || cm.Author.Name == "" {
+		return "Anonymous"
+	}
+	return cm.Author.Name
+}
+
+// commentUpdatedAt returns the last time the comment was modified
+func commentUpdatedAt(cm comment) time.Time {
+	if cm.UpdatedAt != nil {
+		return *cm.UpdatedAt
+	}
+	return cm.CreatedAt
+}
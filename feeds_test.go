@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func feedsRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/v1/feeds/comments/{repo}/{chartName}.{format:atom|rss}").Handler(WithParams(GetItemCommentsFeed))
+	r.Methods("GET").Path("/v1/feeds/comments/{repo}.{format:atom|rss}").Handler(WithParams(GetRepoCommentsFeed))
+	return r
+}
+
+func TestGetItemCommentsFeed(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	author := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	older := time.Date(2017, 11, 1, 10, 0, 0, 0, time.UTC)
+	newer := time.Date(2017, 11, 2, 10, 0, 0, 0, time.UTC)
+	edited := time.Date(2017, 11, 3, 10, 0, 0, 0, time.UTC)
+	comments := []comment{
+		{ID: bson.NewObjectId(), Text: "First", CreatedAt: older, UpdatedAt: &edited, Author: author},
+		{ID: bson.NewObjectId(), Text: "Second", CreatedAt: newer, Author: author},
+	}
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress", Type: "chart", Comments: comments}
+	})
+
+	t.Run("atom", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/feeds/comments/stable/wordpress.atom", nil)
+		feedsRouter().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/atom+xml; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, edited.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+		var feed atomFeed
+		require.NoError(t, xml.NewDecoder(w.Body).Decode(&feed))
+		assert.Equal(t, "urn:ratesvc:comments:stable/wordpress", feed.ID)
+		assert.Equal(t, "http://example.com/v1/feeds/comments/stable/wordpress.atom", feed.Link.Href)
+		assert.Equal(t, "2017-11-03T10:00:00Z", feed.Updated)
+		require.Len(t, feed.Entries, 2)
+		assert.Equal(t, "Second", feed.Entries[0].Content.Body)
+		assert.Equal(t, "First", feed.Entries[1].Content.Body)
+		assert.Equal(t, "2017-11-01T10:00:00Z", feed.Entries[1].Published)
+		assert.Equal(t, "2017-11-03T10:00:00Z", feed.Entries[1].Updated)
+		assert.Equal(t, "Rick Sanchez", feed.Entries[0].Author.Name)
+		assert.Equal(t, "Rick Sanchez commented on stable/wordpress", feed.Entries[0].Title)
+	})
+
+	t.Run("rss", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/feeds/comments/stable/wordpress.rss", nil)
+		feedsRouter().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/rss+xml; charset=utf-8", w.Header().Get("Content-Type"))
+
+		var feed rssFeed
+		require.NoError(t, xml.NewDecoder(w.Body).Decode(&feed))
+		assert.Equal(t, "2.0", feed.Version)
+		assert.Equal(t, edited.Format(time.RFC1123Z), feed.Channel.LastBuildDate)
+		require.Len(t, feed.Channel.Items, 2)
+		assert.Equal(t, "Second", feed.Channel.Items[0].Description)
+		assert.Equal(t, newer.Format(time.RFC1123Z), feed.Channel.Items[0].PubDate)
+	})
+
+	t.Run("conditional GET", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		feedsRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/feeds/comments/stable/wordpress.atom", nil))
+		etag := w.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		tests := []struct {
+			name     string
+			header   string
+			value    string
+			wantCode int
+		}{
+			{"matching etag", "If-None-Match", etag, http.StatusNotModified},
+			{"stale etag", "If-None-Match", `W/"stale"`, http.StatusOK},
+			{"etag in a list", "If-None-Match", `W/"stale", ` + etag, http.StatusNotModified},
+			{"strong etag", "If-None-Match", strings.TrimPrefix(etag, "W/"), http.StatusNotModified},
+			{"any etag", "If-None-Match", "*", http.StatusNotModified},
+			// Last-Modified moves backwards when the newest comment is deleted
+			{"not modified since", "If-Modified-Since", edited.Format(http.TimeFormat), http.StatusOK},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", "/v1/feeds/comments/stable/wordpress.atom", nil)
+				req.Header.Set(tt.header, tt.value)
+				feedsRouter().ServeHTTP(w, req)
+				assert.Equal(t, tt.wantCode, w.Code)
+			})
+		}
+	})
+}
+
+func TestGetRepoCommentsFeed(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	author := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	var items []*item
+	m.On("All", &items).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*item) = []*item{
+			{ID: "stable/wordpress", Comments: []comment{
+				{ID: bson.NewObjectId(), Text: "Hello", CreatedAt: time.Date(2017, 11, 1, 10, 0, 0, 0, time.UTC), Author: author},
+			}},
+			{ID: "stable/drupal", Comments: []comment{
+				{ID: bson.NewObjectId(), Text: "World", CreatedAt: time.Date(2017, 11, 2, 10, 0, 0, 0, time.UTC), Author: author},
+			}},
+		}
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/feeds/comments/stable.atom", nil)
+	feedsRouter().ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var feed atomFeed
+	require.NoError(t, xml.NewDecoder(w.Body).Decode(&feed))
+	assert.Equal(t, "urn:ratesvc:comments:stable", feed.ID)
+	require.Len(t, feed.Entries, 2)
+	assert.Equal(t, "Rick Sanchez commented on stable/drupal", feed.Entries[0].Title)
+	assert.Equal(t, "Rick Sanchez commented on stable/wordpress", feed.Entries[1].Title)
+}
+
+func TestGetItemCommentsFeedEmpty(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("One", &item{}).Return(errors.New("not found"))
+	now := time.Date(2017, 11, 1, 12, 0, 0, 0, time.UTC)
+	oldGetTimestamp := getTimestamp
+	getTimestamp = func() time.Time { return now }
+	defer func() { getTimestamp = oldGetTimestamp }()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/feeds/comments/stable/wordpress.atom", nil)
+	feedsRouter().ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Last-Modified"))
+
+	var feed atomFeed
+	require.NoError(t, xml.NewDecoder(w.Body).Decode(&feed))
+	assert.Empty(t, feed.Entries)
+	assert.Equal(t, "2017-11-01T12:00:00Z", feed.Updated)
+}
@@ -3,15 +3,21 @@ module github.com/kubeapps/ratesvc
 go 1.13
 
 require (
+	github.com/Masterminds/semver v1.5.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
 	github.com/gorilla/mux v1.7.3
+	github.com/gorilla/websocket v1.4.2
 	github.com/heptiolabs/healthcheck v0.0.0-20180807145615-6ff867650f40
 	github.com/kubeapps/common v0.0.0-20190508164739-10b110436c1a
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/prometheus/client_golang v1.4.0 // indirect
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
 	github.com/unrolled/render v1.0.2
 	github.com/urfave/negroni v1.0.0
+	go.etcd.io/bbolt v1.3.6
 	gopkg.in/DATA-DOG/go-sqlmock.v1 v1.3.0 // indirect
+	gopkg.in/yaml.v2 v2.2.5
 )
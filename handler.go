@@ -23,14 +23,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kubeapps/ratesvc/response"
 	log "github.com/sirupsen/logrus"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/globalsign/mgo/bson"
 )
 
@@ -45,8 +43,6 @@ func (h WithParams) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h(w, req, vars)
 }
 
-const itemCollection = "items"
-
 type item struct {
 	// Instead of bson.ObjectID, we use a human-friendly identifier (e.g. "stable/wordpress")
 	ID string `json:"id" bson:"_id,omitempty"`
@@ -58,8 +54,16 @@ type item struct {
 	StargazersCount int `json:"stargazers_count" bson:"-"`
 	// Whether the current user has starred the item, only exposed in the JSON response
 	HasStarred bool `json:"has_starred" bson:"-"`
+	// Version starred by each Stargazer that specified one, keyed by the hex of their ID
+	StargazerVersions map[string]string `json:"-" bson:"stargazer_versions,omitempty"`
+	// Count of the Stargazers of each version which is only exposed in the JSON response
+	StargazersByVersion map[string]int `json:"stargazers_by_version,omitempty" bson:"-"`
+	// Version being starred, only read from the request body
+	StarredVersion string `json:"version,omitempty" bson:"-"`
 	// Comments collection
 	Comments []comment `json:"-"`
+	// ID of the item this one was merged into, if any
+	AliasOf string `json:"-" bson:"alias_of,omitempty"`
 }
 
 // User represents user info
@@ -68,6 +72,10 @@ type User struct {
 	Name      string        `json:"name"`
 	Email     string        `json:"-"`
 	AvatarURL string        `json:"avatar_url" bson:"-"`
+	// Scopes of the API token the user authenticated with, nil for sessions
+	scopes []string
+	// Role given by the token claims, see roleOf
+	role role
 }
 
 // Defines a comment object
@@ -75,15 +83,16 @@ type comment struct {
 	ID        bson.ObjectId `json:"id" bson:"_id,omitempty"`
 	Text      string        `json:"text"`
 	CreatedAt time.Time     `json:"created_at" bson:"created_at"`
+	UpdatedAt *time.Time    `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
 	Author    *User         `json:"author"`
+	// Optional version of the item the comment refers to
+	Version string `json:"version,omitempty" bson:"version,omitempty"`
 }
 
 // GetStars returns a list of starred items
 func GetStars(w http.ResponseWriter, req *http.Request) {
-	db, closer := dbSession.DB()
-	defer closer()
-	var items []*item
-	if err := db.C(itemCollection).Find(nil).All(&items); err != nil {
+	items, err := store.ListItems("")
+	if err != nil {
 		log.WithError(err).Error("could not fetch all items")
 		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch all items").Write(w)
 		return
@@ -91,7 +100,9 @@ func GetStars(w http.ResponseWriter, req *http.Request) {
 
 	currentUser, _ := getCurrentUser(req)
 	for _, it := range items {
+		it.ID = itemIDOf(it)
 		it.StargazersCount = len(it.StargazersIDs)
+		it.StargazersByVersion = countByVersion(it)
 		if currentUser != nil {
 			it.HasStarred = hasStarred(it, currentUser)
 		}
@@ -101,12 +112,12 @@ func GetStars(w http.ResponseWriter, req *http.Request) {
 
 // UpdateStar updates the HasStarred attribute on an item
 func UpdateStar(w http.ResponseWriter, req *http.Request) {
-	db, closer := dbSession.DB()
-	defer closer()
-
 	currentUser, err := getCurrentUser(req)
 	if err != nil {
-		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		writeUnauthorized(w, err)
+		return
+	}
+	if !requireScope(w, currentUser, scopeStarsWrite) {
 		return
 	}
 
@@ -127,70 +138,101 @@ func UpdateStar(w http.ResponseWriter, req *http.Request) {
 		params.Type = "chart"
 	}
 
-	var it item
-	err = db.C(itemCollection).FindId(params.ID).One(&it)
+	if err := normalizeVersion(&params.StarredVersion); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
 
+	if err := validateLegacyItemID(params.Type, params.ID); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+
+	setStar(w, currentUser, params)
+}
+
+// setStar stars or unstars the item for the user depending on
+// params.HasStarred, creating the item if it doesn't exist yet. The response
+// has the counts of the item after the change.
+func setStar(w http.ResponseWriter, currentUser *User, params *item) {
+	key := itemKey(params.Type, params.ID)
+	it, err := store.GetItem(key)
+	if err == nil && !isItemType(it, params.Type) {
+		response.NewErrorResponse(http.StatusConflict, errItemTypeConflict.Error()).Write(w)
+		return
+	}
 	if err != nil {
-		// Create the item if inexistant
-		it = *params
-		if params.HasStarred {
-			it.StargazersIDs = []bson.ObjectId{currentUser.ID}
-		}
-		if err := db.C(itemCollection).Insert(it); err != nil {
-			log.WithError(err).Error("could not insert item")
-			response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		// The item will be created
+		if err := checkItemExists(params.Type, params.ID); err != nil {
+			response.NewErrorResponse(http.StatusNotFound, err.Error()).Write(w)
 			return
 		}
-	} else {
-		// Otherwise we just need to update the database
-		op := "$pull"
-		if params.HasStarred {
-			// no-op if item is already starred by user
-			if hasStarred(&it, currentUser) {
-				response.NewDataResponse(it).WithCode(http.StatusOK).Write(w)
-				return
-			}
-			op = "$push"
-		}
+	}
 
-		if err := db.C(itemCollection).UpdateId(it.ID, bson.M{op: bson.M{"stargazers_ids": currentUser.ID}}); err != nil {
-			log.WithError(err).Error("could not update item")
-			response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
-			return
-		}
+	var changed bool
+	if params.HasStarred {
+		it, changed, err = store.AddStar(key, params.Type, currentUser.ID, params.StarredVersion)
+	} else {
+		it, _, err = store.RemoveStar(key, params.Type, currentUser.ID)
+	}
+	if err != nil {
+		log.WithError(err).Error("could not update item")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
 	}
 
-	response.NewDataResponse(it).WithCode(http.StatusCreated).Write(w)
+	it.ID = itemIDOf(it)
+	it.StargazersCount = len(it.StargazersIDs)
+	it.StargazersByVersion = countByVersion(it)
+	it.HasStarred = params.HasStarred
+	code := http.StatusCreated
+	// Starring an item again only changes the starred version
+	if params.HasStarred && !changed {
+		code = http.StatusOK
+	}
+	response.NewDataResponse(it).WithCode(code).Write(w)
 }
 
 // GetComments returns a list of comments
 func GetComments(w http.ResponseWriter, req *http.Request, params Params) {
-	db, closer := dbSession.DB()
-	defer closer()
+	matchVersion, err := versionMatcher(req.URL.Query().Get("version"))
+	if err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
 
-	var it item
-	itemID := params["repo"] + "/" + params["chartName"]
-	if err := db.C(itemCollection).FindId(itemID).One(&it); err != nil {
+	itemType, itemID := itemFromParams(params)
+	it, err := store.GetItem(itemKey(itemType, itemID))
+	if err != nil || !isItemType(it, itemType) {
 		response.NewDataResponse([]int64{}).Write(w)
 		return
 	}
 
+	// Muted users still see their comments
+	viewer, _ := getCurrentUser(req)
+	comments := []comment{}
 	for _, cm := range it.Comments {
-		h := md5.New()
-		io.WriteString(h, cm.Author.Email)
-		cm.Author.AvatarURL = fmt.Sprintf("https://s.gravatar.com/avatar/%x", h.Sum(nil))
+		// Version-less comments are relevant to every version
+		if cm.Version != "" && !matchVersion(cm.Version) {
+			continue
+		}
+		if commentHidden(cm, viewer) {
+			continue
+		}
+		setAvatarURL(cm.Author)
+		comments = append(comments, cm)
 	}
-	response.NewDataResponse(it.Comments).Write(w)
+	response.NewDataResponse(comments).Write(w)
 }
 
 // CreateComment creates a comment and appends the comment to the item.Comments array
 func CreateComment(w http.ResponseWriter, req *http.Request, params Params) {
-	db, closer := dbSession.DB()
-	defer closer()
-
 	currentUser, err := getCurrentUser(req)
 	if err != nil {
-		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		writeUnauthorized(w, err)
+		return
+	}
+	if !requireScope(w, currentUser, scopeCommentsWrite) {
 		return
 	}
 
@@ -202,60 +244,131 @@ func CreateComment(w http.ResponseWriter, req *http.Request, params Params) {
 		return
 	}
 
-	if cm.Text == "" {
-		response.NewErrorResponse(http.StatusBadRequest, "text missing in request body").Write(w)
+	if err := validateComment(&cm); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
 		return
 	}
 
-	cm.ID = getNewObjectID()
-	cm.CreatedAt = getTimestamp()
-	cm.Author = currentUser
-
-	var it item
-	itemID := params["repo"] + "/" + params["chartName"]
-	if err = db.C(itemCollection).FindId(itemID).One(&it); err != nil {
-		// Create the item if inexistant
-		it.Type = "chart"
-		it.ID = itemID
-		it.Comments = []comment{cm}
-		if err := db.C(itemCollection).Insert(it); err != nil {
-			log.WithError(err).Error("could not insert item")
-			response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
-			return
-		}
-	} else {
-		// Append comment to collection
-		if err = db.C(itemCollection).UpdateId(it.ID, bson.M{"$push": bson.M{"comments": cm}}); err != nil {
-			log.WithError(err).Error("could not update item")
-			response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
-			return
+	itemType, itemID := itemFromParams(params)
+	if err := validateLegacyItemID(itemType, itemID); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+	cm, err = addComment(itemType, itemID, currentUser, cm)
+	if err == errItemTypeConflict {
+		response.NewErrorResponse(http.StatusConflict, err.Error()).Write(w)
+		return
+	}
+	if err == errUnknownItem {
+		response.NewErrorResponse(http.StatusNotFound, err.Error()).Write(w)
+		return
+	}
+	if err != nil {
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	commentsHub.broadcast(commentsRoom(itemType, itemID), commentEvent{Type: eventCreated, Comment: &cm})
+
+	response.NewDataResponse(cm).WithCode(http.StatusCreated).Write(w)
+}
+
+// UpdateComment edits the text of an existing comment
+func UpdateComment(w http.ResponseWriter, req *http.Request, params Params) {
+	itemType, itemID := itemFromParams(params)
+	if !bson.IsObjectIdHex(params["commentId"]) {
+		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
+		return
+	}
+	commentID := bson.ObjectIdHex(params["commentId"])
+
+	currentUser, err := getCurrentUser(req)
+	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+	if !requireScope(w, currentUser, scopeCommentsWrite) {
+		return
+	}
+
+	var edit comment
+	if err := json.NewDecoder(req.Body).Decode(&edit); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+
+	if err := validateComment(&edit); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+
+	it, err := store.GetItem(itemKey(itemType, itemID))
+	if err != nil || !isItemType(it, itemType) {
+		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
+		return
+	}
+
+	idx := -1
+	for i, c := range it.Comments {
+		if commentID == c.ID {
+			idx = i
+			break
 		}
 	}
 
-	// update avatar_url in response object
-	h := md5.New()
-	io.WriteString(h, cm.Author.Email)
-	cm.Author.AvatarURL = fmt.Sprintf("https://s.gravatar.com/avatar/%x", h.Sum(nil))
+	if idx == -1 {
+		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
+		return
+	}
 
-	response.NewDataResponse(cm).WithCode(http.StatusCreated).Write(w)
+	// Users can only edit their own comments
+	cm := it.Comments[idx]
+	if cm.Author.ID != currentUser.ID {
+		response.NewErrorResponse(http.StatusUnauthorized, "not authorized to edit this comment").Write(w)
+		return
+	}
+
+	updatedAt := getTimestamp()
+	cm.Text = edit.Text
+	cm.UpdatedAt = &updatedAt
+
+	err = store.UpdateComment(it.ID, cm.ID, cm.Text, updatedAt)
+	if err == errNotFound {
+		// The comment was deleted in the meantime
+		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("could not update item")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	setAvatarURL(cm.Author)
+	commentsHub.broadcast(it.ID, commentEvent{Type: eventUpdated, Comment: &cm})
+
+	response.NewDataResponse(cm).Write(w)
 }
 
 // DeleteComment delete's an existing comment
 func DeleteComment(w http.ResponseWriter, req *http.Request, params Params) {
-	db, closer := dbSession.DB()
-	defer closer()
-
-	itemID := params["repo"] + "/" + params["chartName"]
+	itemType, itemID := itemFromParams(params)
+	if !bson.IsObjectIdHex(params["commentId"]) {
+		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
+		return
+	}
 	commentID := bson.ObjectIdHex(params["commentId"])
 
 	currentUser, err := getCurrentUser(req)
 	if err != nil {
-		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		writeUnauthorized(w, err)
+		return
+	}
+	if !requireScope(w, currentUser, scopeCommentsWrite) {
 		return
 	}
 
-	var it item
-	if err := db.C(itemCollection).FindId(itemID).One(&it); err != nil {
+	it, err := store.GetItem(itemKey(itemType, itemID))
+	if err != nil || !isItemType(it, itemType) {
 		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
 		return
 	}
@@ -273,59 +386,73 @@ func DeleteComment(w http.ResponseWriter, req *http.Request, params Params) {
 		return
 	}
 
-	// Users can only delete their own comments
-	if cm.Author.ID != currentUser.ID {
+	// Users can only delete their own comments, unless they are moderators
+	if cm.Author.ID != currentUser.ID && !can(currentUser, permModerate) {
 		response.NewErrorResponse(http.StatusUnauthorized, "not authorized to delete this comment").Write(w)
 		return
 	}
 
-	if err = db.C(itemCollection).UpdateId(it.ID, bson.M{"$pull": bson.M{"comments": cm}}); err != nil {
+	if err = store.DeleteComment(it.ID, cm.ID); err != nil {
 		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
 		return
 	}
+	commentsHub.broadcast(it.ID, commentEvent{Type: eventDeleted, Comment: &cm})
 	response.NewDataResponse(cm).WithCode(http.StatusAccepted).Write(w)
 }
 
-type userClaims struct {
-	*User
-	Email string
-	jwt.StandardClaims
+var getNewObjectID = func() bson.ObjectId {
+	return bson.NewObjectId()
 }
 
-var getCurrentUser = func(req *http.Request) (*User, error) {
-	jwtKey, ok := os.LookupEnv("JWT_KEY")
-	if !ok {
-		return nil, errors.New("JWT_KEY not set")
-	}
+var getTimestamp = func() time.Time {
+	return time.Now()
+}
 
-	cookie, err := req.Cookie("ka_auth")
-	if err != nil {
-		return nil, err
+// validateComment checks the client-provided fields of a comment
+func validateComment(cm *comment) error {
+	if cm.Text == "" {
+		return errors.New("text missing in request body")
 	}
+	return normalizeVersion(&cm.Version)
+}
 
-	token, err := jwt.ParseWithClaims(cookie.Value, &userClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtKey), nil
-	})
+// addComment stores a new comment by author on the item, creating the item if
+// it doesn't exist yet, and returns the stored comment. It fails with
+// errItemTypeConflict if the ID belongs to an item of another type, and with
+// errUnknownItem if the item would be created but isn't in the catalogue.
+func addComment(itemType, itemID string, author *User, cm comment) (comment, error) {
+	cm.ID = getNewObjectID()
+	cm.CreatedAt = getTimestamp()
+	cm.Author = author
+
+	key := itemKey(itemType, itemID)
+	it, err := store.GetItem(key)
+	if err == nil && !isItemType(it, itemType) {
+		return cm, errItemTypeConflict
+	}
 	if err != nil {
-		return nil, err
+		// The item will be created
+		if err := checkItemExists(itemType, itemID); err != nil {
+			return cm, err
+		}
 	}
-
-	if claims, ok := token.Claims.(*userClaims); ok && token.Valid {
-		claims.User.Email = claims.Email
-		return claims.User, nil
+	// Creates the item if needed in the same write, so that concurrent first
+	// comments don't both try to insert it
+	if err := store.AddComment(key, itemType, cm); err != nil {
+		log.WithError(err).Error("could not update item")
+		return cm, err
 	}
-	return nil, errors.New("invalid token")
-}
 
-var getNewObjectID = func() bson.ObjectId {
-	return bson.NewObjectId()
+	// update avatar_url in response object
+	setAvatarURL(cm.Author)
+	return cm, nil
 }
 
-var getTimestamp = func() time.Time {
-	return time.Now()
+// setAvatarURL sets the Gravatar URL for the user's email
+func setAvatarURL(u *User) {
+	h := md5.New()
+	io.WriteString(h, u.Email)
+	u.AvatarURL = fmt.Sprintf("https://s.gravatar.com/avatar/%x", h.Sum(nil))
 }
 
 // hasStarred returns true if item is starred by the user
@@ -26,6 +26,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/kubeapps/ratesvc/testutil"
 	"github.com/stretchr/testify/assert"
@@ -39,9 +40,23 @@ type body struct {
 
 var itemsList []*item
 
+// onUpsertItem makes the next atomic update of an item expect the update and
+// find the stored item, or insert a new item if stored is nil
+func onUpsertItem(m *mock.Mock, itemType string, update bson.M, stored *item) {
+	update["$setOnInsert"] = bson.M{"type": itemType}
+	call := m.On("Apply", mgo.Change{Update: update, Upsert: true}, &item{})
+	if stored == nil {
+		call.Return(&mgo.ChangeInfo{UpsertedId: "id"}, nil).Once()
+		return
+	}
+	call.Return(&mgo.ChangeInfo{Updated: 1, Matched: 1}, nil).Run(func(args mock.Arguments) {
+		*args.Get(1).(*item) = *stored
+	}).Once()
+}
+
 func TestGetStars(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
 	oldGetCurrentUser := getCurrentUser
 	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
@@ -90,7 +105,7 @@ func TestUpdateStar(t *testing.T) {
 	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
 		*args.Get(0).(*item) = item{ID: "stable/wordpress"}
 	})
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
 	oldGetCurrentUser := getCurrentUser
 	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
@@ -103,17 +118,20 @@ func TestUpdateStar(t *testing.T) {
 	}{
 		{"invalid", `NOTJSON`, http.StatusBadRequest, false},
 		{"no id", `{"has_starred": true}`, http.StatusBadRequest, false},
+		{"unknown type", `{"id": "stable/wordpress", "type": "plugin", "has_starred": true}`, http.StatusBadRequest, false},
+		{"invalid id", `{"id": "function:stable/wordpress", "has_starred": true}`, http.StatusBadRequest, false},
+		{"invalid function id", `{"id": "a/b/c", "type": "function", "has_starred": true}`, http.StatusBadRequest, false},
 		{"valid", `{"id": "stable/wordpress", "has_starred": true}`, http.StatusCreated, false},
 		{"valid unstar", `{"id": "stable/wordpress", "has_starred": false}`, http.StatusCreated, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.wantCode == http.StatusCreated {
-				op := "$push"
+				update := bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}}
 				if tt.unstar {
-					op = "$pull"
+					update = bson.M{"$pull": bson.M{"stargazers_ids": currentUser.ID}, "$unset": bson.M{"stargazer_versions." + currentUser.ID.Hex(): ""}}
 				}
-				m.On("UpdateId", "stable/wordpress", bson.M{op: bson.M{"stargazers_ids": currentUser.ID}})
+				onUpsertItem(&m, "chart", update, &item{ID: "stable/wordpress", Type: "chart"})
 			}
 
 			w := httptest.NewRecorder()
@@ -122,32 +140,63 @@ func TestUpdateStar(t *testing.T) {
 			assert.Equal(t, tt.wantCode, w.Code)
 		})
 	}
+	m.AssertExpectations(t)
+}
+
+func TestUpdateStarReturnsCounts(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	// Another user starred the item after it was read
+	other := bson.NewObjectId()
+	onFindItem(&m, &item{ID: "stable/wordpress", Type: "chart"})
+	onUpsertItem(&m, "chart", bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}},
+		&item{ID: "stable/wordpress", Type: "chart", StargazersIDs: []bson.ObjectId{other}})
+
+	w := httptest.NewRecorder()
+	UpdateStar(w, httptest.NewRequest("PUT", "/v1/stars", bytes.NewBufferString(`{"id": "stable/wordpress", "has_starred": true}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var b struct {
+		Data item `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&b)
+	assert.Equal(t, 2, b.Data.StargazersCount)
+	assert.True(t, b.Data.HasStarred)
 }
 
 func TestUpdateStarDoesNotDuplicate(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
 	oldGetCurrentUser := getCurrentUser
 	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
 	defer func() { getCurrentUser = oldGetCurrentUser }()
 
-	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
-		*args.Get(0).(*item) = item{ID: "stable/wordpress", StargazersIDs: []bson.ObjectId{currentUser.ID}}
-	})
+	stored := &item{ID: "stable/wordpress", StargazersIDs: []bson.ObjectId{currentUser.ID}}
+	onFindItem(&m, stored)
+	onUpsertItem(&m, "chart", bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}}, stored)
 
-	m.AssertNotCalled(t, "UpdateId")
 	w := httptest.NewRecorder()
 	requestBody := `{"id": "stable/wordpress", "has_starred": true}`
 	req := httptest.NewRequest("PUT", "/v1/stars", bytes.NewBuffer([]byte(requestBody)))
 	UpdateStar(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
+	var b struct {
+		Data item `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&b)
+	assert.Equal(t, 1, b.Data.StargazersCount)
+	m.AssertNotCalled(t, "UpdateId", mock.Anything, mock.Anything)
 }
 
 func TestUpdateStarInsertsInexistantItem(t *testing.T) {
 	var m mock.Mock
 	m.On("One", &item{}).Return(errors.New("not found"))
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
 	oldGetCurrentUser := getCurrentUser
 	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
@@ -155,18 +204,16 @@ func TestUpdateStarInsertsInexistantItem(t *testing.T) {
 	tests := []struct {
 		name        string
 		requestBody string
-		unstar      bool
+		update      bson.M
 	}{
-		{"valid", `{"id": "stable/wordpress", "has_starred": true}`, false},
-		{"valid unstar", `{"id": "stable/wordpress", "has_starred": false}`, true},
+		{"valid", `{"id": "stable/wordpress", "has_starred": true}`,
+			bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}}},
+		{"valid unstar", `{"id": "stable/wordpress", "has_starred": false}`,
+			bson.M{"$pull": bson.M{"stargazers_ids": currentUser.ID}, "$unset": bson.M{"stargazer_versions." + currentUser.ID.Hex(): ""}}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			toInsert := item{ID: "stable/wordpress", Type: "chart", HasStarred: !tt.unstar}
-			if !tt.unstar {
-				toInsert.StargazersIDs = []bson.ObjectId{currentUser.ID}
-			}
-			m.On("Insert", toInsert)
+			onUpsertItem(&m, "chart", tt.update, nil)
 
 			w := httptest.NewRecorder()
 			req := httptest.NewRequest("PUT", "/v1/stars", bytes.NewBuffer([]byte(tt.requestBody)))
@@ -174,11 +221,13 @@ func TestUpdateStarInsertsInexistantItem(t *testing.T) {
 			assert.Equal(t, http.StatusCreated, w.Code)
 		})
 	}
+	m.AssertExpectations(t)
+	m.AssertNotCalled(t, "Insert", mock.Anything)
 }
 
 func TestUpdateStarUnauthorized(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	w := httptest.NewRecorder()
 	req := httptest.NewRequest("PUT", "/v1/stars", nil)
 	UpdateStar(w, req)
@@ -187,7 +236,7 @@ func TestUpdateStarUnauthorized(t *testing.T) {
 
 func TestGetComments(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
 	oldGetCurrentUser := getCurrentUser
 	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
@@ -235,7 +284,7 @@ func TestCreateComment(t *testing.T) {
 	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
 		*args.Get(0).(*item) = item{ID: "stable/wordpress"}
 	})
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
 	oldGetCurrentUser := getCurrentUser
 	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
@@ -263,7 +312,7 @@ func TestCreateComment(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.wantCode == http.StatusCreated {
-				m.On("UpdateId", "stable/wordpress", bson.M{"$push": bson.M{"comments": comment{ID: commentID, Text: "Hello, World", CreatedAt: commentTimestamp, Author: currentUser}}})
+				onUpsertItem(&m, "chart", bson.M{"$push": bson.M{"comments": comment{ID: commentID, Text: "Hello, World", CreatedAt: commentTimestamp, Author: currentUser}}}, &item{ID: "stable/wordpress"})
 			}
 			w := httptest.NewRecorder()
 			req := httptest.NewRequest("POST", "/v1/comments/stable/wordpress", bytes.NewBuffer([]byte(tt.requestBody)))
@@ -279,7 +328,7 @@ func TestCreateComment(t *testing.T) {
 
 func TestCreateCommentUnauthorized(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	w := httptest.NewRecorder()
 	req := httptest.NewRequest("POST", "/v1/comments/stable/wordpress", nil)
 	params := Params{
@@ -292,7 +341,7 @@ func TestCreateCommentUnauthorized(t *testing.T) {
 
 func TestDeleteComment(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
 	oldGetCurrentUser := getCurrentUser
@@ -321,6 +370,7 @@ func TestDeleteComment(t *testing.T) {
 		commentID string
 		wantCode  int
 	}{
+		{"invalid id", "notanid", http.StatusNotFound},
 		{"does not exist", "5a0e9183833def3853088836", http.StatusNotFound},
 		{"exists", commentID.Hex(), http.StatusAccepted},
 	}
@@ -328,7 +378,7 @@ func TestDeleteComment(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.wantCode == http.StatusAccepted {
-				m.On("UpdateId", "stable/wordpress", bson.M{"$pull": bson.M{"comments": comment{ID: commentID, Text: "Second comment", Author: currentUser, CreatedAt: commentTimestamp}}})
+				m.On("UpdateId", "stable/wordpress", bson.M{"$pull": bson.M{"comments": bson.M{"_id": commentID}}})
 			}
 
 			w := httptest.NewRecorder()
@@ -346,7 +396,7 @@ func TestDeleteComment(t *testing.T) {
 
 func TestDeleteCommentUnauthorized(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	w := httptest.NewRecorder()
 	req := httptest.NewRequest("DELETE", "/v1/comments/stable/wordpress/5a0e9183833def3853088836", nil)
 	params := Params{
@@ -360,7 +410,7 @@ func TestDeleteCommentUnauthorized(t *testing.T) {
 
 func TestDeleteCommentCannotDeleteOtherUsersComments(t *testing.T) {
 	var m mock.Mock
-	dbSession = testutil.NewMockSession(&m)
+	store = newMongoStore(testutil.NewMockSession(&m))
 	w := httptest.NewRecorder()
 
 	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
@@ -411,3 +461,75 @@ func Test_getCurrentUser(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateComment(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	editTimestamp := getTimestamp()
+	oldGetTimestamp := getTimestamp
+	getTimestamp = func() time.Time { return editTimestamp }
+	defer func() { getTimestamp = oldGetTimestamp }()
+
+	commentID := bson.NewObjectId()
+	otherCommentID := bson.NewObjectId()
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress", Type: "chart", Comments: []comment{
+			comment{ID: otherCommentID, Text: "First comment", Author: &User{ID: bson.NewObjectId()}},
+			comment{ID: commentID, Text: "Second comment", Author: currentUser},
+		}}
+	})
+
+	tests := []struct {
+		name        string
+		commentID   string
+		requestBody string
+		wantCode    int
+	}{
+		{"invalid", commentID.Hex(), `NOTJSON`, http.StatusBadRequest},
+		{"no text", commentID.Hex(), `{}`, http.StatusBadRequest},
+		{"invalid id", "notanid", `{"text": "Edited"}`, http.StatusNotFound},
+		{"does not exist", "5a0e9183833def3853088836", `{"text": "Edited"}`, http.StatusNotFound},
+		{"other user's comment", otherCommentID.Hex(), `{"text": "Edited"}`, http.StatusUnauthorized},
+		{"valid", commentID.Hex(), `{"text": "Edited"}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantCode == http.StatusOK {
+				m.On("Apply", mgo.Change{Update: bson.M{"$set": bson.M{"comments.$.text": "Edited", "comments.$.updated_at": editTimestamp}}}, nil).Once()
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("PUT", "/v1/comments/stable/wordpress/"+tt.commentID, bytes.NewBuffer([]byte(tt.requestBody)))
+			params := Params{
+				"repo":      "stable",
+				"chartName": "wordpress",
+				"commentId": tt.commentID,
+			}
+			UpdateComment(w, req, params)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				var b struct {
+					Data comment `json:"data"`
+				}
+				json.NewDecoder(w.Body).Decode(&b)
+				assert.Equal(t, "Edited", b.Data.Text)
+				require.NotNil(t, b.Data.UpdatedAt)
+			}
+		})
+	}
+
+	// The comment is deleted between reading the item and updating it
+	m.On("Apply", mock.Anything, nil).Return(nil, mgo.ErrNotFound).Once()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v1/comments/stable/wordpress/"+commentID.Hex(), bytes.NewBufferString(`{"text": "Edited"}`))
+	UpdateComment(w, req, Params{"repo": "stable", "chartName": "wordpress", "commentId": commentID.Hex()})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	m.AssertExpectations(t)
+}
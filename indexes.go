@@ -0,0 +1,194 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+)
+
+// declaredIndex is an index the service queries rely on
+type declaredIndex struct {
+	Collection string
+	Index      mgo.Index
+}
+
+// declaredIndexes are ensured at startup. Each index must be named so that
+// changes to it can be detected.
+var declaredIndexes = []declaredIndex{
+	// Items starred by a user
+	{itemCollection, mgo.Index{Name: "stargazers_ids", Key: []string{"stargazers_ids"}}},
+	{itemCollection, mgo.Index{Name: "type", Key: []string{"type"}}},
+	// Only merged items have alias_of
+	{itemCollection, mgo.Index{Name: "alias_of", Key: []string{"alias_of"}, Sparse: true}},
+	// Authentication with an API token, and the tokens of a user
+	{apiTokenCollection, mgo.Index{Name: "hash", Key: []string{"hash"}, Unique: true}},
+	{apiTokenCollection, mgo.Index{Name: "user_id", Key: []string{"user._id", "created_at"}}},
+	// Lapsed revocations and sanctions are deleted by MongoDB
+	{revocationCollection, mgo.Index{Name: "expires_at", Key: []string{"expires_at"}, ExpireAfter: time.Second}},
+	{sanctionCollection, mgo.Index{Name: "expires_at", Key: []string{"expires_at"}, ExpireAfter: time.Second}},
+}
+
+// Kinds of index drift
+const (
+	// A declared index doesn't exist
+	indexMissing = "missing"
+	// An index has the name of a declared index but different keys or options
+	indexChanged = "changed"
+	// An index isn't declared, it may have been created by hand
+	indexUndeclared = "undeclared"
+)
+
+// indexDrift is a difference between the declared and existing indexes
+type indexDrift struct {
+	Kind       string
+	Collection string
+	Name       string
+}
+
+func (d indexDrift) String() string {
+	return fmt.Sprintf("%s index %s.%s", d.Kind, d.Collection, d.Name)
+}
+
+// indexer is implemented by the mgo collections behind datastore
+type indexer interface {
+	EnsureIndex(index mgo.Index) error
+	DropIndexName(name string) error
+	Indexes() ([]mgo.Index, error)
+}
+
+func indexerOf(c datastore.Collection) (indexer, error) {
+	ix, ok := c.(indexer)
+	if !ok {
+		return nil, errors.New("collection does not support managing indexes")
+	}
+	return ix, nil
+}
+
+// sameIndex returns true if the existing index has the declared keys and
+// options
+func sameIndex(declared, existing mgo.Index) bool {
+	return reflect.DeepEqual(declared.Key, existing.Key) &&
+		declared.Unique == existing.Unique &&
+		declared.Sparse == existing.Sparse &&
+		declared.ExpireAfter == existing.ExpireAfter
+}
+
+// indexesDrift compares the declared indexes with the existing ones
+func indexesDrift(db datastore.Database) ([]indexDrift, error) {
+	byCollection := map[string][]mgo.Index{}
+	var collections []string
+	for _, d := range declaredIndexes {
+		if _, ok := byCollection[d.Collection]; !ok {
+			collections = append(collections, d.Collection)
+		}
+		byCollection[d.Collection] = append(byCollection[d.Collection], d.Index)
+	}
+	sort.Strings(collections)
+
+	var drift []indexDrift
+	for _, name := range collections {
+		ix, err := indexerOf(db.C(name))
+		if err != nil {
+			return nil, err
+		}
+		existing, err := ix.Indexes()
+		// Collections are created with their first document
+		if err != nil && !isNamespaceNotFound(err) {
+			return nil, fmt.Errorf("could not list the indexes of %s: %v", name, err)
+		}
+		existingByName := map[string]mgo.Index{}
+		for _, idx := range existing {
+			existingByName[idx.Name] = idx
+		}
+
+		declaredNames := map[string]bool{}
+		for _, idx := range byCollection[name] {
+			declaredNames[idx.Name] = true
+			e, ok := existingByName[idx.Name]
+			if !ok {
+				drift = append(drift, indexDrift{indexMissing, name, idx.Name})
+			} else if !sameIndex(idx, e) {
+				drift = append(drift, indexDrift{indexChanged, name, idx.Name})
+			}
+		}
+		for _, idx := range existing {
+			if idx.Name != "_id_" && !declaredNames[idx.Name] {
+				drift = append(drift, indexDrift{indexUndeclared, name, idx.Name})
+			}
+		}
+	}
+	return drift, nil
+}
+
+// isNamespaceNotFound returns true if the error is caused by listing the
+// indexes of a collection that doesn't exist yet
+func isNamespaceNotFound(err error) bool {
+	qe, ok := err.(*mgo.QueryError)
+	return ok && qe.Code == 26
+}
+
+// ensureIndexes creates the missing declared indexes and recreates the
+// changed ones. Undeclared indexes are left alone and returned as drift.
+func ensureIndexes(db datastore.Database) ([]indexDrift, error) {
+	drift, err := indexesDrift(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining []indexDrift
+	for _, d := range drift {
+		if d.Kind == indexUndeclared {
+			remaining = append(remaining, d)
+			continue
+		}
+		ix, err := indexerOf(db.C(d.Collection))
+		if err != nil {
+			return nil, err
+		}
+		if d.Kind == indexChanged {
+			log.WithFields(log.Fields{"collection": d.Collection, "index": d.Name}).Info("dropping changed index")
+			if err := ix.DropIndexName(d.Name); err != nil {
+				return nil, fmt.Errorf("could not drop index %s.%s: %v", d.Collection, d.Name, err)
+			}
+		}
+		log.WithFields(log.Fields{"collection": d.Collection, "index": d.Name}).Info("creating index")
+		idx := declaredIndexOf(d)
+		// Don't block the database while building an index
+		idx.Background = true
+		if err := ix.EnsureIndex(idx); err != nil {
+			return nil, fmt.Errorf("could not create index %s.%s: %v", d.Collection, d.Name, err)
+		}
+	}
+	return remaining, nil
+}
+
+func declaredIndexOf(d indexDrift) mgo.Index {
+	for _, di := range declaredIndexes {
+		if di.Collection == d.Collection && di.Index.Name == d.Name {
+			return di.Index
+		}
+	}
+	return mgo.Index{}
+}
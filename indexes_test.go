@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// apiTokenIndexes are the declared indexes of the collection compared before
+// the items one, and expiryIndexes those of the revocations and sanctions
+// compared after it, since collections are compared in order
+var (
+	apiTokenIndexes = []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "hash", Key: []string{"hash"}, Unique: true},
+		{Name: "user_id", Key: []string{"user._id", "created_at"}},
+	}
+	expiryIndexes = []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "expires_at", Key: []string{"expires_at"}, ExpireAfter: time.Second},
+	}
+)
+
+// driftingIndexes has an unchanged, a changed and an undeclared index, the
+// other declared indexes are missing
+var driftingIndexes = []mgo.Index{
+	{Name: "_id_", Key: []string{"_id"}},
+	{Name: "stargazers_ids", Key: []string{"stargazers_ids"}},
+	{Name: "type", Key: []string{"type", "_id"}},
+	{Name: "legacy", Key: []string{"name"}},
+}
+
+func TestIndexesStatus(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("Indexes").Return(apiTokenIndexes, nil).Once()
+	m.On("Indexes").Return(driftingIndexes, nil).Once()
+	m.On("Indexes").Return(expiryIndexes, nil)
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"indexes", "status"}, &out))
+	assert.Equal(t, "changed index items.type\n"+
+		"missing index items.alias_of\n"+
+		"undeclared index items.legacy\n", out.String())
+	m.AssertNotCalled(t, "EnsureIndex", mock.Anything)
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("Indexes").Return(apiTokenIndexes, nil).Once()
+	m.On("Indexes").Return(driftingIndexes, nil).Once()
+	m.On("Indexes").Return(expiryIndexes, nil)
+	m.On("DropIndexName", "type").Return(nil)
+	m.On("EnsureIndex", mgo.Index{Name: "type", Key: []string{"type"}, Background: true}).Return(nil)
+	m.On("EnsureIndex", mgo.Index{Name: "alias_of", Key: []string{"alias_of"}, Sparse: true, Background: true}).Return(nil)
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"indexes", "ensure"}, &out))
+	assert.Equal(t, "undeclared index items.legacy\n", out.String())
+	m.AssertExpectations(t)
+	m.AssertNotCalled(t, "DropIndexName", "legacy")
+}
+
+func TestEnsureIndexesNewCollection(t *testing.T) {
+	var m mock.Mock
+	m.On("Indexes").Return(nil, &mgo.QueryError{Code: 26, Message: "ns does not exist"})
+	m.On("EnsureIndex", mock.Anything).Return(nil)
+
+	db, closer := testutil.NewMockSession(&m).DB()
+	defer closer()
+	drift, err := ensureIndexes(db)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+	m.AssertNumberOfCalls(t, "EnsureIndex", len(declaredIndexes))
+}
+
+func TestIndexesUpToDate(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	existing := []mgo.Index{{Name: "_id_", Key: []string{"_id"}}}
+	for _, d := range declaredIndexes {
+		if d.Collection == itemCollection {
+			existing = append(existing, d.Index)
+		}
+	}
+	m.On("Indexes").Return(apiTokenIndexes, nil).Once()
+	m.On("Indexes").Return(existing, nil).Once()
+	m.On("Indexes").Return(expiryIndexes, nil)
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"indexes", "status"}, &out))
+	assert.Equal(t, "indexes match the declared ones\n", out.String())
+}
@@ -0,0 +1,224 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// errItemTypeConflict is returned when an ID is already used by an item of another type
+var errItemTypeConflict = errors.New("id already used by an item of another type")
+
+// idSegment matches a single segment of an item ID
+const idSegment = `[A-Za-z0-9][A-Za-z0-9._-]*`
+
+// itemTypes is the registry of allowed item types, mapping each type to the
+// pattern its IDs must match
+var itemTypes = map[string]*regexp.Regexp{}
+
+func init() {
+	// Charts are identified by repo/chartName
+	registerItemType("chart", idSegment+"/"+idSegment)
+	// Functions are identified by name or namespace/name
+	registerItemType("function", "("+idSegment+"/)?"+idSegment)
+}
+
+// registerItemType allows items of the given type, validating their IDs
+// against idPattern
+func registerItemType(name, idPattern string) error {
+	re, err := regexp.Compile("^(?:" + idPattern + ")$")
+	if err != nil {
+		return err
+	}
+	itemTypes[name] = re
+	return nil
+}
+
+// validateItemID checks that the type is registered and the ID matches its rules
+func validateItemID(itemType, id string) error {
+	re, ok := itemTypes[itemType]
+	if !ok {
+		return fmt.Errorf("unknown item type %q", itemType)
+	}
+	// A - segment separates IDs from the sub-resources of items in routes
+	if !re.MatchString(id) || containsString(strings.Split(id, "/"), "-") {
+		return fmt.Errorf("invalid id for item type %q", itemType)
+	}
+	return nil
+}
+
+// itemKey returns the key the item with the type and ID is stored under.
+// Charts are stored under their ID, so that the items stored before item types
+// are still found, and other items under type:id, so that the IDs of different
+// types don't clash. Chart IDs can't contain colons, see validateLegacyItemID.
+func itemKey(itemType, id string) string {
+	if itemType == "" || itemType == "chart" {
+		return id
+	}
+	return itemType + ":" + id
+}
+
+// itemIDOf returns the ID of a stored item, without the type its key has
+func itemIDOf(it *item) string {
+	if it.Type == "" || it.Type == "chart" {
+		return it.ID
+	}
+	return strings.TrimPrefix(it.ID, it.Type+":")
+}
+
+// validateLegacyItemID checks the items given to the routes that predate item
+// types. Chart IDs weren't validated, so only those that could clash with the
+// keys of other types are rejected.
+func validateLegacyItemID(itemType, id string) error {
+	if itemType != "chart" {
+		return validateItemID(itemType, id)
+	}
+	if strings.Contains(id, ":") {
+		return errors.New(`invalid id for item type "chart"`)
+	}
+	return nil
+}
+
+// isItemType returns true if the stored item is of the given type. Items
+// stored before types were introduced are charts.
+func isItemType(it *item, itemType string) bool {
+	return it.Type == itemType || (it.Type == "" && itemType == "chart")
+}
+
+// itemFromParams returns the type and ID of the item addressed by the path
+// params, which are either {type}/{id} or the legacy {repo}/{chartName}
+func itemFromParams(params Params) (string, string) {
+	if itemType, ok := params["type"]; ok {
+		return itemType, params["id"]
+	}
+	return "chart", params["repo"] + "/" + params["chartName"]
+}
+
+// storedItem returns the item addressed by the path params, failing with
+// errNotFound if nobody has interacted with it yet
+func storedItem(params Params) (*item, error) {
+	itemType, itemID := itemFromParams(params)
+	it, err := store.GetItem(itemKey(itemType, itemID))
+	if err != nil {
+		return nil, err
+	}
+	if !isItemType(it, itemType) {
+		return nil, errNotFound
+	}
+	return it, nil
+}
+
+// validItem wraps handlers for {type}/{id} routes, rejecting unknown types and
+// invalid IDs
+func validItem(h WithParams) WithParams {
+	return func(w http.ResponseWriter, req *http.Request, params Params) {
+		itemType, itemID := itemFromParams(params)
+		if _, ok := itemTypes[itemType]; !ok {
+			response.NewErrorResponse(http.StatusNotFound, "unknown item type").Write(w)
+			return
+		}
+		if err := validateItemID(itemType, itemID); err != nil {
+			response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+			return
+		}
+		h(w, req, params)
+	}
+}
+
+// GetItem returns a single item with its star count
+func GetItem(w http.ResponseWriter, req *http.Request, params Params) {
+	itemType, itemID := itemFromParams(params)
+	it, err := store.GetItem(itemKey(itemType, itemID))
+	if err != nil || !isItemType(it, itemType) {
+		// Items nobody has interacted with yet are not stored
+		it = &item{ID: itemID, Type: itemType}
+	}
+
+	// Merged items are returned with the ID of the item they were merged into
+	it.ID = itemIDOf(it)
+	it.Type = itemType
+	it.StargazersCount = len(it.StargazersIDs)
+	it.StargazersByVersion = countByVersion(it)
+	if currentUser, err := getCurrentUser(req); err == nil {
+		it.HasStarred = hasStarred(it, currentUser)
+	}
+	response.NewDataResponse(it).Write(w)
+}
+
+// UpdateItemStar stars or unstars an item, taking the item from the path and
+// has_starred and the optional version from the request body
+func UpdateItemStar(w http.ResponseWriter, req *http.Request, params Params) {
+	currentUser, err := getCurrentUser(req)
+	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+	if !requireScope(w, currentUser, scopeStarsWrite) {
+		return
+	}
+
+	var body item
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+
+	if err := normalizeVersion(&body.StarredVersion); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+
+	itemType, itemID := itemFromParams(params)
+	setStar(w, currentUser, &item{ID: itemID, Type: itemType, HasStarred: body.HasStarred, StarredVersion: body.StarredVersion})
+}
+
+// itemTypesFlag registers extra item types from name=pattern command-line flags
+type itemTypesFlag struct{}
+
+func (itemTypesFlag) String() string {
+	var names []string
+	for name := range itemTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (itemTypesFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("item types must be in the form name=pattern")
+	}
+	// Type names are path segments of routes and prefixes of item keys
+	if strings.ContainsAny(parts[0], "/:") {
+		return fmt.Errorf("invalid item type name %q, it can't contain / or :", parts[0])
+	}
+	if parts[0] == "chart" {
+		return errors.New("the chart item type can't be redefined")
+	}
+	return registerItemType(parts[0], parts[1])
+}
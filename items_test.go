@@ -0,0 +1,247 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateItemID(t *testing.T) {
+	tests := []struct {
+		name     string
+		itemType string
+		id       string
+		wantErr  bool
+	}{
+		{"chart", "chart", "stable/wordpress", false},
+		{"chart without repo", "chart", "wordpress", true},
+		{"chart with extra segment", "chart", "stable/wordpress/1.0.0", true},
+		{"function", "function", "hello", false},
+		{"namespaced function", "function", "default/hello", false},
+		{"invalid characters", "function", "hello world", true},
+		{"unknown type", "plugin", "hello", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateItemID(tt.itemType, tt.id)
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func Test_itemTypesFlag(t *testing.T) {
+	defer delete(itemTypes, "plugin")
+	var f itemTypesFlag
+	assert.Error(t, f.Set("plugin"))
+	assert.Error(t, f.Set("plugin=("))
+	require.NoError(t, f.Set("plugin=[a-z]+/[a-z]+/[a-z]+"))
+	assert.NoError(t, validateItemID("plugin", "a/b/c"))
+	assert.Error(t, validateItemID("plugin", "a/b"))
+	assert.Equal(t, "chart,function,plugin", f.String())
+
+	defer delete(itemTypes, "path")
+	require.NoError(t, f.Set("path=.+"))
+	assert.NoError(t, validateItemID("path", "a/b/c"))
+	// - segments separate IDs from the sub-resources of items
+	assert.Error(t, validateItemID("path", "a/-/comments"))
+
+	assert.EqualError(t, f.Set("a/b=.+"), `invalid item type name "a/b", it can't contain / or :`)
+	assert.EqualError(t, f.Set("a:b=.+"), `invalid item type name "a:b", it can't contain / or :`)
+	assert.Error(t, f.Set("=.+"))
+	assert.EqualError(t, f.Set("chart=.+"), "the chart item type can't be redefined")
+	assert.Error(t, validateItemID("chart", "a/b/c"))
+}
+
+func TestItemRoutesValidation(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("One", &item{}).Return(errors.New("not found"))
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{"unknown type", "/v1/items/plugin/hello", http.StatusNotFound},
+		{"invalid chart id", "/v1/items/chart/stable/wordpress/extra", http.StatusBadRequest},
+		{"valid chart", "/v1/items/chart/stable/wordpress", http.StatusOK},
+		{"single segment function", "/v1/items/function/hello", http.StatusOK},
+		{"namespaced function", "/v1/items/function/default/hello", http.StatusOK},
+		{"function comments", "/v1/items/function/default/hello/-/comments", http.StatusOK},
+		{"id with a - segment", "/v1/items/function/default/-/hello", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
+
+func TestItemRoutesDontCollideWithIDs(t *testing.T) {
+	store = newMemoryStore()
+	require.NoError(t, store.CreateItem(item{ID: itemKey("function", "ns/comments"), Type: "function", StargazersIDs: []bson.ObjectId{bson.NewObjectId()}}))
+	require.NoError(t, store.CreateItem(item{ID: itemKey("function", "ns"), Type: "function",
+		Comments: []comment{{ID: bson.NewObjectId(), Text: "Hello", CreatedAt: time.Now(), Author: &User{ID: bson.NewObjectId()}}}}))
+
+	// The function ns/comments, not the comments of the function ns
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/items/function/ns/comments", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var it struct {
+		Data item `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&it))
+	assert.Equal(t, "ns/comments", it.Data.ID)
+	assert.Equal(t, 1, it.Data.StargazersCount)
+
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/items/function/ns/-/comments", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var comments struct {
+		Data []comment `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&comments))
+	require.Len(t, comments.Data, 1)
+	assert.Equal(t, "Hello", comments.Data[0].Text)
+}
+
+func TestGetItem(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "function:default/hello", Type: "function", StargazersIDs: []bson.ObjectId{bson.NewObjectId(), currentUser.ID}}
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		wantType  string
+		wantCount int
+	}{
+		{"stored item", "/v1/items/function/default/hello", "function", 2},
+		{"item of another type", "/v1/items/chart/default/hello", "chart", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			var b struct {
+				Data item `json:"data"`
+			}
+			json.NewDecoder(w.Body).Decode(&b)
+			assert.Equal(t, "default/hello", b.Data.ID)
+			assert.Equal(t, tt.wantType, b.Data.Type)
+			assert.Equal(t, tt.wantCount, b.Data.StargazersCount)
+			assert.Equal(t, tt.wantCount > 0, b.Data.HasStarred)
+		})
+	}
+}
+
+func TestUpdateItemStarInsertsTypedItem(t *testing.T) {
+	var m mock.Mock
+	m.On("One", &item{}).Return(errors.New("not found"))
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	onUpsertItem(&m, "function", bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}}, nil)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v1/items/function/hello/-/star", bytes.NewBufferString(`{"has_starred": true}`))
+	newRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	m.AssertExpectations(t)
+}
+
+func TestCreateItemCommentInsertsTypedItem(t *testing.T) {
+	var m mock.Mock
+	m.On("One", &item{}).Return(errors.New("not found"))
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	commentID := getNewObjectID()
+	oldGetNewObjectID := getNewObjectID
+	getNewObjectID = func() bson.ObjectId { return commentID }
+	defer func() { getNewObjectID = oldGetNewObjectID }()
+
+	commentTimestamp := getTimestamp()
+	oldGetTimestamp := getTimestamp
+	getTimestamp = func() time.Time { return commentTimestamp }
+	defer func() { getTimestamp = oldGetTimestamp }()
+
+	onUpsertItem(&m, "function", bson.M{"$push": bson.M{"comments": comment{ID: commentID, Text: "Hello, World", CreatedAt: commentTimestamp, Author: currentUser}}}, nil)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/items/function/default/hello/-/comments", bytes.NewBufferString(`{"text": "Hello, World"}`))
+	newRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	m.AssertExpectations(t)
+}
+
+func TestItemTypeConflict(t *testing.T) {
+	var m mock.Mock
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress", Type: "chart"}
+	})
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"star", "PUT", "/v1/items/function/stable/wordpress/-/star", `{"has_starred": true}`},
+		{"comment", "POST", "/v1/items/function/stable/wordpress/-/comments", `{"text": "Hello"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body)))
+			assert.Equal(t, http.StatusConflict, w.Code)
+		})
+	}
+	m.AssertNotCalled(t, "Apply", mock.Anything, mock.Anything)
+}
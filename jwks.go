@@ -0,0 +1,310 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// publicKey is a key verifying token signatures
+type publicKey struct {
+	// *rsa.PublicKey or *ecdsa.PublicKey
+	key interface{}
+	// Algorithm the key is restricted to, if any
+	alg string
+}
+
+// keySource loads public keys by key ID
+type keySource interface {
+	Load() (map[string]publicKey, error)
+}
+
+// newKeySource returns the source of the public keys in a PEM file, or in a
+// JWKS document given by its path or HTTP(S) URL
+func newKeySource(pemPath, jwks string) keySource {
+	if pemPath != "" {
+		return &pemKeySource{path: pemPath}
+	}
+	if strings.HasPrefix(jwks, "http://") || strings.HasPrefix(jwks, "https://") {
+		return &httpJWKSSource{url: jwks, client: &http.Client{Timeout: 30 * time.Second}}
+	}
+	return &fileJWKSSource{path: jwks}
+}
+
+// jwksMinRefreshInterval limits how often tokens with an unknown key ID make
+// the keys reload
+var jwksMinRefreshInterval = time.Minute
+
+// keySet keeps the keys of a source in memory. Keys are reloaded when a
+// token refers to an unknown key ID, so that rotated keys are picked up.
+type keySet struct {
+	source keySource
+
+	mu          sync.RWMutex
+	keys        map[string]publicKey
+	lastRefresh time.Time
+}
+
+func newKeySet(source keySource) *keySet {
+	return &keySet{source: source}
+}
+
+// Refresh reloads the keys, keeping the previous ones if it fails
+func (ks *keySet) Refresh() error {
+	ks.mu.Lock()
+	ks.lastRefresh = time.Now()
+	ks.mu.Unlock()
+
+	keys, err := ks.source.Load()
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	log.WithFields(log.Fields{"keys": len(keys)}).Info("loaded token verification keys")
+	return nil
+}
+
+// RefreshEvery reloads the keys periodically until stop is closed
+func (ks *keySet) RefreshEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ks.Refresh(); err != nil {
+				log.WithError(err).Error("could not refresh token verification keys")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// lookup returns the key with the ID. Tokens without a key ID may only be
+// verified by a set of a single key, and the single key of a source without
+// key IDs, like a PEM file, verifies tokens whatever their key ID.
+func (ks *keySet) lookup(kid string) (publicKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	if k, ok := ks.keys[""]; ok && len(ks.keys) == 1 {
+		return k, true
+	}
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// Key returns the key with the ID, reloading the keys if it is unknown
+func (ks *keySet) Key(kid string) (publicKey, error) {
+	if k, ok := ks.lookup(kid); ok {
+		return k, nil
+	}
+	ks.mu.RLock()
+	stale := time.Since(ks.lastRefresh) >= jwksMinRefreshInterval
+	ks.mu.RUnlock()
+	if stale {
+		if err := ks.Refresh(); err != nil {
+			log.WithError(err).Error("could not refresh token verification keys")
+		}
+		if k, ok := ks.lookup(kid); ok {
+			return k, nil
+		}
+	}
+	return publicKey{}, fmt.Errorf("unknown key %q", kid)
+}
+
+// pemKeySource reads a single RSA or ECDSA public key, or certificate, from
+// a PEM file. Its key ID is empty.
+type pemKeySource struct {
+	path string
+}
+
+func (s *pemKeySource) Load() (map[string]publicKey, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return map[string]publicKey{"": {key: key}}, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return map[string]publicKey{"": {key: key}}, nil
+	}
+	return nil, fmt.Errorf("%s does not contain an RSA or ECDSA public key", s.path)
+}
+
+// fileJWKSSource reads a JSON Web Key Set file
+type fileJWKSSource struct {
+	path string
+}
+
+func (s *fileJWKSSource) Load() (map[string]publicKey, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", s.path, err)
+	}
+	return keys, nil
+}
+
+// httpJWKSSource fetches a JSON Web Key Set, e.g. from the jwks_uri of an
+// OpenID Connect provider
+type httpJWKSSource struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpJWKSSource) Load() (map[string]publicKey, error) {
+	res, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", res.StatusCode, s.url)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", s.url, err)
+	}
+	return keys, nil
+}
+
+// jsonWebKey is the subset of RFC 7517 keys we need
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signature verification keys of a JSON Web Key Set.
+// Keys of other types or uses are ignored.
+func parseJWKS(data []byte) (map[string]publicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]publicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaKey(k)
+		case "EC":
+			key, err = ecKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = publicKey{key: key, alg: k.Alg}
+	}
+	return keys, nil
+}
+
+// base64Int decodes a base64url-encoded big-endian integer
+func base64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func rsaKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64Int(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	e, err := base64Int(k.E)
+	if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func ecKey(k jsonWebKey) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64Int(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x: %v", err)
+	}
+	y, err := base64Int(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y: %v", err)
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
@@ -0,0 +1,243 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticKeys is a keySource of fixed keys
+type staticKeys map[string]publicKey
+
+func (s staticKeys) Load() (map[string]publicKey, error) {
+	return s, nil
+}
+
+func base64URL(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// jwkOf returns the JSON Web Key of an RSA or ECDSA public key
+func jwkOf(kid string, key interface{}) jsonWebKey {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{Kty: "RSA", Kid: kid, Use: "sig", N: base64URL(k.N), E: base64URL(big.NewInt(int64(k.E)))}
+	case *ecdsa.PublicKey:
+		return jsonWebKey{Kty: "EC", Kid: kid, Crv: k.Curve.Params().Name, X: base64URL(k.X), Y: base64URL(k.Y)}
+	}
+	panic("unsupported key")
+}
+
+// jwksStub serves a JSON Web Key Set that can be changed, counting requests
+type jwksStub struct {
+	mu       sync.Mutex
+	keys     []jsonWebKey
+	requests int
+}
+
+func (s *jwksStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+}
+
+func (s *jwksStub) setKeys(keys ...jsonWebKey) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	rsaJWK := jwkOf("rsa-1", &rsaKey.PublicKey)
+	rsaJWK.Alg = "RS256"
+	encJWK := jwkOf("rsa-enc", &rsaKey.PublicKey)
+	encJWK.Use = "enc"
+	data, err := json.Marshal(map[string]interface{}{"keys": []interface{}{
+		rsaJWK,
+		jwkOf("ec-1", &ecKey.PublicKey),
+		encJWK,
+		map[string]string{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}})
+	require.NoError(t, err)
+
+	keys, err := parseJWKS(data)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2, "encryption and symmetric keys are ignored")
+	assert.Equal(t, publicKey{key: &rsaKey.PublicKey, alg: "RS256"}, keys["rsa-1"])
+	assert.True(t, ecKey.PublicKey.X.Cmp(keys["ec-1"].key.(*ecdsa.PublicKey).X) == 0)
+
+	invalid := jwkOf("ec-1", &ecKey.PublicKey)
+	invalid.Y = invalid.X
+	tests := []struct {
+		name string
+		key  jsonWebKey
+		err  string
+	}{
+		{"point not on curve", invalid, `key "ec-1": point is not on curve P-256`},
+		{"unknown curve", jsonWebKey{Kty: "EC", Kid: "ec-2", Crv: "P-192"}, `key "ec-2": unsupported curve "P-192"`},
+		{"invalid modulus", jsonWebKey{Kty: "RSA", Kid: "rsa-2", N: "!", E: "AQAB"}, `key "rsa-2": invalid modulus: illegal base64 data at input byte 0`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(map[string]interface{}{"keys": []jsonWebKey{tt.key}})
+			require.NoError(t, err)
+			_, err = parseJWKS(data)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	stub := &jwksStub{}
+	stub.setKeys(jwkOf("rsa-1", &rsaKey.PublicKey))
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	keys := newKeySet(newKeySource("", server.URL))
+	require.NoError(t, keys.Refresh())
+	v, err := newTokenVerifier("", keys, nil)
+	require.NoError(t, err)
+	user := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	rotated := signToken(t, jwt.SigningMethodES256, ecKey, "ec-1", testClaims(user))
+
+	// Unknown keys only reload the set once per interval
+	_, err = v.userFromToken(rotated)
+	assert.EqualError(t, err, `token signature could not be verified: unknown key "ec-1"`)
+	assert.Equal(t, 1, stub.requests)
+
+	stub.setKeys(jwkOf("rsa-1", &rsaKey.PublicKey), jwkOf("ec-1", &ecKey.PublicKey))
+	oldInterval := jwksMinRefreshInterval
+	jwksMinRefreshInterval = 0
+	defer func() { jwksMinRefreshInterval = oldInterval }()
+
+	got, err := v.userFromToken(rotated)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, got.ID)
+	assert.Equal(t, 2, stub.requests)
+
+	// Known keys don't reload the set
+	_, err = v.userFromToken(signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", testClaims(user)))
+	require.NoError(t, err)
+	assert.Equal(t, 2, stub.requests)
+}
+
+func TestKeySetKeepsKeysOnFailure(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	stub := &jwksStub{}
+	stub.setKeys(jwkOf("rsa-1", &rsaKey.PublicKey))
+	server := httptest.NewServer(stub)
+
+	keys := newKeySet(newKeySource("", server.URL))
+	require.NoError(t, keys.Refresh())
+	server.Close()
+	assert.Error(t, keys.Refresh())
+	_, err := keys.Key("rsa-1")
+	assert.NoError(t, err)
+}
+
+func TestKeySources(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	rsaKey, ecKey := testKeys(t)
+	user := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+
+	writePEM := func(name string, key interface{}) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		require.NoError(t, err)
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+		return path
+	}
+	jwksPath := filepath.Join(dir, "jwks.json")
+	data, err := json.Marshal(map[string]interface{}{"keys": []jsonWebKey{jwkOf("ec-1", &ecKey.PublicKey)}})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(jwksPath, data, 0600))
+	notAKey := filepath.Join(dir, "key.txt")
+	require.NoError(t, ioutil.WriteFile(notAKey, []byte("hello"), 0600))
+
+	tests := []struct {
+		name   string
+		source keySource
+		token  string
+		err    string
+	}{
+		{"RSA PEM", newKeySource(writePEM("rsa.pem", &rsaKey.PublicKey), ""), signToken(t, jwt.SigningMethodRS256, rsaKey, "", testClaims(user)), ""},
+		{"ECDSA PEM", newKeySource(writePEM("ec.pem", &ecKey.PublicKey), ""), signToken(t, jwt.SigningMethodES256, ecKey, "", testClaims(user)), ""},
+		{"PEM with key ID", newKeySource(writePEM("rsa-kid.pem", &rsaKey.PublicKey), ""), signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", testClaims(user)), ""},
+		{"JWKS file", newKeySource("", jwksPath), signToken(t, jwt.SigningMethodES256, ecKey, "ec-1", testClaims(user)), ""},
+		{"invalid PEM", newKeySource(notAKey, ""), "", notAKey + " does not contain an RSA or ECDSA public key"},
+		{"invalid JWKS", newKeySource("", notAKey), "", "could not parse " + notAKey + ": invalid character 'h' looking for beginning of value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := newKeySet(tt.source)
+			err := keys.Refresh()
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			v, err := newTokenVerifier("", keys, nil)
+			require.NoError(t, err)
+			_, err = v.userFromToken(tt.token)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestKeySetRefreshEvery(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	stub := &jwksStub{}
+	stub.setKeys(jwkOf("rsa-1", &rsaKey.PublicKey))
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	keys := newKeySet(newKeySource("", server.URL))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		keys.RefreshEvery(time.Millisecond, stop)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		_, ok := keys.lookup("rsa-1")
+		return ok
+	}, time.Second, time.Millisecond)
+	close(stop)
+	<-done
+}
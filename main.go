@@ -20,6 +20,7 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/heptiolabs/healthcheck"
@@ -28,38 +29,190 @@ import (
 	"github.com/urfave/negroni"
 )
 
-var dbSession datastore.Session
-
 func main() {
+	storage := flag.String("storage", "mongo", "Storage backend, one of mongo, sqlite, postgres, bolt or memory (for development, data is lost on exit)")
+	sqlitePath := flag.String("sqlite-path", "ratesvc.db", "SQLite database file")
+	boltPath := flag.String("bolt-path", "ratesvc.bolt", "Embedded database file")
+	boltSnapshotPath := flag.String("bolt-snapshot-path", "", "File periodically replaced by a consistent copy of the embedded database (disabled if empty)")
+	boltSnapshotInterval := flag.Duration("bolt-snapshot-interval", time.Hour, "Interval between snapshots of the embedded database")
+	postgresURL := flag.String("postgres-url", "postgres://localhost/ratesvc?sslmode=disable", "PostgreSQL connection URL, the password can be set in PGPASSWORD (see https://godoc.org/github.com/lib/pq)")
 	dbURL := flag.String("mongo-url", "localhost", "MongoDB URL (see https://godoc.org/labix.org/v2/mgo#Dial for format)")
 	dbName := flag.String("mongo-database", "ratesvc", "MongoDB database")
 	dbUsername := flag.String("mongo-user", "", "MongoDB user")
 	dbPassword := os.Getenv("MONGO_PASSWORD")
+	migrate := flag.Bool("migrate", true, "Apply pending MongoDB migrations at startup")
+	ensureIdx := flag.Bool("ensure-indexes", true, "Create missing MongoDB indexes at startup")
+	flag.IntVar(&commentsHub.config.MaxConnections, "ws-max-connections", defaultHubConfig.MaxConnections, "Maximum number of open comment WebSockets (0 for unlimited)")
+	flag.IntVar(&commentsHub.config.MaxConnectionsPerItem, "ws-max-connections-per-item", defaultHubConfig.MaxConnectionsPerItem, "Maximum number of open comment WebSockets per item (0 for unlimited)")
+	flag.DurationVar(&commentsHub.config.PingInterval, "ws-ping-interval", defaultHubConfig.PingInterval, "Interval between pings sent to comment WebSocket clients")
+	flag.DurationVar(&commentsHub.config.PongTimeout, "ws-pong-timeout", defaultHubConfig.PongTimeout, "Time to wait for a pong before closing a comment WebSocket")
+	flag.Var(itemTypesFlag{}, "item-type", "Additional item type in the form name=pattern, where pattern is a regular expression for its IDs (can be repeated)")
+	catalogSource := flag.String("catalog", "", "Helm index.yaml file, directory of index files or chart service URL used to reject unknown charts (disabled if empty)")
+	catalogRefresh := flag.Duration("catalog-refresh", 10*time.Minute, "Interval between catalogue reloads")
+	flag.StringVar(&authCookieName, "auth-cookie", authCookieName, "Cookie holding the JWT of browser sessions, used if the request has no Authorization: Bearer header")
+	jwtAlgorithms := flag.String("jwt-algorithms", "", "Comma-separated JWT signing algorithms to accept, e.g. RS256,ES256 (defaults to those of the configured keys)")
+	jwtPublicKey := flag.String("jwt-public-key", "", "PEM file with the RSA or ECDSA public key verifying JWTs")
+	jwks := flag.String("jwks", "", "JSON Web Key Set file or URL with the public keys verifying JWTs, selected by their kid")
+	jwksRefresh := flag.Duration("jwks-refresh", time.Hour, "Interval between reloads of the JSON Web Key Set")
+	jwtIssuers := flag.String("jwt-issuer", "", "Comma-separated iss values accepted in JWTs (any if empty)")
+	jwtAudiences := flag.String("jwt-audience", "", "Comma-separated aud values, one of which JWTs must have (not checked if empty)")
+	jwtLeeway := flag.Duration("jwt-leeway", time.Minute, "Clock skew allowed when checking the exp, nbf and iat claims of JWTs")
+	jwtRequiredClaims := flag.String("jwt-required-claims", "", "Comma-separated claims JWTs must have, among iss, sub, aud, exp, nbf, iat and jti, e.g. exp to reject tokens that never expire (none if empty)")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect provider issuer URL, enables logging in at /auth/login (the client secret is read from OIDC_CLIENT_SECRET)")
+	oidcClientID := flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "Public URL of /auth/callback registered with the OpenID Connect provider")
+	oidcScopes := flag.String("oidc-scopes", "openid,profile,email", "Comma-separated scopes requested from the OpenID Connect provider")
+	oidcRolesClaim := flag.String("oidc-roles-claim", "", "ID token claim holding the roles of users, only the roles file assigns roles to OpenID Connect users if empty")
+	sessionTTL := flag.Duration("session-ttl", 24*time.Hour, "How long sessions started by logging in with OpenID Connect last")
+	csrfOrigins := flag.String("csrf-trusted-origins", "", "Comma-separated origins, e.g. https://hub.example.com, allowed to make cookie-authenticated writes and open comment WebSockets besides the service's own")
+	corsOrigins := flag.String("cors-allowed-origins", "", "Comma-separated origins allowed to call the API from browsers, or * for any (CORS is disabled if empty)")
+	corsMethods := flag.String("cors-allowed-methods", "GET,POST,PUT,DELETE", "Comma-separated methods allowed in cross-origin requests")
+	corsHeaders := flag.String("cors-allowed-headers", "Authorization,Content-Type", "Comma-separated headers allowed in cross-origin requests")
+	corsCredentials := flag.Bool("cors-allow-credentials", false, "Let browsers send the session cookie with cross-origin requests, which also trusts the CORS origins for cookie-authenticated writes")
+	corsMaxAge := flag.Duration("cors-max-age", 10*time.Minute, "How long browsers may cache preflight responses")
+	rolesFile := flag.String("roles-file", "", "YAML file listing the IDs of the users with each role (user, moderator or admin), in addition to the roles claim of their JWTs")
+	flag.DurationVar(&badgeMaxAge, "badge-max-age", badgeMaxAge, "How long badges may be cached by CDNs and browsers")
 	flag.Parse()
 
-	mongoConfig := datastore.Config{URL: *dbURL, Database: *dbName, Username: *dbUsername, Password: dbPassword}
+	if commentsHub.config.PingInterval >= commentsHub.config.PongTimeout {
+		log.Fatal("--ws-ping-interval must be shorter than --ws-pong-timeout")
+	}
+
+	cfg := storeConfig{
+		mongo:       datastore.Config{URL: *dbURL, Database: *dbName, Username: *dbUsername, Password: dbPassword},
+		sqlitePath:  *sqlitePath,
+		postgresURL: *postgresURL,
+		boltPath:    *boltPath,
+	}
 	var err error
-	dbSession, err = datastore.NewSession(mongoConfig)
+	store, err = newStore(*storage, cfg)
 	if err != nil {
-		log.WithFields(log.Fields{"host": *dbURL}).Fatal(err)
+		log.WithFields(log.Fields{"storage": *storage}).Fatal(err)
 	}
 
-	r := mux.NewRouter()
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args(), os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Healthcheck
-	health := healthcheck.NewHandler()
-	r.Handle("/live", health)
-	r.Handle("/ready", health)
+	if ms, ok := store.(*mongoStore); ok && *migrate {
+		if _, err := newMigrator(ms.session).Up(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if ms, ok := store.(*mongoStore); ok && *ensureIdx {
+		db, closer := ms.session.DB()
+		drift, err := ensureIndexes(db)
+		closer()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, d := range drift {
+			log.Warn(d)
+		}
+	}
 
-	// Routes
-	apiv1 := r.PathPrefix("/v1").Subrouter()
-	apiv1.Methods("GET").Path("/stars").HandlerFunc(GetStars)
-	apiv1.Methods("PUT").Path("/stars").HandlerFunc(UpdateStar)
-	apiv1.Methods("GET").Path("/comments/{repo}/{chartName}").Handler(WithParams(GetComments))
-	apiv1.Methods("POST").Path("/comments/{repo}/{chartName}").Handler(WithParams(CreateComment))
-	apiv1.Methods("DELETE").Path("/comments/{repo}/{chartName}/{commentId}").Handler(WithParams(DeleteComment))
+	if bs, ok := store.(*boltStore); ok && *boltSnapshotPath != "" {
+		go bs.SnapshotEvery(*boltSnapshotPath, *boltSnapshotInterval, nil)
+	}
+
+	var keys *keySet
+	if *jwtPublicKey != "" || *jwks != "" {
+		keys = newKeySet(newKeySource(*jwtPublicKey, *jwks))
+		if err := keys.Refresh(); err != nil {
+			log.Fatal(err)
+		}
+		if *jwtPublicKey == "" {
+			go keys.RefreshEvery(*jwksRefresh, nil)
+		}
+	}
+	// HMAC-signed tokens are verified with JWT_KEY, the others with the public keys
+	jwtVerifier, err = newTokenVerifier(os.Getenv("JWT_KEY"), keys, splitList(*jwtAlgorithms))
+	if err != nil {
+		log.Fatal(err)
+	}
+	jwtVerifier.policy = claimsPolicy{
+		Issuers:   splitList(*jwtIssuers),
+		Audiences: splitList(*jwtAudiences),
+		Leeway:    *jwtLeeway,
+		Required:  splitList(*jwtRequiredClaims),
+	}
+	if err := validateClaimNames(jwtVerifier.policy.Required); err != nil {
+		log.Fatal(err)
+	}
+
+	trustedOrigins = splitList(*csrfOrigins)
+	var corsPolicy *cors
+	if *corsOrigins != "" {
+		corsPolicy, err = newCORS(corsConfig{
+			AllowedOrigins:   splitList(*corsOrigins),
+			AllowedMethods:   splitList(*corsMethods),
+			AllowedHeaders:   splitList(*corsHeaders),
+			AllowCredentials: *corsCredentials,
+			MaxAge:           *corsMaxAge,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Origins sent credentials are trusted as much as the service's own
+		if *corsCredentials {
+			trustedOrigins = append(trustedOrigins, corsPolicy.config.AllowedOrigins...)
+		}
+	}
+
+	if *rolesFile != "" {
+		roles, err := loadRoleAssignments(*rolesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setAssignedRoles(roles)
+	}
+
+	if *oidcIssuer != "" {
+		// Sessions are signed with JWT_KEY, so they must pass the verifier
+		if !containsString(jwtVerifier.algorithms, "HS256") {
+			log.Fatal("HS256 must be an accepted JWT algorithm to log in with OpenID Connect")
+		}
+		config := oidcConfig{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  *oidcRedirectURL,
+			Scopes:       splitList(*oidcScopes),
+			SessionKey:   []byte(os.Getenv("JWT_KEY")),
+			SessionTTL:   *sessionTTL,
+			Leeway:       *jwtLeeway,
+			RolesClaim:   *oidcRolesClaim,
+		}
+		if issuers := jwtVerifier.policy.Issuers; len(issuers) > 0 {
+			config.SessionIssuer = issuers[0]
+		}
+		if audiences := jwtVerifier.policy.Audiences; len(audiences) > 0 {
+			config.SessionAudience = audiences[0]
+		}
+		loginProvider, err = newOIDCLogin(config)
+		if err != nil {
+			log.WithFields(log.Fields{"issuer": *oidcIssuer}).Fatal(err)
+		}
+	}
+
+	if *catalogSource != "" {
+		c := newCatalog(*catalogSource)
+		if err := c.Refresh(); err != nil {
+			log.WithFields(log.Fields{"catalog": *catalogSource}).Fatal(err)
+		}
+		go c.RefreshEvery(*catalogRefresh, nil)
+		validator = c
+	}
+
+	r := newRouter()
 
 	n := negroni.Classic()
+	if corsPolicy != nil {
+		n.Use(corsPolicy)
+	}
 	n.UseHandler(r)
 
 	port := os.Getenv("PORT")
@@ -70,3 +223,66 @@ func main() {
 	log.WithFields(log.Fields{"addr": addr}).Info("Started RateSvc")
 	http.ListenAndServe(addr, n)
 }
+
+// newRouter returns the router with all the service routes
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(csrfProtection)
+
+	// Healthcheck
+	health := healthcheck.NewHandler()
+	r.Handle("/live", health)
+	r.Handle("/ready", health)
+
+	// Login
+	if loginProvider != nil {
+		r.Methods("GET").Path("/auth/login").HandlerFunc(loginProvider.Login)
+		r.Methods("GET").Path("/auth/callback").HandlerFunc(loginProvider.Callback)
+		// Logging out revokes the session, so it is only done by POST requests
+		// that pass the CSRF checks
+		r.Methods("POST").Path("/auth/logout").HandlerFunc(loginProvider.Logout)
+	}
+
+	// Routes, each declaring the permission it requires
+	apiv1 := r.PathPrefix("/v1").Subrouter()
+	route := func(p permission, method, path string, h http.Handler) {
+		apiv1.Methods(method).Path(path).Handler(requirePermission(p, h))
+	}
+	route(permRead, "GET", "/stars", http.HandlerFunc(GetStars))
+	route(permStar, "PUT", "/stars", http.HandlerFunc(UpdateStar))
+	route(permRead, "GET", "/comments/{repo}/{chartName}", WithParams(GetComments))
+	route(permComment, "POST", "/comments/{repo}/{chartName}", WithParams(CreateComment))
+	route(permComment, "PUT", "/comments/{repo}/{chartName}/{commentId}", WithParams(UpdateComment))
+	route(permComment, "DELETE", "/comments/{repo}/{chartName}/{commentId}", WithParams(DeleteComment))
+	// Anonymous users can follow comments, posting is checked per message
+	route(permRead, "GET", "/ws/comments/{repo}/{chartName}", WithParams(CommentsSocket))
+	route(permRead, "GET", "/feeds/comments/{repo}/{chartName}.{format:atom|rss}", WithParams(GetItemCommentsFeed))
+	route(permRead, "GET", "/feeds/comments/{repo}.{format:atom|rss}", WithParams(GetRepoCommentsFeed))
+	route(permRead, "GET", "/badges/stars/{repo}/{chartName}.svg", WithParams(GetStarsBadge))
+	route(permRead, "GET", "/badges/rating/{repo}/{chartName}.svg", WithParams(GetRatingBadge))
+	// Item type-aware routes. IDs may contain any number of path segments, so
+	// the sub-resources of items follow a - segment, which IDs can't contain.
+	route(permRead, "GET", "/items/{type}/{id:.+}/-/comments", WithParams(validItem(GetComments)))
+	route(permComment, "POST", "/items/{type}/{id:.+}/-/comments", WithParams(validItem(CreateComment)))
+	route(permComment, "PUT", "/items/{type}/{id:.+}/-/comments/{commentId}", WithParams(validItem(UpdateComment)))
+	route(permComment, "DELETE", "/items/{type}/{id:.+}/-/comments/{commentId}", WithParams(validItem(DeleteComment)))
+	route(permStar, "PUT", "/items/{type}/{id:.+}/-/star", WithParams(validItem(UpdateItemStar)))
+	route(permRead, "GET", "/items/{type}/{id:.+}/-/ws", WithParams(validItem(CommentsSocket)))
+	route(permRead, "GET", "/items/{type}/{id:.+}/-/comments.{format:atom|rss}", WithParams(validItem(GetItemCommentsFeed)))
+	route(permRead, "GET", "/items/{type}/{id:.+}/-/badges/stars.svg", WithParams(validItem(GetStarsBadge)))
+	route(permRead, "GET", "/items/{type}/{id:.+}/-/badges/rating.svg", WithParams(validItem(GetRatingBadge)))
+	route(permRead, "GET", "/items/{type}/{id:.+}", WithParams(validItem(GetItem)))
+	route(permRead, "GET", "/repos", http.HandlerFunc(ListRepos))
+	route(permRead, "GET", "/repos/{repo}/stats", WithParams(GetRepoStats))
+	route(permManageTokens, "GET", "/tokens", http.HandlerFunc(ListAPITokens))
+	route(permManageTokens, "POST", "/tokens", http.HandlerFunc(CreateAPIToken))
+	route(permManageTokens, "DELETE", "/tokens/{tokenId}", WithParams(DeleteAPIToken))
+	route(permAdminister, "GET", "/revocations", http.HandlerFunc(ListRevocations))
+	route(permAdminister, "POST", "/revocations", http.HandlerFunc(CreateRevocation))
+	route(permAdminister, "DELETE", "/revocations/{revocationId}", WithParams(DeleteRevocation))
+	route(permModerate, "GET", "/sanctions", http.HandlerFunc(ListSanctions))
+	route(permModerate, "POST", "/sanctions", http.HandlerFunc(CreateSanction))
+	route(permModerate, "DELETE", "/sanctions/{sanctionId}", WithParams(DeleteSanction))
+
+	return r
+}
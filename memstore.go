@@ -0,0 +1,431 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// memoryStore keeps items in memory, for tests and local development. Data
+// is lost when the process exits.
+type memoryStore struct {
+	mu          sync.RWMutex
+	items       map[string]*item
+	tokens      map[bson.ObjectId]*apiToken
+	revocations map[bson.ObjectId]*revocation
+	sanctions   map[bson.ObjectId]*sanction
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		items:       map[string]*item{},
+		tokens:      map[bson.ObjectId]*apiToken{},
+		revocations: map[bson.ObjectId]*revocation{},
+		sanctions:   map[bson.ObjectId]*sanction{},
+	}
+}
+
+// copyItem returns a deep copy of the item, so that callers can't modify the
+// stored data
+func copyItem(it *item) *item {
+	c := *it
+	c.StargazersIDs = append([]bson.ObjectId(nil), it.StargazersIDs...)
+	if it.StargazerVersions != nil {
+		c.StargazerVersions = map[string]string{}
+		for k, v := range it.StargazerVersions {
+			c.StargazerVersions[k] = v
+		}
+	}
+	c.Comments = nil
+	for _, cm := range it.Comments {
+		c.Comments = append(c.Comments, copyComment(cm))
+	}
+	return &c
+}
+
+func copyComment(cm comment) comment {
+	if cm.Author != nil {
+		author := *cm.Author
+		cm.Author = &author
+	}
+	if cm.UpdatedAt != nil {
+		updatedAt := *cm.UpdatedAt
+		cm.UpdatedAt = &updatedAt
+	}
+	return cm
+}
+
+// find returns the stored item, following aliases. It must be called with
+// the lock held.
+func (s *memoryStore) find(id string) (*item, error) {
+	for i := 0; i < maxAliasHops; i++ {
+		it, ok := s.items[id]
+		if !ok {
+			return nil, errNotFound
+		}
+		if it.AliasOf == "" {
+			return it, nil
+		}
+		id = it.AliasOf
+	}
+	return nil, fmt.Errorf("too many aliases resolving item %q", id)
+}
+
+func (s *memoryStore) GetItem(id string) (*item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	it, err := s.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return copyItem(it), nil
+}
+
+func (s *memoryStore) ListItems(repo string) ([]*item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list(repo), nil
+}
+
+// stats returns the counts of the charts of the repo, or of every chart if
+// the repo is empty. It must be called with the lock held.
+func (s *memoryStore) stats(repo string, hiddenAuthors []bson.ObjectId) []itemStats {
+	var stats []itemStats
+	for _, it := range s.list(repo) {
+		if isItemType(it, "chart") {
+			stats = append(stats, statsOf(it, hiddenAuthors))
+		}
+	}
+	return stats
+}
+
+// list returns copies of the charts of the repo, or of every item if the repo
+// is empty, sorted by ID. It must be called with the lock held.
+func (s *memoryStore) list(repo string) []*item {
+	items := []*item{}
+	for _, it := range s.items {
+		if it.AliasOf != "" || (repo != "" && (!isItemType(it, "chart") || repoOf(it.ID) != repo)) {
+			continue
+		}
+		items = append(items, copyItem(it))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+func (s *memoryStore) ListAliases() (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	aliases := map[string]string{}
+	for _, it := range s.items {
+		if it.AliasOf != "" {
+			aliases[it.ID] = it.AliasOf
+		}
+	}
+	return aliases, nil
+}
+
+func (s *memoryStore) CreateItem(it item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[it.ID]; ok {
+		return fmt.Errorf("item %q already exists", it.ID)
+	}
+	stored := copyItem(&it)
+	// Only persisted fields are kept
+	stored.StargazersCount, stored.HasStarred, stored.StargazersByVersion, stored.StarredVersion = 0, false, nil, ""
+	s.items[it.ID] = stored
+	return nil
+}
+
+// update runs fn on the stored item with the given ID
+func (s *memoryStore) update(id string, fn func(it *item) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.items[id]
+	if !ok {
+		return errNotFound
+	}
+	return fn(it)
+}
+
+// upsert runs fn on the stored item with the given ID, following aliases,
+// or on a new item of the given type if it doesn't exist, and returns a copy
+// of the result
+func (s *memoryStore) upsert(id, itemType string, fn func(it *item)) (*item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, err := s.find(id)
+	if err == errNotFound {
+		it = &item{ID: id, Type: itemType}
+		s.items[id] = it
+	} else if err != nil {
+		return nil, err
+	}
+	fn(it)
+	return copyItem(it), nil
+}
+
+func (s *memoryStore) AddStar(itemID, itemType string, userID bson.ObjectId, version string) (*item, bool, error) {
+	var changed bool
+	it, err := s.upsert(itemID, itemType, func(it *item) {
+		changed = !hasStarred(it, &User{ID: userID})
+		addStargazer(it, userID, version)
+	})
+	return it, changed, err
+}
+
+func (s *memoryStore) RemoveStar(itemID, itemType string, userID bson.ObjectId) (*item, bool, error) {
+	var changed bool
+	it, err := s.upsert(itemID, itemType, func(it *item) {
+		changed = hasStarred(it, &User{ID: userID})
+		removeStargazer(it, userID)
+	})
+	return it, changed, err
+}
+
+func (s *memoryStore) AddComment(itemID, itemType string, cm comment) error {
+	_, err := s.upsert(itemID, itemType, func(it *item) {
+		it.Comments = append(it.Comments, copyComment(cm))
+	})
+	return err
+}
+
+func (s *memoryStore) UpdateComment(itemID string, commentID bson.ObjectId, text string, updatedAt time.Time) error {
+	return s.update(itemID, func(it *item) error {
+		return editComment(it, commentID, text, updatedAt)
+	})
+}
+
+func (s *memoryStore) DeleteComment(itemID string, commentID bson.ObjectId) error {
+	return s.update(itemID, func(it *item) error {
+		return removeComment(it, commentID)
+	})
+}
+
+func (s *memoryStore) ListRepos(hiddenAuthors []bson.ObjectId) ([]repoStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return aggregateRepos(s.stats("", hiddenAuthors)), nil
+}
+
+func (s *memoryStore) GetRepoStats(repo string, limit int, hiddenAuthors []bson.ObjectId) (*repoStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := aggregateRepoStats(repo, s.stats(repo, hiddenAuthors), limit)
+	if stats == nil {
+		return nil, errNotFound
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) MergeItems(fromID, toID string) (*item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fromID == toID {
+		return nil, errMergeIntoItself
+	}
+
+	stored, ok := s.items[fromID]
+	if !ok {
+		return nil, fmt.Errorf("could not find item %q: %v", fromID, errNotFound)
+	}
+	from := copyItem(stored)
+
+	to := &item{ID: toID, Type: from.Type}
+	if stored, err := s.find(toID); err == nil {
+		to = copyItem(stored)
+	}
+	if err := mergeInto(from, to); err != nil {
+		return nil, err
+	}
+
+	s.items[to.ID] = copyItem(to)
+	s.items[fromID] = &item{ID: fromID, Type: from.Type, AliasOf: to.ID}
+	return to, nil
+}
+
+func copyAPIToken(t *apiToken) *apiToken {
+	c := *t
+	c.Scopes = append([]string(nil), t.Scopes...)
+	if t.User != nil {
+		user := *t.User
+		c.User = &user
+	}
+	if t.LastUsedAt != nil {
+		lastUsedAt := *t.LastUsedAt
+		c.LastUsedAt = &lastUsedAt
+	}
+	return &c
+}
+
+func (s *memoryStore) CreateAPIToken(t apiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[t.ID]; ok {
+		return fmt.Errorf("API token %s already exists", t.ID.Hex())
+	}
+	t.Token = ""
+	s.tokens[t.ID] = copyAPIToken(&t)
+	return nil
+}
+
+func (s *memoryStore) ListAPITokens(userID bson.ObjectId) ([]*apiToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tokens []*apiToken
+	for _, t := range s.tokens {
+		if userID == "" || t.User.ID == userID {
+			tokens = append(tokens, copyAPIToken(t))
+		}
+	}
+	sortByCreation(tokens, func(i int) (time.Time, bson.ObjectId) { return tokens[i].CreatedAt, tokens[i].ID })
+	return tokens, nil
+}
+
+func (s *memoryStore) FindAPIToken(hash string) (*apiToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens {
+		if t.Hash == hash {
+			return copyAPIToken(t), nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (s *memoryStore) DeleteAPIToken(userID, id bson.ObjectId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok || t.User.ID != userID {
+		return errNotFound
+	}
+	delete(s.tokens, id)
+	return nil
+}
+
+func (s *memoryStore) TouchAPIToken(id bson.ObjectId, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return errNotFound
+	}
+	t.LastUsedAt = &usedAt
+	return nil
+}
+
+func copyRevocation(r *revocation) *revocation {
+	c := *r
+	if r.IssuedBefore != nil {
+		issuedBefore := *r.IssuedBefore
+		c.IssuedBefore = &issuedBefore
+	}
+	if r.ExpiresAt != nil {
+		expiresAt := *r.ExpiresAt
+		c.ExpiresAt = &expiresAt
+	}
+	return &c
+}
+
+func (s *memoryStore) CreateRevocation(r revocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revocations[r.ID]; ok {
+		return fmt.Errorf("revocation %s already exists", r.ID.Hex())
+	}
+	s.revocations[r.ID] = copyRevocation(&r)
+	return nil
+}
+
+func (s *memoryStore) ListRevocations(now time.Time) ([]*revocation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*revocation
+	for _, r := range s.revocations {
+		if r.inEffect(now) {
+			list = append(list, copyRevocation(r))
+		}
+	}
+	sortByCreation(list, func(i int) (time.Time, bson.ObjectId) { return list[i].CreatedAt, list[i].ID })
+	return list, nil
+}
+
+func (s *memoryStore) DeleteRevocation(id bson.ObjectId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revocations[id]; !ok {
+		return errNotFound
+	}
+	delete(s.revocations, id)
+	return nil
+}
+
+func copySanction(sn *sanction) *sanction {
+	c := *sn
+	if sn.ExpiresAt != nil {
+		expiresAt := *sn.ExpiresAt
+		c.ExpiresAt = &expiresAt
+	}
+	return &c
+}
+
+func (s *memoryStore) CreateSanction(sn sanction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sanctions[sn.ID]; ok {
+		return fmt.Errorf("sanction %s already exists", sn.ID.Hex())
+	}
+	s.sanctions[sn.ID] = copySanction(&sn)
+	return nil
+}
+
+func (s *memoryStore) ListSanctions(now time.Time) ([]*sanction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*sanction
+	for _, sn := range s.sanctions {
+		if sn.inEffect(now) {
+			list = append(list, copySanction(sn))
+		}
+	}
+	sortByCreation(list, func(i int) (time.Time, bson.ObjectId) { return list[i].CreatedAt, list[i].ID })
+	return list, nil
+}
+
+func (s *memoryStore) DeleteSanction(id bson.ObjectId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sanctions[id]; !ok {
+		return errNotFound
+	}
+	delete(s.sanctions, id)
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Maximum number of aliases followed when looking up an item, so that alias
+// cycles can't loop forever
+const maxAliasHops = 10
+
+// errMergeIntoItself is returned when merging an item into itself
+var errMergeIntoItself = errors.New("cannot merge an item into itself")
+
+// mergeInto moves the stars and comments of from into to, checking that the
+// items can be merged. Stores persist the result.
+func mergeInto(from, to *item) error {
+	if from.AliasOf != "" {
+		return fmt.Errorf("item %q was already merged into %q", from.ID, from.AliasOf)
+	}
+	if to.ID == from.ID {
+		return errors.New("cannot merge an item into one of its aliases")
+	}
+	if !isItemType(to, from.Type) && !isItemType(from, to.Type) {
+		return errItemTypeConflict
+	}
+
+	stargazers := map[bson.ObjectId]bool{}
+	for _, id := range to.StargazersIDs {
+		stargazers[id] = true
+	}
+	for _, id := range from.StargazersIDs {
+		if !stargazers[id] {
+			stargazers[id] = true
+			to.StargazersIDs = append(to.StargazersIDs, id)
+			if version, ok := from.StargazerVersions[id.Hex()]; ok {
+				if to.StargazerVersions == nil {
+					to.StargazerVersions = map[string]string{}
+				}
+				to.StargazerVersions[id.Hex()] = version
+			}
+		}
+	}
+
+	// Comments already in the target were copied by a previous attempt
+	commented := map[bson.ObjectId]bool{}
+	for _, cm := range to.Comments {
+		commented[cm.ID] = true
+	}
+	for _, cm := range from.Comments {
+		if !commented[cm.ID] {
+			to.Comments = append(to.Comments, cm)
+		}
+	}
+	sort.SliceStable(to.Comments, func(i, j int) bool {
+		return to.Comments[i].CreatedAt.Before(to.Comments[j].CreatedAt)
+	})
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// onFindItem makes the next lookup of an item return it
+func onFindItem(m *mock.Mock, it *item) {
+	call := m.On("One", &item{})
+	if it == nil {
+		call.Return(errors.New("not found")).Once()
+		return
+	}
+	call.Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = *it
+	}).Once()
+}
+
+func TestMergeItems(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+
+	alice, bob, carol := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	day := func(d int) time.Time { return time.Date(2017, 11, d, 0, 0, 0, 0, time.UTC) }
+	c1 := comment{ID: bson.NewObjectId(), Text: "first", CreatedAt: day(1)}
+	c2 := comment{ID: bson.NewObjectId(), Text: "second", CreatedAt: day(2)}
+	c3 := comment{ID: bson.NewObjectId(), Text: "third", CreatedAt: day(3)}
+
+	onFindItem(&m, &item{ID: "incubator/foo", Type: "chart", StargazersIDs: []bson.ObjectId{alice, bob}, Comments: []comment{c2},
+		StargazerVersions: map[string]string{alice.Hex(): "1.0.0", bob.Hex(): "1.0.0"}})
+	onFindItem(&m, &item{ID: "stable/foo", Type: "chart", StargazersIDs: []bson.ObjectId{bob, carol}, Comments: []comment{c1, c3}})
+	onUpsertItem(&m, "chart", bson.M{
+		"$addToSet": bson.M{"stargazers_ids": bson.M{"$each": []bson.ObjectId{alice, bob}}},
+		"$push":     bson.M{"comments": bson.M{"$each": []comment{c2}, "$sort": bson.M{"created_at": 1}}},
+		"$set":      bson.M{"stargazer_versions." + alice.Hex(): "1.0.0"},
+	}, nil)
+	m.On("UpdateId", "incubator/foo", bson.M{"$set": bson.M{"alias_of": "stable/foo"}, "$unset": bson.M{"stargazers_ids": "", "stargazer_versions": "", "comments": ""}}).Return(nil)
+
+	it, err := store.MergeItems("incubator/foo", "stable/foo")
+	require.NoError(t, err)
+	assert.Equal(t, "stable/foo", it.ID)
+	assert.Len(t, it.StargazersIDs, 3)
+	assert.Equal(t, []comment{c1, c2, c3}, it.Comments)
+	m.AssertExpectations(t)
+}
+
+func TestMergeItemsAgain(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+
+	// The previous merge was interrupted before setting the alias
+	alice := bson.NewObjectId()
+	c1 := comment{ID: bson.NewObjectId(), Text: "first"}
+	onFindItem(&m, &item{ID: "incubator/foo", Type: "chart", StargazersIDs: []bson.ObjectId{alice}, Comments: []comment{c1}})
+	onFindItem(&m, &item{ID: "stable/foo", Type: "chart", StargazersIDs: []bson.ObjectId{alice}, Comments: []comment{c1}})
+	onUpsertItem(&m, "chart", bson.M{
+		"$addToSet": bson.M{"stargazers_ids": bson.M{"$each": []bson.ObjectId{alice}}},
+		"$push":     bson.M{"comments": bson.M{"$each": []comment{}, "$sort": bson.M{"created_at": 1}}},
+	}, nil)
+	m.On("UpdateId", "incubator/foo", mock.Anything).Return(nil)
+
+	it, err := store.MergeItems("incubator/foo", "stable/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []comment{c1}, it.Comments)
+	m.AssertExpectations(t)
+}
+
+func TestMergeItemsCreatesTarget(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+
+	alice := bson.NewObjectId()
+	c1 := comment{ID: bson.NewObjectId(), Text: "first"}
+	onFindItem(&m, &item{ID: "incubator/foo", Type: "chart", StargazersIDs: []bson.ObjectId{alice}, Comments: []comment{c1}})
+	onFindItem(&m, nil)
+	onUpsertItem(&m, "chart", bson.M{
+		"$addToSet": bson.M{"stargazers_ids": bson.M{"$each": []bson.ObjectId{alice}}},
+		"$push":     bson.M{"comments": bson.M{"$each": []comment{c1}, "$sort": bson.M{"created_at": 1}}},
+	}, nil)
+	m.On("UpdateId", "incubator/foo", mock.Anything).Return(nil)
+
+	_, err := store.MergeItems("incubator/foo", "stable/foo")
+	require.NoError(t, err)
+	m.AssertExpectations(t)
+}
+
+func TestMergeItemsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  *item
+		to    *item
+		toID  string
+		error string
+	}{
+		{"same item", nil, nil, "incubator/foo", "cannot merge an item into itself"},
+		{"missing source", nil, nil, "stable/foo", `could not find item "incubator/foo": not found`},
+		{"already merged", &item{ID: "incubator/foo", AliasOf: "stable/foo"}, nil, "stable/bar", `item "incubator/foo" was already merged into "stable/foo"`},
+		{"type conflict", &item{ID: "incubator/foo", Type: "chart"}, &item{ID: "stable/foo", Type: "function"}, "stable/foo", errItemTypeConflict.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m mock.Mock
+			store = newMongoStore(testutil.NewMockSession(&m))
+			onFindItem(&m, tt.from)
+			onFindItem(&m, tt.to)
+
+			_, err := store.MergeItems("incubator/foo", tt.toID)
+			require.Error(t, err)
+			assert.Equal(t, tt.error, err.Error())
+			m.AssertNotCalled(t, "Apply", mock.Anything, mock.Anything)
+			m.AssertNotCalled(t, "UpdateId", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestRequestsToAliasesResolveToTarget(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	target := &item{ID: "stable/foo", Type: "chart", Comments: []comment{
+		{ID: bson.NewObjectId(), Text: "Hello", Author: currentUser},
+	}}
+
+	t.Run("read", func(t *testing.T) {
+		onFindItem(&m, &item{ID: "incubator/foo", Type: "chart", AliasOf: "stable/foo"})
+		onFindItem(&m, target)
+		w := httptest.NewRecorder()
+		GetComments(w, httptest.NewRequest("GET", "/v1/comments/incubator/foo", nil), Params{"repo": "incubator", "chartName": "foo"})
+		var b body
+		json.NewDecoder(w.Body).Decode(&b)
+		assert.Len(t, b.Data, 1)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		onFindItem(&m, &item{ID: "incubator/foo", Type: "chart", AliasOf: "stable/foo"})
+		onFindItem(&m, target)
+		// The upsert doesn't match the alias and fails with a duplicate key
+		m.On("Apply", mock.Anything, &item{}).Return(nil, &mgo.LastError{Code: 11000}).Once()
+		onFindItem(&m, &item{ID: "incubator/foo", Type: "chart", AliasOf: "stable/foo"})
+		onUpsertItem(&m, "chart", bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}}, target)
+		w := httptest.NewRecorder()
+		UpdateStar(w, httptest.NewRequest("PUT", "/v1/stars", bytes.NewBufferString(`{"id": "incubator/foo", "has_starred": true}`)))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		m.AssertExpectations(t)
+	})
+}
+
+func TestMongoStoreAliasCycle(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/foo", AliasOf: "stable/foo"}
+	})
+	_, err := store.GetItem("stable/foo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,434 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// migrationsCollection has a document for each applied migration
+	migrationsCollection = "migrations"
+	// migrationLocksCollection has the lock held while running migrations
+	migrationLocksCollection = "migration_locks"
+	migrationLockID          = "migrations"
+)
+
+var (
+	// migrationLockTTL is how long the lock is held before it is considered
+	// abandoned by a replica that crashed while migrating
+	migrationLockTTL = 10 * time.Minute
+	// migrationLockRenewal is the interval at which the lock is renewed while
+	// migrating, well within the TTL
+	migrationLockRenewal = 3 * time.Minute
+	// migrationLockWait is how long to wait for another replica to finish
+	migrationLockWait = 5 * time.Minute
+	// migrationLockRetry is the interval between attempts to get the lock
+	migrationLockRetry = time.Second
+)
+
+// migration changes the shape of the stored documents. As a migration may be
+// interrupted before it is recorded, running Up or Down again must be safe.
+type migration struct {
+	Version     int
+	Description string
+	Up          func(db datastore.Database) error
+	// Down reverts Up, nil if there is nothing to revert
+	Down func(db datastore.Database) error
+}
+
+// migrations must be kept sorted by version, and released migrations must
+// never be changed
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "set the type of the items created before item types",
+		Up: func(db datastore.Database) error {
+			return updateAll(db.C(itemCollection),
+				bson.M{"type": bson.M{"$in": []interface{}{nil, ""}}},
+				bson.M{"$set": bson.M{"type": "chart"}})
+		},
+		// Items without a type are read as charts
+		Down: func(db datastore.Database) error {
+			return updateAll(db.C(itemCollection),
+				bson.M{"type": "chart"},
+				bson.M{"$unset": bson.M{"type": ""}})
+		},
+	},
+	{
+		Version:     2,
+		Description: "remove the stargazers_count and has_starred fields stored by old versions",
+		Up: func(db datastore.Database) error {
+			return updateAll(db.C(itemCollection),
+				bson.M{"$or": []bson.M{
+					{"stargazers_count": bson.M{"$exists": true}},
+					{"has_starred": bson.M{"$exists": true}},
+				}},
+				bson.M{"$unset": bson.M{"stargazers_count": "", "has_starred": ""}})
+		},
+	},
+	{
+		Version:     3,
+		Description: "key the items that aren't charts by type, so that IDs can be reused across types",
+		Up: func(db datastore.Database) error {
+			var items []item
+			if err := db.C(itemCollection).Find(bson.M{"type": bson.M{"$nin": []interface{}{"chart", "", nil}}}).All(&items); err != nil {
+				return err
+			}
+			for _, it := range items {
+				if key := itemKey(it.Type, it.ID); key != it.ID && !strings.HasPrefix(it.ID, it.Type+":") {
+					if err := rekeyItem(db, it, key); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(db datastore.Database) error {
+			var items []item
+			if err := db.C(itemCollection).Find(bson.M{"type": bson.M{"$nin": []interface{}{"chart", "", nil}}}).All(&items); err != nil {
+				return err
+			}
+			for _, it := range items {
+				if id := itemIDOf(&it); id != it.ID {
+					if err := rekeyItem(db, it, id); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// rekeyItem moves the item and the aliases pointing to it under a new ID.
+// The copy is inserted before the original is removed, so that running it
+// again after an interruption completes the move.
+func rekeyItem(db datastore.Database, it item, id string) error {
+	oldID := it.ID
+	it.ID = id
+	if err := db.C(itemCollection).Insert(it); err != nil {
+		if !mgo.IsDup(err) {
+			return fmt.Errorf("could not copy item %q: %v", oldID, err)
+		}
+		var existing item
+		if err := db.C(itemCollection).FindId(id).One(&existing); err != nil {
+			return fmt.Errorf("could not copy item %q: %v", oldID, err)
+		}
+		if existing.Type != it.Type {
+			return fmt.Errorf("could not copy item %q: %q is used by an item of type %q", oldID, id, existing.Type)
+		}
+	}
+	if err := updateAll(db.C(itemCollection), bson.M{"alias_of": oldID}, bson.M{"$set": bson.M{"alias_of": id}}); err != nil {
+		return err
+	}
+	if err := db.C(itemCollection).Remove(bson.M{"_id": oldID}); err != nil && err != mgo.ErrNotFound {
+		return fmt.Errorf("could not remove item %q: %v", oldID, err)
+	}
+	return nil
+}
+
+// migrationRecord is stored for each applied migration
+type migrationRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// migrationStatus is a known or recorded migration and when it was applied
+type migrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   *time.Time
+}
+
+// updateAller is implemented by the mgo collections behind datastore
+type updateAller interface {
+	UpdateAll(selector, update interface{}) (*mgo.ChangeInfo, error)
+}
+
+// updateAll updates every document matching the selector
+func updateAll(c datastore.Collection, selector, update interface{}) error {
+	u, ok := c.(updateAller)
+	if !ok {
+		return errors.New("collection does not support updating many documents")
+	}
+	_, err := u.UpdateAll(selector, update)
+	return err
+}
+
+// migrator applies and reverts migrations, holding a lock so that only one
+// replica runs them at a time
+type migrator struct {
+	session    datastore.Session
+	migrations []migration
+	// owner identifies the lock held by this process
+	owner string
+}
+
+func newMigrator(session datastore.Session) *migrator {
+	hostname, _ := os.Hostname()
+	return &migrator{
+		session:    session,
+		migrations: migrations,
+		owner:      fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), bson.NewObjectId().Hex()),
+	}
+}
+
+// lock waits until no other replica holds the migrations lock and takes it
+func (m *migrator) lock(db datastore.Database) error {
+	deadline := time.Now().Add(migrationLockWait)
+	for {
+		// Inserts the lock if missing and takes it over if expired, otherwise
+		// the insert fails with a duplicate key error
+		now := time.Now()
+		_, err := db.C(migrationLocksCollection).Upsert(
+			bson.M{"_id": migrationLockID, "expires_at": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": m.owner, "expires_at": now.Add(migrationLockTTL)}},
+		)
+		if err == nil {
+			return nil
+		}
+		if !mgo.IsDup(err) {
+			return fmt.Errorf("could not lock migrations: %v", err)
+		}
+		if !time.Now().Before(deadline) {
+			return errors.New("timed out waiting for another replica to finish running migrations")
+		}
+		log.Info("waiting for another replica to finish running migrations")
+		time.Sleep(migrationLockRetry)
+	}
+}
+
+// lockKeeper renews the migrations lock in the background, so that
+// migrations running longer than the TTL keep it
+type lockKeeper struct {
+	mu sync.Mutex
+	// When the lock expires unless renewed again
+	expires time.Time
+	err     error
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// keepLock starts renewing the lock just taken by lock
+func (m *migrator) keepLock(db datastore.Database) *lockKeeper {
+	k := &lockKeeper{expires: time.Now().Add(migrationLockTTL), stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(k.done)
+		ticker := time.NewTicker(migrationLockRenewal)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-k.stop:
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			err := m.renew(db, now)
+			k.mu.Lock()
+			switch {
+			case err == nil:
+				k.expires = now.Add(migrationLockTTL)
+			case err == mgo.ErrNotFound:
+				k.err = errors.New("another replica took over the migrations lock")
+			default:
+				// The lock is kept until it expires, check fails after that
+				log.WithError(err).Error("could not renew the migrations lock")
+			}
+			k.mu.Unlock()
+		}
+	}()
+	return k
+}
+
+// renew extends the lock if this process still holds it
+func (m *migrator) renew(db datastore.Database, now time.Time) error {
+	q, ok := db.C(migrationLocksCollection).Find(bson.M{"_id": migrationLockID, "owner": m.owner}).(applier)
+	if !ok {
+		return errors.New("datastore does not support atomic updates")
+	}
+	_, err := q.Apply(mgo.Change{Update: bson.M{"$set": bson.M{"expires_at": now.Add(migrationLockTTL)}}}, nil)
+	return err
+}
+
+// check returns an error once the lock may be held by another replica
+func (k *lockKeeper) check() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.err != nil {
+		return k.err
+	}
+	if !time.Now().Before(k.expires) {
+		return errors.New("the migrations lock expired")
+	}
+	return nil
+}
+
+// release stops renewing the lock
+func (k *lockKeeper) release() {
+	close(k.stop)
+	<-k.done
+}
+
+func (m *migrator) unlock(db datastore.Database) {
+	err := db.C(migrationLocksCollection).Remove(bson.M{"_id": migrationLockID, "owner": m.owner})
+	if err != nil && err != mgo.ErrNotFound {
+		log.WithError(err).Error("could not unlock migrations")
+	}
+}
+
+// applied returns the records of the applied migrations sorted by version
+func (m *migrator) applied(db datastore.Database) ([]migrationRecord, error) {
+	var records []migrationRecord
+	if err := db.C(migrationsCollection).Find(nil).Sort("_id").All(&records); err != nil {
+		return nil, fmt.Errorf("could not read applied migrations: %v", err)
+	}
+	return records, nil
+}
+
+// Up applies the pending migrations in order and returns them
+func (m *migrator) Up() ([]migration, error) {
+	db, closer := m.session.DB()
+	defer closer()
+
+	if err := m.lock(db); err != nil {
+		return nil, err
+	}
+	defer m.unlock(db)
+	k := m.keepLock(db)
+	defer k.release()
+
+	records, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+	done := map[int]bool{}
+	for _, r := range records {
+		done[r.Version] = true
+	}
+
+	var applied []migration
+	for _, mg := range m.migrations {
+		if done[mg.Version] {
+			continue
+		}
+		if err := k.check(); err != nil {
+			return applied, err
+		}
+		log.WithFields(log.Fields{"version": mg.Version, "description": mg.Description}).Info("applying migration")
+		if err := mg.Up(db); err != nil {
+			return applied, fmt.Errorf("migration %d failed: %v", mg.Version, err)
+		}
+		// Migrations can be run again, so one finished without the lock is
+		// left unrecorded
+		if err := k.check(); err != nil {
+			return applied, fmt.Errorf("migration %d: %v", mg.Version, err)
+		}
+		r := migrationRecord{Version: mg.Version, Description: mg.Description, AppliedAt: getTimestamp()}
+		if err := db.C(migrationsCollection).Insert(r); err != nil {
+			return applied, fmt.Errorf("could not record migration %d: %v", mg.Version, err)
+		}
+		applied = append(applied, mg)
+	}
+	return applied, nil
+}
+
+// Down reverts the last applied migration and returns it
+func (m *migrator) Down() (*migration, error) {
+	db, closer := m.session.DB()
+	defer closer()
+
+	if err := m.lock(db); err != nil {
+		return nil, err
+	}
+	defer m.unlock(db)
+	k := m.keepLock(db)
+	defer k.release()
+
+	records, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no migrations have been applied")
+	}
+	last := records[len(records)-1]
+
+	var mg *migration
+	for i := range m.migrations {
+		if m.migrations[i].Version == last.Version {
+			mg = &m.migrations[i]
+		}
+	}
+	if mg == nil {
+		return nil, fmt.Errorf("migration %d is unknown, it was applied by a newer version", last.Version)
+	}
+
+	log.WithFields(log.Fields{"version": mg.Version, "description": mg.Description}).Info("reverting migration")
+	if mg.Down != nil {
+		if err := mg.Down(db); err != nil {
+			return nil, fmt.Errorf("reverting migration %d failed: %v", mg.Version, err)
+		}
+	}
+	if err := k.check(); err != nil {
+		return nil, fmt.Errorf("reverting migration %d: %v", mg.Version, err)
+	}
+	if err := db.C(migrationsCollection).Remove(bson.M{"_id": mg.Version}); err != nil {
+		return nil, fmt.Errorf("could not remove the record of migration %d: %v", mg.Version, err)
+	}
+	return mg, nil
+}
+
+// Status returns every known migration and when it was applied, followed
+// by the applied migrations unknown to this version
+func (m *migrator) Status() ([]migrationStatus, error) {
+	db, closer := m.session.DB()
+	defer closer()
+
+	records, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+	appliedAt := map[int]*time.Time{}
+	for i := range records {
+		appliedAt[records[i].Version] = &records[i].AppliedAt
+	}
+
+	var status []migrationStatus
+	known := map[int]bool{}
+	for _, mg := range m.migrations {
+		known[mg.Version] = true
+		status = append(status, migrationStatus{Version: mg.Version, Description: mg.Description, AppliedAt: appliedAt[mg.Version]})
+	}
+	for i, r := range records {
+		if !known[r.Version] {
+			status = append(status, migrationStatus{Version: r.Version, Description: r.Description, AppliedAt: &records[i].AppliedAt})
+		}
+	}
+	return status, nil
+}
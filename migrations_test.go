@@ -0,0 +1,286 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// onAppliedMigrations makes the lookup of applied migrations return records
+func onAppliedMigrations(m *mock.Mock, records ...migrationRecord) {
+	var result []migrationRecord
+	m.On("All", &result).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]migrationRecord) = records
+	})
+}
+
+// newTestMigrator returns a migrator with a known lock owner
+func newTestMigrator(m *mock.Mock, migrations []migration) *migrator {
+	mg := newMigrator(testutil.NewMockSession(m))
+	mg.owner = "test"
+	if migrations != nil {
+		mg.migrations = migrations
+	}
+	return mg
+}
+
+var migrationLock = bson.M{"_id": migrationLockID, "owner": "test"}
+
+func TestMigrateUp(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	day := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	oldGetTimestamp := getTimestamp
+	getTimestamp = func() time.Time { return day }
+	defer func() { getTimestamp = oldGetTimestamp }()
+
+	m.On("Upsert", mock.Anything, mock.Anything).Return(nil).Once()
+	onAppliedMigrations(&m, migrationRecord{Version: 1, Description: migrations[0].Description, AppliedAt: day})
+	m.On("UpdateAll", bson.M{"$or": []bson.M{
+		{"stargazers_count": bson.M{"$exists": true}},
+		{"has_starred": bson.M{"$exists": true}},
+	}}, bson.M{"$unset": bson.M{"stargazers_count": "", "has_starred": ""}}).Return(nil)
+	m.On("Insert", migrationRecord{Version: 2, Description: migrations[1].Description, AppliedAt: day})
+	var items []item
+	m.On("All", &items)
+	m.On("Insert", migrationRecord{Version: 3, Description: migrations[2].Description, AppliedAt: day})
+	m.On("Remove", mock.Anything).Return(nil)
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"migrate", "up"}, &out))
+	assert.Equal(t, "applied migration 2: "+migrations[1].Description+"\n"+
+		"applied migration 3: "+migrations[2].Description+"\n", out.String())
+	m.AssertExpectations(t)
+}
+
+// onItems makes the lookup of items return the given ones
+func onItems(m *mock.Mock, items ...item) {
+	var result []item
+	m.On("All", &result).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]item) = items
+	})
+}
+
+func TestMigrateKeyItemsByType(t *testing.T) {
+	var m mock.Mock
+	db, closer := testutil.NewMockSession(&m).DB()
+	defer closer()
+	onItems(&m,
+		item{ID: "hello", Type: "function"},
+		item{ID: "function:default/hello", Type: "function"},
+	)
+	m.On("Insert", item{ID: "function:hello", Type: "function"}).Return(nil)
+	m.On("UpdateAll", bson.M{"alias_of": "hello"}, bson.M{"$set": bson.M{"alias_of": "function:hello"}}).Return(nil)
+	m.On("Remove", bson.M{"_id": "hello"}).Return(nil)
+
+	require.NoError(t, migrations[2].Up(db))
+	m.AssertExpectations(t)
+	m.AssertNumberOfCalls(t, "Insert", 1)
+}
+
+func TestMigrateUnkeyItemsConflict(t *testing.T) {
+	var m mock.Mock
+	db, closer := testutil.NewMockSession(&m).DB()
+	defer closer()
+	onItems(&m, item{ID: "function:stable/wordpress", Type: "function"})
+	m.On("Insert", item{ID: "stable/wordpress", Type: "function"}).Return(&mgo.LastError{Code: 11000})
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress", Type: "chart"}
+	})
+
+	err := migrations[2].Down(db)
+	assert.EqualError(t, err, `could not copy item "function:stable/wordpress": "stable/wordpress" is used by an item of type "chart"`)
+	m.AssertNotCalled(t, "Remove", mock.Anything)
+}
+
+func TestMigrateWaitsForLock(t *testing.T) {
+	oldRetry := migrationLockRetry
+	migrationLockRetry = 0
+	defer func() { migrationLockRetry = oldRetry }()
+
+	var m mock.Mock
+	ran := 0
+	mg := newTestMigrator(&m, []migration{
+		{Version: 1, Up: func(datastore.Database) error { ran++; return nil }},
+	})
+	// Another replica holds the lock the first time
+	m.On("Upsert", mock.Anything, mock.Anything).Return(&mgo.LastError{Code: 11000}).Once()
+	m.On("Upsert", mock.Anything, mock.Anything).Return(nil).Once()
+	onAppliedMigrations(&m)
+	m.On("Insert", mock.Anything)
+	m.On("Remove", migrationLock).Return(nil)
+
+	applied, err := mg.Up()
+	require.NoError(t, err)
+	assert.Len(t, applied, 1)
+	assert.Equal(t, 1, ran)
+	m.AssertExpectations(t)
+}
+
+func TestMigrateLockTimeout(t *testing.T) {
+	oldWait := migrationLockWait
+	migrationLockWait = 0
+	defer func() { migrationLockWait = oldWait }()
+
+	var m mock.Mock
+	ran := 0
+	mg := newTestMigrator(&m, []migration{
+		{Version: 1, Up: func(datastore.Database) error { ran++; return nil }},
+	})
+	m.On("Upsert", mock.Anything, mock.Anything).Return(&mgo.LastError{Code: 11000})
+
+	_, err := mg.Up()
+	assert.EqualError(t, err, "timed out waiting for another replica to finish running migrations")
+	assert.Equal(t, 0, ran)
+	m.AssertNotCalled(t, "Remove", mock.Anything)
+}
+
+// useLockTimings shortens the migrations lock TTL and renewal interval
+func useLockTimings(ttl, renewal time.Duration) func() {
+	oldTTL, oldRenewal := migrationLockTTL, migrationLockRenewal
+	migrationLockTTL, migrationLockRenewal = ttl, renewal
+	return func() { migrationLockTTL, migrationLockRenewal = oldTTL, oldRenewal }
+}
+
+func TestMigrateRenewsLock(t *testing.T) {
+	defer useLockTimings(50*time.Millisecond, 10*time.Millisecond)()
+
+	var m mock.Mock
+	mg := newTestMigrator(&m, []migration{
+		{Version: 1, Up: func(datastore.Database) error { time.Sleep(100 * time.Millisecond); return nil }},
+	})
+	m.On("Upsert", mock.Anything, mock.Anything).Return(nil)
+	onAppliedMigrations(&m)
+	m.On("Apply", mock.Anything, nil)
+	m.On("Insert", mock.Anything)
+	m.On("Remove", migrationLock).Return(nil)
+
+	applied, err := mg.Up()
+	require.NoError(t, err)
+	assert.Len(t, applied, 1)
+	m.AssertCalled(t, "Insert", mock.Anything)
+}
+
+func TestMigrateLosesLock(t *testing.T) {
+	tests := []struct {
+		name     string
+		renewErr error
+		error    string
+	}{
+		{"taken over", mgo.ErrNotFound, "migration 1: another replica took over the migrations lock"},
+		{"expired", errors.New("connection refused"), "migration 1: the migrations lock expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer useLockTimings(50*time.Millisecond, 10*time.Millisecond)()
+
+			var m mock.Mock
+			ran := 0
+			mg := newTestMigrator(&m, []migration{
+				{Version: 1, Up: func(datastore.Database) error { ran++; time.Sleep(100 * time.Millisecond); return nil }},
+				{Version: 2, Up: func(datastore.Database) error { ran++; return nil }},
+			})
+			m.On("Upsert", mock.Anything, mock.Anything).Return(nil)
+			onAppliedMigrations(&m)
+			m.On("Apply", mock.Anything, nil).Return(nil, tt.renewErr)
+			m.On("Remove", migrationLock).Return(nil)
+
+			applied, err := mg.Up()
+			assert.EqualError(t, err, tt.error)
+			assert.Empty(t, applied)
+			assert.Equal(t, 1, ran)
+			m.AssertNotCalled(t, "Insert", mock.Anything)
+		})
+	}
+}
+
+func TestMigrateUpFailure(t *testing.T) {
+	var m mock.Mock
+	mg := newTestMigrator(&m, []migration{
+		{Version: 1, Up: func(datastore.Database) error { return nil }},
+		{Version: 2, Up: func(datastore.Database) error { return errors.New("boom") }},
+		{Version: 3, Up: func(datastore.Database) error { return nil }},
+	})
+	m.On("Upsert", mock.Anything, mock.Anything).Return(nil)
+	onAppliedMigrations(&m)
+	m.On("Insert", mock.Anything).Once()
+	m.On("Remove", migrationLock).Return(nil)
+
+	applied, err := mg.Up()
+	assert.EqualError(t, err, "migration 2 failed: boom")
+	require.Len(t, applied, 1)
+	assert.Equal(t, 1, applied[0].Version)
+	m.AssertExpectations(t)
+}
+
+func TestMigrateDown(t *testing.T) {
+	var m mock.Mock
+	mg := newTestMigrator(&m, nil)
+	m.On("Upsert", mock.Anything, mock.Anything).Return(nil)
+	onAppliedMigrations(&m, migrationRecord{Version: 1})
+	m.On("UpdateAll", bson.M{"type": "chart"}, bson.M{"$unset": bson.M{"type": ""}}).Return(nil)
+	m.On("Remove", bson.M{"_id": 1}).Return(nil)
+	m.On("Remove", migrationLock).Return(nil)
+
+	reverted, err := mg.Down()
+	require.NoError(t, err)
+	assert.Equal(t, 1, reverted.Version)
+	m.AssertExpectations(t)
+}
+
+func TestMigrateDownUnknown(t *testing.T) {
+	var m mock.Mock
+	mg := newTestMigrator(&m, nil)
+	m.On("Upsert", mock.Anything, mock.Anything).Return(nil)
+	onAppliedMigrations(&m, migrationRecord{Version: 99})
+	m.On("Remove", migrationLock).Return(nil)
+
+	_, err := mg.Down()
+	assert.EqualError(t, err, "migration 99 is unknown, it was applied by a newer version")
+	m.AssertNotCalled(t, "Remove", bson.M{"_id": 99})
+}
+
+func TestMigrateStatus(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	day := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	onAppliedMigrations(&m, migrationRecord{Version: 1, AppliedAt: day}, migrationRecord{Version: 99, Description: "from the future", AppliedAt: day})
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"migrate", "status"}, &out))
+	assert.Equal(t, "1\tapplied 2017-11-01T00:00:00Z\t"+migrations[0].Description+"\n"+
+		"2\tpending\t"+migrations[1].Description+"\n"+
+		"3\tpending\t"+migrations[2].Description+"\n"+
+		"99\tapplied 2017-11-01T00:00:00Z\tfrom the future\n", out.String())
+}
+
+func TestMigrateRequiresMongo(t *testing.T) {
+	store = newMemoryStore()
+	err := runCommand([]string{"migrate", "up"}, &bytes.Buffer{})
+	assert.EqualError(t, err, "migrations are only used by the mongo storage, SQL schemas are migrated when opening the database")
+}
@@ -0,0 +1,488 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+)
+
+const (
+	itemCollection       = "items"
+	apiTokenCollection   = "api_tokens"
+	revocationCollection = "revocations"
+	sanctionCollection   = "sanctions"
+)
+
+// notAliasQuery matches the items that haven't been merged into another one
+var notAliasQuery = bson.M{"alias_of": bson.M{"$exists": false}}
+
+// chartQuery matches the charts that haven't been merged, including those
+// stored before item types
+var chartQuery = bson.M{"type": bson.M{"$in": []interface{}{"chart", "", nil}}, "alias_of": bson.M{"$exists": false}}
+
+// stargazersCountExpr is an aggregation expression counting the stars of an
+// item
+var stargazersCountExpr = bson.M{"$size": bson.M{"$ifNull": []interface{}{"$stargazers_ids", []interface{}{}}}}
+
+// commentsCountExpr returns an aggregation expression counting the comments
+// of an item, except those of the hidden authors
+func commentsCountExpr(hiddenAuthors []bson.ObjectId) bson.M {
+	comments := bson.M{"$ifNull": []interface{}{"$comments", []interface{}{}}}
+	if len(hiddenAuthors) == 0 {
+		return bson.M{"$size": comments}
+	}
+	return bson.M{"$size": bson.M{"$filter": bson.M{
+		"input": comments,
+		"as":    "comment",
+		"cond":  bson.M{"$not": []interface{}{bson.M{"$in": []interface{}{"$$comment.author._id", hiddenAuthors}}}},
+	}}}
+}
+
+// repoStatsFacets is the result of the repo stats aggregation
+type repoStatsFacets struct {
+	Totals        []repoStats `bson:"totals"`
+	MostStarred   []itemStats `bson:"most_starred"`
+	MostDiscussed []itemStats `bson:"most_discussed"`
+}
+
+// mongoStore stores each item as a document embedding its stars and comments
+type mongoStore struct {
+	session datastore.Session
+}
+
+func newMongoStore(session datastore.Session) *mongoStore {
+	return &mongoStore{session: session}
+}
+
+// repoQuery matches the charts of a repo that haven't been merged
+func repoQuery(repo string) bson.M {
+	query := bson.M{"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(repo) + "/"}}
+	for k, v := range chartQuery {
+		query[k] = v
+	}
+	return query
+}
+
+// findItem fetches an item by ID, following the aliases left by merged items
+func findItem(db datastore.Database, id string, it *item) error {
+	for i := 0; i < maxAliasHops; i++ {
+		*it = item{}
+		if err := db.C(itemCollection).FindId(id).One(it); err != nil {
+			if err == mgo.ErrNotFound {
+				return errNotFound
+			}
+			return err
+		}
+		if it.AliasOf == "" {
+			return nil
+		}
+		id = it.AliasOf
+	}
+	return fmt.Errorf("too many aliases resolving item %q", id)
+}
+
+func (s *mongoStore) GetItem(id string) (*item, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	var it item
+	if err := findItem(db, id, &it); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+func (s *mongoStore) ListItems(repo string) ([]*item, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	query := notAliasQuery
+	if repo != "" {
+		query = repoQuery(repo)
+	}
+	var items []*item
+	err := db.C(itemCollection).Find(query).All(&items)
+	return items, err
+}
+
+func (s *mongoStore) ListAliases() (map[string]string, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	var items []*item
+	if err := db.C(itemCollection).Find(bson.M{"alias_of": bson.M{"$exists": true}}).All(&items); err != nil {
+		return nil, err
+	}
+	aliases := map[string]string{}
+	for _, it := range items {
+		aliases[it.ID] = it.AliasOf
+	}
+	return aliases, nil
+}
+
+func (s *mongoStore) CreateItem(it item) error {
+	db, closer := s.session.DB()
+	defer closer()
+	return db.C(itemCollection).Insert(it)
+}
+
+// applier is implemented by the mgo queries behind datastore
+type applier interface {
+	Apply(change mgo.Change, result interface{}) (*mgo.ChangeInfo, error)
+}
+
+// upsertItem atomically applies the update to the item with the given ID,
+// following aliases, or to a new item of the given type if it doesn't exist.
+// It returns the item as it was before the update.
+func upsertItem(db datastore.Database, id, itemType string, update bson.M) (*item, error) {
+	update["$setOnInsert"] = bson.M{"type": itemType}
+	for i := 0; i < maxAliasHops; i++ {
+		// Aliases aren't matched, so upserting one fails with a duplicate key
+		q, ok := db.C(itemCollection).Find(bson.M{"_id": id, "alias_of": bson.M{"$exists": false}}).(applier)
+		if !ok {
+			return nil, errors.New("datastore does not support atomic updates")
+		}
+		var old item
+		info, err := q.Apply(mgo.Change{Update: update, Upsert: true}, &old)
+		if mgo.IsDup(err) {
+			var alias item
+			if err := db.C(itemCollection).FindId(id).One(&alias); err != nil {
+				return nil, err
+			}
+			if alias.AliasOf != "" {
+				id = alias.AliasOf
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info != nil && info.UpsertedId != nil {
+			return &item{ID: id, Type: itemType}, nil
+		}
+		return &old, nil
+	}
+	return nil, fmt.Errorf("too many aliases resolving item %q", id)
+}
+
+func (s *mongoStore) AddStar(itemID, itemType string, userID bson.ObjectId, version string) (*item, bool, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	update := bson.M{"$addToSet": bson.M{"stargazers_ids": userID}}
+	if version != "" {
+		update["$set"] = bson.M{"stargazer_versions." + userID.Hex(): version}
+	}
+	it, err := upsertItem(db, itemID, itemType, update)
+	if err != nil {
+		return nil, false, err
+	}
+	// The item is updated the same way the database did
+	changed := !hasStarred(it, &User{ID: userID})
+	addStargazer(it, userID, version)
+	return it, changed, nil
+}
+
+func (s *mongoStore) RemoveStar(itemID, itemType string, userID bson.ObjectId) (*item, bool, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	update := bson.M{
+		"$pull":  bson.M{"stargazers_ids": userID},
+		"$unset": bson.M{"stargazer_versions." + userID.Hex(): ""},
+	}
+	it, err := upsertItem(db, itemID, itemType, update)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := hasStarred(it, &User{ID: userID})
+	removeStargazer(it, userID)
+	return it, changed, nil
+}
+
+func (s *mongoStore) AddComment(itemID, itemType string, cm comment) error {
+	db, closer := s.session.DB()
+	defer closer()
+	_, err := upsertItem(db, itemID, itemType, bson.M{"$push": bson.M{"comments": cm}})
+	return err
+}
+
+func (s *mongoStore) UpdateComment(itemID string, commentID bson.ObjectId, text string, updatedAt time.Time) error {
+	db, closer := s.session.DB()
+	defer closer()
+
+	// The comment is matched in the same update, so that concurrent edits
+	// and deletions can't shift it
+	q, ok := db.C(itemCollection).Find(bson.M{"_id": itemID, "comments._id": commentID}).(applier)
+	if !ok {
+		return errors.New("datastore does not support atomic updates")
+	}
+	update := bson.M{"$set": bson.M{"comments.$.text": text, "comments.$.updated_at": updatedAt}}
+	if _, err := q.Apply(mgo.Change{Update: update}, nil); err != nil {
+		if err == mgo.ErrNotFound {
+			return errNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *mongoStore) DeleteComment(itemID string, commentID bson.ObjectId) error {
+	db, closer := s.session.DB()
+	defer closer()
+	return db.C(itemCollection).UpdateId(itemID, bson.M{"$pull": bson.M{"comments": bson.M{"_id": commentID}}})
+}
+
+func (s *mongoStore) ListRepos(hiddenAuthors []bson.ObjectId) ([]repoStats, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	pipeline := []bson.M{
+		{"$match": chartQuery},
+		{"$project": bson.M{
+			// Chart IDs are in the form repo/chartName
+			"repo":             bson.M{"$arrayElemAt": []interface{}{bson.M{"$split": []interface{}{"$_id", "/"}}, 0}},
+			"stargazers_count": stargazersCountExpr,
+			"comments_count":   commentsCountExpr(hiddenAuthors),
+		}},
+		{"$group": bson.M{
+			"_id":              "$repo",
+			"items_count":      bson.M{"$sum": 1},
+			"stargazers_count": bson.M{"$sum": "$stargazers_count"},
+			"comments_count":   bson.M{"$sum": "$comments_count"},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+
+	repos := []repoStats{}
+	err := db.C(itemCollection).Pipe(pipeline).All(&repos)
+	return repos, err
+}
+
+func (s *mongoStore) GetRepoStats(repo string, limit int, hiddenAuthors []bson.ObjectId) (*repoStats, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	pipeline := []bson.M{
+		{"$match": repoQuery(repo)},
+		{"$project": bson.M{"stargazers_count": stargazersCountExpr, "comments_count": commentsCountExpr(hiddenAuthors)}},
+		{"$facet": bson.M{
+			"totals": []bson.M{{"$group": bson.M{
+				"_id":              nil,
+				"items_count":      bson.M{"$sum": 1},
+				"stargazers_count": bson.M{"$sum": "$stargazers_count"},
+				"comments_count":   bson.M{"$sum": "$comments_count"},
+			}}},
+			"most_starred": []bson.M{
+				{"$match": bson.M{"stargazers_count": bson.M{"$gt": 0}}},
+				{"$sort": bson.D{{Name: "stargazers_count", Value: -1}, {Name: "_id", Value: 1}}},
+				{"$limit": limit},
+			},
+			"most_discussed": []bson.M{
+				{"$match": bson.M{"comments_count": bson.M{"$gt": 0}}},
+				{"$sort": bson.D{{Name: "comments_count", Value: -1}, {Name: "_id", Value: 1}}},
+				{"$limit": limit},
+			},
+		}},
+	}
+
+	var result repoStatsFacets
+	if err := db.C(itemCollection).Pipe(pipeline).One(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Totals) == 0 {
+		return nil, errNotFound
+	}
+
+	stats := result.Totals[0]
+	stats.Name = repo
+	stats.MostStarred = result.MostStarred
+	stats.MostDiscussed = result.MostDiscussed
+	return &stats, nil
+}
+
+func (s *mongoStore) MergeItems(fromID, toID string) (*item, error) {
+	db, closer := s.session.DB()
+	defer closer()
+
+	if fromID == toID {
+		return nil, errMergeIntoItself
+	}
+
+	var from item
+	if err := db.C(itemCollection).FindId(fromID).One(&from); err != nil {
+		return nil, fmt.Errorf("could not find item %q: %v", fromID, err)
+	}
+
+	var to item
+	if err := findItem(db, toID, &to); err != nil {
+		to = item{ID: toID, Type: from.Type}
+	}
+	merged := to
+	if err := mergeInto(&from, &merged); err != nil {
+		return nil, err
+	}
+
+	// The stars and comments of the source are added to the target in a
+	// single update, so that concurrent writes to the target are kept.
+	// Comments already in the target are skipped, so that a merge
+	// interrupted before the alias is set can be run again.
+	stargazers := map[bson.ObjectId]bool{}
+	for _, id := range to.StargazersIDs {
+		stargazers[id] = true
+	}
+	versions := bson.M{}
+	for _, id := range from.StargazersIDs {
+		if version, ok := from.StargazerVersions[id.Hex()]; ok && !stargazers[id] {
+			versions["stargazer_versions."+id.Hex()] = version
+		}
+	}
+	commented := map[bson.ObjectId]bool{}
+	for _, cm := range to.Comments {
+		commented[cm.ID] = true
+	}
+	comments := []comment{}
+	for _, cm := range from.Comments {
+		if !commented[cm.ID] {
+			comments = append(comments, cm)
+		}
+	}
+	update := bson.M{
+		"$addToSet": bson.M{"stargazers_ids": bson.M{"$each": append([]bson.ObjectId{}, from.StargazersIDs...)}},
+		"$push":     bson.M{"comments": bson.M{"$each": comments, "$sort": bson.M{"created_at": 1}}},
+	}
+	if len(versions) > 0 {
+		update["$set"] = versions
+	}
+	if _, err := upsertItem(db, to.ID, merged.Type, update); err != nil {
+		return nil, fmt.Errorf("could not update item %q: %v", to.ID, err)
+	}
+
+	alias := bson.M{"$set": bson.M{"alias_of": to.ID}, "$unset": bson.M{"stargazers_ids": "", "stargazer_versions": "", "comments": ""}}
+	if err := db.C(itemCollection).UpdateId(fromID, alias); err != nil {
+		return nil, fmt.Errorf("could not turn %q into an alias: %v", fromID, err)
+	}
+	return &merged, nil
+}
+
+func (s *mongoStore) CreateAPIToken(t apiToken) error {
+	db, closer := s.session.DB()
+	defer closer()
+	return db.C(apiTokenCollection).Insert(t)
+}
+
+func (s *mongoStore) ListAPITokens(userID bson.ObjectId) ([]*apiToken, error) {
+	db, closer := s.session.DB()
+	defer closer()
+	var tokens []*apiToken
+	query := bson.M{}
+	if userID != "" {
+		query["user._id"] = userID
+	}
+	err := db.C(apiTokenCollection).Find(query).Sort("created_at", "_id").All(&tokens)
+	return tokens, err
+}
+
+func (s *mongoStore) FindAPIToken(hash string) (*apiToken, error) {
+	db, closer := s.session.DB()
+	defer closer()
+	var t apiToken
+	if err := db.C(apiTokenCollection).Find(bson.M{"hash": hash}).One(&t); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *mongoStore) DeleteAPIToken(userID, id bson.ObjectId) error {
+	db, closer := s.session.DB()
+	defer closer()
+	err := db.C(apiTokenCollection).Remove(bson.M{"_id": id, "user._id": userID})
+	if err == mgo.ErrNotFound {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *mongoStore) TouchAPIToken(id bson.ObjectId, usedAt time.Time) error {
+	db, closer := s.session.DB()
+	defer closer()
+	err := db.C(apiTokenCollection).UpdateId(id, bson.M{"$set": bson.M{"last_used_at": usedAt}})
+	if err == mgo.ErrNotFound {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *mongoStore) CreateRevocation(r revocation) error {
+	db, closer := s.session.DB()
+	defer closer()
+	return db.C(revocationCollection).Insert(r)
+}
+
+func (s *mongoStore) ListRevocations(now time.Time) ([]*revocation, error) {
+	db, closer := s.session.DB()
+	defer closer()
+	var list []*revocation
+	query := bson.M{"$or": []bson.M{{"expires_at": bson.M{"$exists": false}}, {"expires_at": bson.M{"$gt": now}}}}
+	err := db.C(revocationCollection).Find(query).Sort("created_at", "_id").All(&list)
+	return list, err
+}
+
+func (s *mongoStore) DeleteRevocation(id bson.ObjectId) error {
+	db, closer := s.session.DB()
+	defer closer()
+	err := db.C(revocationCollection).Remove(bson.M{"_id": id})
+	if err == mgo.ErrNotFound {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *mongoStore) CreateSanction(sn sanction) error {
+	db, closer := s.session.DB()
+	defer closer()
+	return db.C(sanctionCollection).Insert(sn)
+}
+
+func (s *mongoStore) ListSanctions(now time.Time) ([]*sanction, error) {
+	db, closer := s.session.DB()
+	defer closer()
+	var list []*sanction
+	query := bson.M{"$or": []bson.M{{"expires_at": bson.M{"$exists": false}}, {"expires_at": bson.M{"$gt": now}}}}
+	err := db.C(sanctionCollection).Find(query).Sort("created_at", "_id").All(&list)
+	return list, err
+}
+
+func (s *mongoStore) DeleteSanction(id bson.ObjectId) error {
+	db, closer := s.session.DB()
+	defer closer()
+	err := db.C(sanctionCollection).Remove(bson.M{"_id": id})
+	if err == mgo.ErrNotFound {
+		return errNotFound
+	}
+	return err
+}
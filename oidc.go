@@ -0,0 +1,469 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// oidcStateCookieName holds the state of a login until the provider redirects
+// back to the callback
+const oidcStateCookieName = "ka_oidc_state"
+
+// oidcStateTTL is how long users have to log in with the provider
+const oidcStateTTL = 10 * time.Minute
+
+// oidcConfig configures the OpenID Connect login
+type oidcConfig struct {
+	// Issuer URL of the provider, its configuration is discovered from
+	// Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// URL of /auth/callback as seen by browsers
+	RedirectURL string
+	Scopes      []string
+	// Key signing the session tokens, JWT_KEY
+	SessionKey []byte
+	// How long sessions last
+	SessionTTL time.Duration
+	// iss and aud of the session tokens, if the verifier requires them
+	SessionIssuer   string
+	SessionAudience string
+	// Leeway when checking the times of ID tokens
+	Leeway time.Duration
+	// ID token claim mapped to the roles of users, if any. Roles are only
+	// assigned by the roles file otherwise.
+	RolesClaim string
+}
+
+// oidcLogin logs users in with an OpenID Connect provider using the
+// authorization code flow, issuing the same session cookie getCurrentUser
+// reads
+type oidcLogin struct {
+	config        oidcConfig
+	authURL       string
+	tokenURL      string
+	endSessionURL string
+	idTokens      *tokenVerifier
+	client        *http.Client
+}
+
+// loginProvider handles /auth routes, they are disabled if nil
+var loginProvider *oidcLogin
+
+// oidcDiscovery is the subset of the provider metadata we need
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// newOIDCLogin discovers the provider configuration and loads its keys
+func newOIDCLogin(config oidcConfig) (*oidcLogin, error) {
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("the OpenID Connect client ID and redirect URL are required")
+	}
+	if len(config.SessionKey) == 0 {
+		return nil, errors.New("JWT_KEY must be set to sign the sessions of OpenID Connect logins")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	discoveryURL := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	res, err := client.Get(discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", res.StatusCode, discoveryURL)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", discoveryURL, err)
+	}
+	if d.Issuer != config.Issuer {
+		return nil, fmt.Errorf("provider issuer %q does not match %q", d.Issuer, config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("%s lacks the authorization, token or JWKS endpoint", discoveryURL)
+	}
+
+	keys := newKeySet(&httpJWKSSource{url: d.JWKSURI, client: client})
+	if err := keys.Refresh(); err != nil {
+		return nil, err
+	}
+	idTokens, err := newTokenVerifier("", keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	idTokens.policy = claimsPolicy{
+		Issuers:   []string{config.Issuer},
+		Audiences: []string{config.ClientID},
+		Leeway:    config.Leeway,
+		Required:  []string{"sub", "exp", "iat"},
+	}
+	if config.SessionTTL == 0 {
+		config.SessionTTL = 24 * time.Hour
+	}
+	return &oidcLogin{
+		config:        config,
+		authURL:       d.AuthorizationEndpoint,
+		tokenURL:      d.TokenEndpoint,
+		endSessionURL: d.EndSessionEndpoint,
+		idTokens:      idTokens,
+		client:        client,
+	}, nil
+}
+
+// loginState is kept in a signed cookie during the login
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	registeredClaims
+}
+
+// idTokenClaims are the ID token claims mapped to the User
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	registeredClaims
+	// Every claim of the token, to read the one configured as RolesClaim
+	all map[string]json.RawMessage
+}
+
+// UnmarshalJSON decodes the claims, keeping them all
+func (c *idTokenClaims) UnmarshalJSON(data []byte) error {
+	type plain idTokenClaims
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.all)
+}
+
+// randomString returns a random URL-safe string
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localRedirect returns the path to redirect to after logging in or out,
+// only accepting paths of this site to avoid open redirects
+func localRedirect(req *http.Request) string {
+	redirect := req.URL.Query().Get("redirect")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+func (l *oidcLogin) secureCookies() bool {
+	return strings.HasPrefix(l.config.RedirectURL, "https://")
+}
+
+// Login redirects to the provider, remembering the state of the login
+func (l *oidcLogin) Login(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	state := loginState{
+		State:            randomString(),
+		Nonce:            randomString(),
+		Verifier:         randomString(),
+		Redirect:         localRedirect(req),
+		registeredClaims: registeredClaims{ExpiresAt: now.Add(oidcStateTTL).Unix()},
+	}
+	cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, state).SignedString(l.config.SessionKey)
+	if err != nil {
+		log.WithError(err).Error("could not sign login state")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    cookie,
+		Path:     "/auth",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   l.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {l.config.ClientID},
+		"redirect_uri":          {l.config.RedirectURL},
+		"scope":                 {strings.Join(l.config.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, req, addQuery(l.authURL, params), http.StatusFound)
+}
+
+// Callback exchanges the authorization code for an ID token and starts the
+// session of its user
+func (l *oidcLogin) Callback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.WithFields(log.Fields{"error": e, "description": query.Get("error_description")}).Info("login failed")
+		response.NewErrorResponse(http.StatusUnauthorized, "login failed: "+e).Write(w)
+		return
+	}
+
+	// Only the browser that started the login may complete it
+	cookie, err := req.Cookie(oidcStateCookieName)
+	if err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, "no login in progress").Write(w)
+		return
+	}
+	var state loginState
+	sessions := &tokenVerifier{algorithms: []string{"HS256"}, hmacKey: l.config.SessionKey}
+	if err := sessions.verify(cookie.Value, &state); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, "invalid or expired login state").Write(w)
+		return
+	}
+	if query.Get("state") == "" || query.Get("state") != state.State {
+		response.NewErrorResponse(http.StatusBadRequest, "login state mismatch").Write(w)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/auth", MaxAge: -1})
+
+	rawIDToken, err := l.exchange(query.Get("code"), state.Verifier)
+	if err != nil {
+		log.WithError(err).Error("could not exchange authorization code")
+		response.NewErrorResponse(http.StatusBadGateway, "could not complete login with the provider").Write(w)
+		return
+	}
+	var claims idTokenClaims
+	if err := l.idTokens.verify(rawIDToken, &claims); err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+	if claims.Nonce != state.Nonce {
+		writeUnauthorized(w, &authError{reason: "ID token nonce mismatch"})
+		return
+	}
+
+	session, err := l.session(claims)
+	if err != nil {
+		log.WithError(err).Error("could not sign session token")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(l.config.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   l.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, state.Redirect, http.StatusFound)
+}
+
+// exchange redeems the authorization code at the token endpoint and returns
+// the ID token
+func (l *oidcLogin) exchange(code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {l.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", l.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(l.config.ClientID), url.QueryEscape(l.config.ClientSecret))
+	res, err := l.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("unexpected token response with status %d: %v", res.StatusCode, err)
+	}
+	if tokens.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %s: %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned status %d without an ID token", res.StatusCode)
+	}
+	return tokens.IDToken, nil
+}
+
+// userFromIDToken maps the ID token claims to a User. User IDs are derived
+// from the issuer and subject, so that they are stable across logins.
+func userFromIDToken(claims idTokenClaims) *User {
+	sum := sha256.Sum256([]byte(claims.Issuer + "\n" + claims.Subject))
+	name := claims.Name
+	if name == "" {
+		name = claims.PreferredUsername
+	}
+	if name == "" {
+		name = claims.Email
+	}
+	if name == "" {
+		name = claims.Subject
+	}
+	return &User{ID: bson.ObjectId(sum[:12]), Name: name, Email: claims.Email}
+}
+
+// roles returns the roles in the configured claim of the ID token, which
+// holds a role or a list of them
+func (l *oidcLogin) roles(claims idTokenClaims) []string {
+	raw, ok := claims.all[l.config.RolesClaim]
+	if l.config.RolesClaim == "" || !ok {
+		return nil
+	}
+	var roles []string
+	if err := json.Unmarshal(raw, &roles); err == nil {
+		return roles
+	}
+	var r string
+	if err := json.Unmarshal(raw, &r); err == nil {
+		return []string{r}
+	}
+	log.WithFields(log.Fields{"claim": l.config.RolesClaim}).Warn("ignoring roles claim that is neither a string nor a list of strings")
+	return nil
+}
+
+// session returns the session token of the ID token user
+func (l *oidcLogin) session(idClaims idTokenClaims) (string, error) {
+	user := userFromIDToken(idClaims)
+	now := time.Now()
+	claims := userClaims{
+		User:  user,
+		Email: user.Email,
+		Roles: l.roles(idClaims),
+		registeredClaims: registeredClaims{
+			Issuer:    l.config.SessionIssuer,
+			Subject:   user.ID.Hex(),
+			ExpiresAt: now.Add(l.config.SessionTTL).Unix(),
+			IssuedAt:  now.Unix(),
+			TokenID:   randomString(),
+		},
+	}
+	if l.config.SessionAudience != "" {
+		claims.Audience = audience{l.config.SessionAudience}
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(l.config.SessionKey)
+}
+
+// Logout ends the session, and the provider session if it supports
+// RP-initiated logout
+func (l *oidcLogin) Logout(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(authCookieName); err == nil && cookie.Value != "" {
+		revokeSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   l.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	redirect := localRedirect(req)
+	if l.endSessionURL == "" {
+		http.Redirect(w, req, redirect, http.StatusFound)
+		return
+	}
+	postLogout, err := url.Parse(l.config.RedirectURL)
+	if err != nil {
+		http.Redirect(w, req, redirect, http.StatusFound)
+		return
+	}
+	postLogout.Path, postLogout.RawQuery = redirect, ""
+	if i := strings.Index(redirect, "?"); i >= 0 {
+		postLogout.Path, postLogout.RawQuery = redirect[:i], redirect[i+1:]
+	}
+	params := url.Values{
+		"client_id":                {l.config.ClientID},
+		"post_logout_redirect_uri": {postLogout.String()},
+	}
+	http.Redirect(w, req, addQuery(l.endSessionURL, params), http.StatusFound)
+}
+
+// revokeSession revokes the session token, so that copies of the cookie stop
+// working too. Invalid tokens are ignored, they don't authenticate anyway.
+func revokeSession(token string) {
+	claims, err := jwtVerifier.parse(token)
+	if err != nil || claims.TokenID == "" {
+		return
+	}
+	r := revocation{
+		ID:        getNewObjectID(),
+		TokenID:   claims.TokenID,
+		Reason:    "logged out",
+		RevokedBy: claims.User.ID,
+		CreatedAt: getTimestamp(),
+	}
+	if claims.ExpiresAt != 0 {
+		expiresAt := time.Unix(claims.ExpiresAt, 0)
+		r.ExpiresAt = &expiresAt
+	}
+	if err := store.CreateRevocation(r); err != nil {
+		log.WithError(err).Error("could not revoke session")
+		return
+	}
+	revocationCache.invalidate()
+}
+
+// addQuery appends the parameters to the query of the URL
+func addQuery(u string, params url.Values) string {
+	if strings.Contains(u, "?") {
+		return u + "&" + params.Encode()
+	}
+	return u + "?" + params.Encode()
+}
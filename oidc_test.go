@@ -0,0 +1,406 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is an OpenID Connect provider issuing ID tokens for the codes
+// it is given with authorize
+type fakeProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu    sync.Mutex
+	codes map[string]fakeGrant
+	// change alters the claims of the next ID tokens
+	change func(c *idTokenClaims)
+	// extra claims of the next ID tokens
+	extra map[string]interface{}
+}
+
+// fakeGrant is an authorization code granted to the client
+type fakeGrant struct {
+	challenge string
+	nonce     string
+	claims    idTokenClaims
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	p := &fakeProvider{t: t, codes: map[string]fakeGrant{}}
+	rsaKey, _ := testKeys(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/keys",
+			EndSessionEndpoint:    p.server.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{jwkOf("provider-1", &rsaKey.PublicKey)}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "ratesvc" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		p.mu.Lock()
+		grant, ok := p.codes[req.PostFormValue("code")]
+		delete(p.codes, req.PostFormValue("code"))
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := grant.claims
+		claims.Issuer = p.server.URL
+		claims.Audience = audience{"ratesvc"}
+		claims.Nonce = grant.nonce
+		claims.IssuedAt = time.Now().Unix()
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		if p.change != nil {
+			p.change(&claims)
+		}
+		signed := jwt.Claims(claims)
+		if p.extra != nil {
+			all := jwt.MapClaims{}
+			data, _ := json.Marshal(claims)
+			json.Unmarshal(data, &all)
+			for k, v := range p.extra {
+				all[k] = v
+			}
+			signed = all
+		}
+		idToken := signToken(p.t, jwt.SigningMethodRS256, rsaKey, "provider-1", signed)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+// authorize logs the user in at the authorization URL ratesvc redirected to,
+// returning the callback URL the provider redirects back to
+func (p *fakeProvider) authorize(authURL string, claims idTokenClaims) string {
+	u, err := url.Parse(authURL)
+	require.NoError(p.t, err)
+	q := u.Query()
+	require.Equal(p.t, "S256", q.Get("code_challenge_method"))
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = fakeGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	p.mu.Unlock()
+	return q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+}
+
+func testOIDCLogin(t *testing.T, p *fakeProvider) *oidcLogin {
+	l, err := newOIDCLogin(oidcConfig{
+		Issuer:       p.server.URL,
+		ClientID:     "ratesvc",
+		ClientSecret: "s3cr3t",
+		RedirectURL:  "https://hub.example.com/auth/callback",
+		Scopes:       []string{"openid", "profile", "email"},
+		SessionKey:   []byte("secret"),
+		SessionTTL:   time.Hour,
+	})
+	require.NoError(t, err)
+	return l
+}
+
+// cookieNamed returns the cookie set by the response
+func cookieNamed(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// login runs the login flow until the provider redirects back, returning the
+// callback request
+func login(t *testing.T, p *fakeProvider, r http.Handler, claims idTokenClaims) *http.Request {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?redirect=/charts/stable/wordpress", nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	location := w.Header().Get("Location")
+	assert.Contains(t, location, p.server.URL+"/authorize?")
+	state := cookieNamed(w, oidcStateCookieName)
+	require.NotNil(t, state)
+	assert.True(t, state.HttpOnly)
+	assert.True(t, state.Secure)
+
+	req := httptest.NewRequest("GET", p.authorize(location, claims), nil)
+	req.AddCookie(state)
+	return req
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newFakeProvider(t)
+	defer p.server.Close()
+	oldProvider, oldVerifier := loginProvider, jwtVerifier
+	loginProvider = testOIDCLogin(t, p)
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret"), policy: claimsPolicy{Required: []string{"exp"}}}
+	defer func() { loginProvider, jwtVerifier = oldProvider, oldVerifier }()
+	r := newRouter()
+
+	claims := idTokenClaims{Name: "Rick Sanchez", Email: "rick@sanchez.com", registeredClaims: registeredClaims{Subject: "rick"}}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, login(t, p, r, claims))
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	assert.Equal(t, "/charts/stable/wordpress", w.Header().Get("Location"))
+	session := cookieNamed(w, authCookieName)
+	require.NotNil(t, session)
+	assert.True(t, session.HttpOnly)
+	assert.Equal(t, 3600, session.MaxAge)
+
+	// The session cookie authenticates requests like externally minted ones
+	req := httptest.NewRequest("GET", "/v1/stars", nil)
+	req.AddCookie(session)
+	user, err := getCurrentUser(req)
+	require.NoError(t, err)
+	assert.Equal(t, "Rick Sanchez", user.Name)
+	assert.Equal(t, "rick@sanchez.com", user.Email)
+	assert.Equal(t, roleUser, roleOf(user))
+
+	// Users keep their ID across logins
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, login(t, p, r, claims))
+	req = httptest.NewRequest("GET", "/v1/stars", nil)
+	req.AddCookie(cookieNamed(w, authCookieName))
+	again, err := getCurrentUser(req)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, again.ID)
+}
+
+func TestOIDCRolesClaim(t *testing.T) {
+	p := newFakeProvider(t)
+	defer p.server.Close()
+	oldProvider, oldVerifier := loginProvider, jwtVerifier
+	loginProvider = testOIDCLogin(t, p)
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	defer func() { loginProvider, jwtVerifier = oldProvider, oldVerifier }()
+	r := newRouter()
+	claims := idTokenClaims{Name: "Rick Sanchez", registeredClaims: registeredClaims{Subject: "rick"}}
+
+	tests := []struct {
+		name       string
+		rolesClaim string
+		extra      map[string]interface{}
+		want       role
+	}{
+		{"roles claim not trusted by default", "", map[string]interface{}{"roles": []string{"admin"}}, roleUser},
+		{"other claim than the configured one", "groups", map[string]interface{}{"roles": []string{"admin"}}, roleUser},
+		{"list of roles", "groups", map[string]interface{}{"groups": []string{"developers", "moderator"}}, roleModerator},
+		{"single role", "groups", map[string]interface{}{"groups": "admin"}, roleAdmin},
+		{"invalid claim", "groups", map[string]interface{}{"groups": 42}, roleUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loginProvider.config.RolesClaim = tt.rolesClaim
+			p.extra = tt.extra
+			defer func() { p.extra = nil }()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, login(t, p, r, claims))
+			require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+			req := httptest.NewRequest("GET", "/v1/stars", nil)
+			req.AddCookie(cookieNamed(w, authCookieName))
+			user, err := getCurrentUser(req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, roleOf(user))
+		})
+	}
+}
+
+func TestOIDCCallbackErrors(t *testing.T) {
+	p := newFakeProvider(t)
+	defer p.server.Close()
+	oldProvider := loginProvider
+	loginProvider = testOIDCLogin(t, p)
+	defer func() { loginProvider = oldProvider }()
+	r := newRouter()
+	claims := idTokenClaims{Name: "Rick Sanchez", registeredClaims: registeredClaims{Subject: "rick"}}
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		change  func(c *idTokenClaims)
+		code    int
+		message string
+	}{
+		{"no state cookie", func() *http.Request {
+			req := login(t, p, r, claims)
+			return httptest.NewRequest("GET", req.URL.String(), nil)
+		}, nil, http.StatusBadRequest, "no login in progress"},
+		{"state mismatch", func() *http.Request {
+			req := login(t, p, r, claims)
+			q := req.URL.Query()
+			q.Set("state", "forged")
+			req.URL.RawQuery = q.Encode()
+			return req
+		}, nil, http.StatusBadRequest, "login state mismatch"},
+		{"provider error", func() *http.Request {
+			return httptest.NewRequest("GET", "/auth/callback?error=access_denied", nil)
+		}, nil, http.StatusUnauthorized, "login failed: access_denied"},
+		{"unknown code", func() *http.Request {
+			req := login(t, p, r, claims)
+			q := req.URL.Query()
+			q.Set("code", "guessed")
+			req.URL.RawQuery = q.Encode()
+			return req
+		}, nil, http.StatusBadGateway, "could not complete login with the provider"},
+		{"nonce mismatch", func() *http.Request { return login(t, p, r, claims) },
+			func(c *idTokenClaims) { c.Nonce = "replayed" }, http.StatusUnauthorized, "ID token nonce mismatch"},
+		{"other audience", func() *http.Request { return login(t, p, r, claims) },
+			func(c *idTokenClaims) { c.Audience = audience{"other-client"} }, http.StatusUnauthorized, "token audience is not accepted"},
+		{"expired", func() *http.Request { return login(t, p, r, claims) },
+			func(c *idTokenClaims) { c.ExpiresAt = time.Now().Add(-time.Hour).Unix() }, http.StatusUnauthorized, "token has expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.change = tt.change
+			defer func() { p.change = nil }()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, tt.request())
+			assert.Equal(t, tt.code, w.Code)
+			assert.Contains(t, w.Body.String(), tt.message)
+			assert.Nil(t, cookieNamed(w, authCookieName))
+		})
+	}
+}
+
+func TestOIDCLoginRedirects(t *testing.T) {
+	tests := []struct {
+		redirect string
+		want     string
+	}{
+		{"/charts/stable/wordpress?tab=comments", "/charts/stable/wordpress?tab=comments"},
+		{"", "/"},
+		{"https://evil.example.com", "/"},
+		{"//evil.example.com", "/"},
+		{"/\\evil.example.com", "/"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/auth/login?"+url.Values{"redirect": {tt.redirect}}.Encode(), nil)
+		assert.Equal(t, tt.want, localRedirect(req), tt.redirect)
+	}
+}
+
+func TestOIDCLogout(t *testing.T) {
+	p := newFakeProvider(t)
+	defer p.server.Close()
+	oldProvider := loginProvider
+	loginProvider = testOIDCLogin(t, p)
+	defer func() { loginProvider = oldProvider }()
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("POST", "/auth/logout?redirect=/charts", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, p.server.URL+"/logout?client_id=ratesvc&post_logout_redirect_uri=https%3A%2F%2Fhub.example.com%2Fcharts",
+		w.Header().Get("Location"))
+	session := cookieNamed(w, authCookieName)
+	require.NotNil(t, session)
+	assert.Equal(t, -1, session.MaxAge)
+}
+
+func TestOIDCLogoutRevokesSession(t *testing.T) {
+	p := newFakeProvider(t)
+	defer p.server.Close()
+	store = newMemoryStore()
+	oldProvider, oldVerifier, oldCache := loginProvider, jwtVerifier, revocationCache
+	loginProvider = testOIDCLogin(t, p)
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	revocationCache = &revocationList{}
+	defer func() { loginProvider, jwtVerifier, revocationCache = oldProvider, oldVerifier, oldCache }()
+	r := newRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, login(t, p, r, idTokenClaims{Name: "Rick Sanchez", registeredClaims: registeredClaims{Subject: "rick"}}))
+	session := cookieNamed(w, authCookieName)
+	require.NotNil(t, session)
+	req := httptest.NewRequest("GET", "/v1/stars", nil)
+	req.AddCookie(session)
+	user, err := getCurrentUser(req)
+	require.NoError(t, err)
+
+	// Cross-site links and forms can't log users out
+	forged := httptest.NewRequest("GET", "/auth/logout", nil)
+	forged.AddCookie(session)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, forged)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	forged = httptest.NewRequest("POST", "/auth/logout", nil)
+	forged.Header.Set("Origin", "https://evil.example.com")
+	forged.AddCookie(session)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, forged)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	_, err = getCurrentUser(req)
+	require.NoError(t, err)
+
+	logout := httptest.NewRequest("POST", "/auth/logout", nil)
+	logout.Header.Set("Origin", "http://example.com")
+	logout.AddCookie(session)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, logout)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// A copy of the cookie kept after logging out no longer authenticates
+	_, err = getCurrentUser(req)
+	assert.Equal(t, errTokenRevoked, err)
+	revocations, err := store.ListRevocations(time.Now())
+	require.NoError(t, err)
+	require.Len(t, revocations, 1)
+	assert.Equal(t, user.ID, revocations[0].RevokedBy)
+	assert.NotNil(t, revocations[0].ExpiresAt)
+}
+
+func TestNewOIDCLoginErrors(t *testing.T) {
+	p := newFakeProvider(t)
+	defer p.server.Close()
+
+	_, err := newOIDCLogin(oidcConfig{Issuer: p.server.URL, ClientID: "ratesvc", RedirectURL: "https://hub.example.com/auth/callback"})
+	assert.EqualError(t, err, "JWT_KEY must be set to sign the sessions of OpenID Connect logins")
+	_, err = newOIDCLogin(oidcConfig{Issuer: p.server.URL + "/", ClientID: "ratesvc", RedirectURL: "https://hub.example.com/auth/callback",
+		SessionKey: []byte("secret")})
+	assert.EqualError(t, err, `provider issuer "`+p.server.URL+`" does not match "`+p.server.URL+`/"`)
+}
+
+func TestAuthRoutesDisabled(t *testing.T) {
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
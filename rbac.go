@@ -0,0 +1,221 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/response"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// role is what a user is allowed to do, each role has the permissions of the
+// roles before it
+type role int
+
+const (
+	roleAnonymous role = iota
+	roleUser
+	roleModerator
+	roleAdmin
+)
+
+var roleNames = map[role]string{
+	roleAnonymous: "anonymous",
+	roleUser:      "user",
+	roleModerator: "moderator",
+	roleAdmin:     "admin",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+// parseRole returns the role with the name
+func parseRole(name string) (role, bool) {
+	for r, n := range roleNames {
+		if n == name {
+			return r, true
+		}
+	}
+	return roleAnonymous, false
+}
+
+// permission is an action routes require
+type permission string
+
+// Permissions and the least role having each of them
+const (
+	// Reading public data
+	permRead permission = "read"
+	// Starring and unstarring items
+	permStar permission = "star"
+	// Writing, editing and deleting one's comments
+	permComment permission = "comment"
+	// Managing one's API tokens
+	permManageTokens permission = "manage-tokens"
+	// Deleting the comments of others
+	permModerate permission = "moderate"
+	// Managing the service
+	permAdminister permission = "administer"
+)
+
+var permissionRoles = map[permission]role{
+	permRead:         roleAnonymous,
+	permStar:         roleUser,
+	permComment:      roleUser,
+	permManageTokens: roleUser,
+	permModerate:     roleModerator,
+	permAdminister:   roleAdmin,
+}
+
+// roleAssignments maps user IDs to the roles given to them in the roles
+// file, in addition to those of their tokens
+type roleAssignments map[bson.ObjectId]role
+
+var (
+	assignedRolesMu sync.RWMutex
+	assignedRoles   roleAssignments
+)
+
+// setAssignedRoles replaces the roles of the roles file
+func setAssignedRoles(roles roleAssignments) {
+	assignedRolesMu.Lock()
+	assignedRoles = roles
+	assignedRolesMu.Unlock()
+}
+
+// loadRoleAssignments reads a YAML file listing the IDs of the users with
+// each role, e.g.
+//
+//	admin:
+//	- 5a0c4b8f1b2d3e4f5a6b7c8d
+//	moderator:
+//	- 5a0c4b8f1b2d3e4f5a6b7c8e
+func loadRoleAssignments(path string) (roleAssignments, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string][]string
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	roles := roleAssignments{}
+	for name, ids := range file {
+		r, ok := parseRole(name)
+		if !ok || r == roleAnonymous {
+			return nil, fmt.Errorf("%s: unknown role %q, expected user, moderator or admin", path, name)
+		}
+		for _, id := range ids {
+			if !bson.IsObjectIdHex(id) {
+				return nil, fmt.Errorf("%s: invalid user ID %q", path, id)
+			}
+			if r > roles[bson.ObjectIdHex(id)] {
+				roles[bson.ObjectIdHex(id)] = r
+			}
+		}
+	}
+	return roles, nil
+}
+
+// highestRole returns the highest of the named roles, ignoring unknown ones
+func highestRole(names []string) role {
+	highest := roleAnonymous
+	for _, name := range names {
+		if r, ok := parseRole(name); ok && r > highest {
+			highest = r
+		}
+	}
+	return highest
+}
+
+// roleOf returns the role of the user, nil for anonymous requests. Users
+// authenticated with an API token never have more than the user role.
+func roleOf(u *User) role {
+	if u == nil {
+		return roleAnonymous
+	}
+	if u.scopes != nil {
+		return roleUser
+	}
+	r := roleUser
+	if u.role > r {
+		r = u.role
+	}
+	assignedRolesMu.RLock()
+	defer assignedRolesMu.RUnlock()
+	if assigned := assignedRoles[u.ID]; assigned > r {
+		r = assigned
+	}
+	return r
+}
+
+// can returns whether the user has the permission
+func can(u *User, p permission) bool {
+	required, ok := permissionRoles[p]
+	return ok && roleOf(u) >= required
+}
+
+type contextKey int
+
+// currentUserKey holds the user authenticated by requirePermission in the
+// request context
+const currentUserKey contextKey = iota
+
+// permissionHandler only lets users with the permission through
+type permissionHandler struct {
+	permission permission
+	next       http.Handler
+}
+
+// requirePermission wraps the handler of a route with the permission it
+// requires, and rejects the writes of banned users. Every /v1 route must
+// declare one.
+func requirePermission(p permission, h http.Handler) http.Handler {
+	if _, ok := permissionRoles[p]; !ok {
+		panic(fmt.Sprintf("unknown permission %q", p))
+	}
+	return &permissionHandler{permission: p, next: h}
+}
+
+func (h *permissionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if permissionRoles[h.permission] == roleAnonymous {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	currentUser, err := getCurrentUser(req)
+	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+	if !can(currentUser, h.permission) {
+		response.NewErrorResponse(http.StatusForbidden, "forbidden, requires the "+permissionRoles[h.permission].String()+" role").Write(w)
+		return
+	}
+	// Banned users can still read
+	if !isSafeMethod(req.Method) && !requireNotBanned(w, currentUser) {
+		return
+	}
+	// Handlers get the user from the context instead of authenticating again
+	h.next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), currentUserKey, currentUser)))
+}
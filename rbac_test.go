@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutesDeclarePermissions(t *testing.T) {
+	err := newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/v1/") {
+			return nil
+		}
+		if _, ok := route.GetHandler().(*permissionHandler); !ok {
+			t.Errorf("route %s does not declare a permission", path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRoleOf(t *testing.T) {
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	setAssignedRoles(roleAssignments{alice: roleModerator})
+	defer setAssignedRoles(nil)
+
+	tests := []struct {
+		name string
+		user *User
+		want role
+	}{
+		{"anonymous", nil, roleAnonymous},
+		{"user", &User{ID: bob}, roleUser},
+		{"from claims", &User{ID: bob, role: roleAdmin}, roleAdmin},
+		{"from file", &User{ID: alice}, roleModerator},
+		{"highest of claims and file", &User{ID: alice, role: roleAdmin}, roleAdmin},
+		{"API token", &User{ID: alice, role: roleAdmin, scopes: []string{scopeCommentsWrite}}, roleUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, roleOf(tt.user))
+		})
+	}
+	assert.True(t, can(&User{ID: alice}, permModerate))
+	assert.False(t, can(&User{ID: alice}, permAdminister))
+	assert.False(t, can(nil, permStar))
+	assert.True(t, can(nil, permRead))
+}
+
+func TestRolesFromClaims(t *testing.T) {
+	oldVerifier := jwtVerifier
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	defer func() { jwtVerifier = oldVerifier }()
+
+	claims := testClaims(&User{ID: bson.NewObjectId(), Name: "Rick Sanchez"})
+	claims.Roles = []string{"moderator", "wizard"}
+	u, err := jwtVerifier.userFromToken(signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", claims))
+	require.NoError(t, err)
+	assert.Equal(t, roleModerator, roleOf(u))
+}
+
+func TestLoadRoleAssignments(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	write := func(content string) string {
+		path := filepath.Join(dir, "roles.yaml")
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	roles, err := loadRoleAssignments(write("admin:\n- " + alice.Hex() + "\nmoderator:\n- " + alice.Hex() + "\n- " + bob.Hex() + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, roleAssignments{alice: roleAdmin, bob: roleModerator}, roles)
+
+	path := write("owner:\n- " + alice.Hex() + "\n")
+	_, err = loadRoleAssignments(path)
+	assert.EqualError(t, err, path+`: unknown role "owner", expected user, moderator or admin`)
+	_, err = loadRoleAssignments(write("admin:\n- rick\n"))
+	assert.EqualError(t, err, path+`: invalid user ID "rick"`)
+}
+
+func TestRequirePermission(t *testing.T) {
+	moderator := &User{ID: bson.NewObjectId(), Name: "Mod", role: roleModerator}
+	var authenticated int
+	var currentUser *User
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(req *http.Request) (*User, error) {
+		if u, ok := req.Context().Value(currentUserKey).(*User); ok {
+			return u, nil
+		}
+		authenticated++
+		if currentUser == nil {
+			return nil, errNoToken
+		}
+		return currentUser, nil
+	}
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	var got *User
+	h := requirePermission(permModerate, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, _ = getCurrentUser(req)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	currentUser = &User{ID: bson.NewObjectId()}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "requires the moderator role")
+
+	// The handler gets the user without authenticating again
+	currentUser, authenticated = moderator, 0
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, moderator, got)
+	assert.Equal(t, 1, authenticated)
+
+	assert.Panics(t, func() { requirePermission("fly", h) })
+}
+
+func TestModeratorsDeleteComments(t *testing.T) {
+	store = newMemoryStore()
+	alice := &User{ID: bson.NewObjectId(), Name: "Alice"}
+	bob := &User{ID: bson.NewObjectId(), Name: "Bob"}
+	moderator := &User{ID: bson.NewObjectId(), Name: "Mod"}
+	setAssignedRoles(roleAssignments{moderator.ID: roleModerator})
+	defer setAssignedRoles(nil)
+	var currentUser *User
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) {
+		if currentUser == nil {
+			return nil, errors.New("no token")
+		}
+		return currentUser, nil
+	}
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+	r := newRouter()
+	do := func(u *User, method, path, body string) *httptest.ResponseRecorder {
+		currentUser = u
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusCreated, do(alice, "POST", "/v1/comments/stable/wordpress", `{"text": "Hello"}`).Code)
+	it, err := store.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	path := "/v1/comments/stable/wordpress/" + it.Comments[0].ID.Hex()
+
+	assert.Equal(t, http.StatusUnauthorized, do(nil, "DELETE", path, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(bob, "DELETE", path, "").Code)
+	// Moderators can delete the comments of others, but not edit them
+	assert.Equal(t, http.StatusUnauthorized, do(moderator, "PUT", path, `{"text": "Edited"}`).Code)
+	assert.Equal(t, http.StatusAccepted, do(moderator, "DELETE", path, "").Code)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTopItems = 5
+	maxTopItems     = 50
+)
+
+// itemStats holds the counts of a single item
+type itemStats struct {
+	ID              string `json:"id" bson:"_id"`
+	StargazersCount int    `json:"stargazers_count" bson:"stargazers_count"`
+	CommentsCount   int    `json:"comments_count" bson:"comments_count"`
+}
+
+// repoStats holds the aggregate counts of the items in a repo
+type repoStats struct {
+	Name            string `json:"name" bson:"_id"`
+	ItemsCount      int    `json:"items_count" bson:"items_count"`
+	StargazersCount int    `json:"stargazers_count" bson:"stargazers_count"`
+	CommentsCount   int    `json:"comments_count" bson:"comments_count"`
+	// Only set when fetching the stats of a single repo
+	MostStarred   []itemStats `json:"most_starred,omitempty" bson:"-"`
+	MostDiscussed []itemStats `json:"most_discussed,omitempty" bson:"-"`
+}
+
+// ListRepos returns the aggregate counts of every repo
+func ListRepos(w http.ResponseWriter, req *http.Request) {
+	// The comments of muted users are hidden from everyone but themselves,
+	// so they aren't counted either
+	muted, err := sanctionCache.mutedUsers()
+	if err != nil {
+		log.WithError(err).Error("could not load sanctions")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	repos, err := store.ListRepos(muted)
+	if err != nil {
+		log.WithError(err).Error("could not aggregate repos")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	response.NewDataResponse(repos).Write(w)
+}
+
+// GetRepoStats returns the aggregate counts of a repo together with its
+// most starred and most discussed items
+func GetRepoStats(w http.ResponseWriter, req *http.Request, params Params) {
+	limit := defaultTopItems
+	if l := req.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxTopItems {
+			response.NewErrorResponse(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxTopItems)).Write(w)
+			return
+		}
+		limit = n
+	}
+
+	muted, err := sanctionCache.mutedUsers()
+	if err != nil {
+		log.WithError(err).Error("could not load sanctions")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	stats, err := store.GetRepoStats(params["repo"], limit, muted)
+	if err == errNotFound {
+		response.NewErrorResponse(http.StatusNotFound, "repo not found").Write(w)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("could not aggregate repo stats")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	response.NewDataResponse(stats).Write(w)
+}
+
+// repoOf returns the repo of an item ID in the form repo/chartName
+func repoOf(id string) string {
+	return strings.SplitN(id, "/", 2)[0]
+}
+
+// statsOf returns the counts of an item, not counting the comments of the
+// hidden authors
+func statsOf(it *item, hiddenAuthors []bson.ObjectId) itemStats {
+	stats := itemStats{ID: it.ID, StargazersCount: len(it.StargazersIDs)}
+	for _, cm := range it.Comments {
+		if cm.Author == nil || !containsObjectID(hiddenAuthors, cm.Author.ID) {
+			stats.CommentsCount++
+		}
+	}
+	return stats
+}
+
+func containsObjectID(list []bson.ObjectId, id bson.ObjectId) bool {
+	for _, e := range list {
+		if e == id {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateRepos computes the counts of every repo from the counts of its
+// items, for stores that can't aggregate them natively
+func aggregateRepos(items []itemStats) []repoStats {
+	byName := map[string]*repoStats{}
+	for _, it := range items {
+		name := repoOf(it.ID)
+		r, ok := byName[name]
+		if !ok {
+			r = &repoStats{Name: name}
+			byName[name] = r
+		}
+		r.ItemsCount++
+		r.StargazersCount += it.StargazersCount
+		r.CommentsCount += it.CommentsCount
+	}
+
+	repos := []repoStats{}
+	for _, r := range byName {
+		repos = append(repos, *r)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	return repos
+}
+
+// aggregateRepoStats computes the stats of a repo from the counts of its
+// items, for stores that can't aggregate them natively. It returns nil if
+// there are no items.
+func aggregateRepoStats(repo string, items []itemStats, limit int) *repoStats {
+	if len(items) == 0 {
+		return nil
+	}
+
+	stats := &repoStats{Name: repo, ItemsCount: len(items)}
+	for _, it := range items {
+		stats.StargazersCount += it.StargazersCount
+		stats.CommentsCount += it.CommentsCount
+	}
+	stats.MostStarred = topItems(items, limit, func(s itemStats) int { return s.StargazersCount })
+	stats.MostDiscussed = topItems(items, limit, func(s itemStats) int { return s.CommentsCount })
+	return stats
+}
+
+// topItems returns up to limit items with a non-zero count, sorted by
+// decreasing count and then by ID
+func topItems(all []itemStats, limit int, count func(itemStats) int) []itemStats {
+	var top []itemStats
+	for _, s := range all {
+		if count(s) > 0 {
+			top = append(top, s)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if count(top[i]) != count(top[j]) {
+			return count(top[i]) > count(top[j])
+		}
+		return top[i].ID < top[j].ID
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
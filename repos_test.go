@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListRepos(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	repos := []repoStats{
+		{Name: "incubator", ItemsCount: 1, StargazersCount: 0, CommentsCount: 3},
+		{Name: "stable", ItemsCount: 2, StargazersCount: 5, CommentsCount: 1},
+	}
+	m.On("All", &[]repoStats{}).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]repoStats) = repos
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/repos", nil)
+	ListRepos(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var b struct {
+		Data []repoStats `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&b)
+	assert.Equal(t, repos, b.Data)
+}
+
+func TestGetRepoStats(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+
+	tests := []struct {
+		name     string
+		query    string
+		facets   repoStatsFacets
+		wantCode int
+	}{
+		{"valid", "", repoStatsFacets{
+			Totals:        []repoStats{{ItemsCount: 2, StargazersCount: 5, CommentsCount: 1}},
+			MostStarred:   []itemStats{{"stable/wordpress", 4, 0}, {"stable/drupal", 1, 1}},
+			MostDiscussed: []itemStats{{"stable/drupal", 1, 1}},
+		}, http.StatusOK},
+		{"unknown repo", "", repoStatsFacets{}, http.StatusNotFound},
+		{"invalid limit", "?limit=0", repoStatsFacets{}, http.StatusBadRequest},
+		{"limit too large", "?limit=100", repoStatsFacets{}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.ExpectedCalls = nil
+			m.On("One", &repoStatsFacets{}).Run(func(args mock.Arguments) {
+				*args.Get(0).(*repoStatsFacets) = tt.facets
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/v1/repos/stable/stats"+tt.query, nil)
+			GetRepoStats(w, req, Params{"repo": "stable"})
+			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var b struct {
+				Data repoStats `json:"data"`
+			}
+			json.NewDecoder(w.Body).Decode(&b)
+			assert.Equal(t, "stable", b.Data.Name)
+			assert.Equal(t, 2, b.Data.ItemsCount)
+			assert.Equal(t, 5, b.Data.StargazersCount)
+			assert.Equal(t, tt.facets.MostStarred, b.Data.MostStarred)
+			assert.Equal(t, tt.facets.MostDiscussed, b.Data.MostDiscussed)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// revocation invalidates tokens before they expire: either the JWT with the
+// TokenID (jti claim), or every token of the user UserID issued before
+// IssuedBefore
+type revocation struct {
+	ID           bson.ObjectId `json:"id" bson:"_id"`
+	TokenID      string        `json:"token_id,omitempty" bson:"token_id,omitempty"`
+	UserID       bson.ObjectId `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	IssuedBefore *time.Time    `json:"issued_before,omitempty" bson:"issued_before,omitempty"`
+	// When the revocation lapses, e.g. once the revoked token has expired
+	ExpiresAt *time.Time    `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Reason    string        `json:"reason,omitempty" bson:"reason,omitempty"`
+	RevokedBy bson.ObjectId `json:"revoked_by" bson:"revoked_by"`
+	CreatedAt time.Time     `json:"created_at" bson:"created_at"`
+}
+
+// inEffect returns whether the revocation hasn't lapsed at now
+func (r *revocation) inEffect(now time.Time) bool {
+	return r.ExpiresAt == nil || r.ExpiresAt.After(now)
+}
+
+// maxReasonLength is the maximum length of the reason of a revocation or
+// sanction
+const maxReasonLength = 500
+
+// normalizeReason trims the reason of a revocation or sanction, checking its
+// length
+func normalizeReason(reason *string) error {
+	*reason = strings.TrimSpace(*reason)
+	if len(*reason) > maxReasonLength {
+		return fmt.Errorf("reason must be at most %d characters", maxReasonLength)
+	}
+	return nil
+}
+
+// errTokenRevoked is returned for tokens revoked before they expire
+var errTokenRevoked = &authError{reason: "token has been revoked"}
+
+// revocationList keeps the revocations in effect in memory, so that checking
+// a token doesn't query the store
+type revocationList struct {
+	storeCache
+	tokens map[string]bool
+	// The latest cutoff of each user
+	users map[bson.ObjectId]time.Time
+}
+
+// revocationCache holds the revocations checked by getCurrentUser
+var revocationCache = &revocationList{}
+
+// Refresh reloads the revocations in effect from the store
+func (l *revocationList) Refresh() error {
+	list, err := store.ListRevocations(getTimestamp())
+	if err != nil {
+		return err
+	}
+	tokens := map[string]bool{}
+	users := map[bson.ObjectId]time.Time{}
+	for _, r := range list {
+		if r.TokenID != "" {
+			tokens[r.TokenID] = true
+		}
+		if r.UserID != "" && r.IssuedBefore != nil && r.IssuedBefore.After(users[r.UserID]) {
+			users[r.UserID] = *r.IssuedBefore
+		}
+	}
+	l.mu.Lock()
+	l.tokens, l.users = tokens, users
+	l.setLoaded()
+	l.mu.Unlock()
+	return nil
+}
+
+// check returns errTokenRevoked if the token of the user, with the ID and
+// issue time, has been revoked. JWTs only have a precision of a second, so
+// tokens issued in the second of a cutoff are revoked too.
+func (l *revocationList) check(userID bson.ObjectId, tokenID string, issuedAt time.Time) error {
+	if err := l.load(l.Refresh, "token revocations"); err != nil {
+		return &authError{reason: "could not check token revocation", cause: err}
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if tokenID != "" && l.tokens[tokenID] {
+		return errTokenRevoked
+	}
+	if cutoff, ok := l.users[userID]; ok && issuedAt.Unix() <= cutoff.Unix() {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// validateRevocation checks a new revocation, revoking the tokens of a user
+// issued until now if no cutoff is given
+func validateRevocation(r *revocation, now time.Time) error {
+	r.TokenID = strings.TrimSpace(r.TokenID)
+	switch {
+	case r.TokenID == "" && r.UserID == "":
+		return errors.New("token_id or user_id is required")
+	case r.TokenID != "" && r.UserID != "":
+		return errors.New("token_id and user_id can't be both given")
+	case r.TokenID != "" && r.IssuedBefore != nil:
+		return errors.New("issued_before only applies to user_id")
+	}
+	if r.UserID != "" {
+		if r.IssuedBefore == nil {
+			r.IssuedBefore = &now
+		}
+		if r.IssuedBefore.After(now) {
+			return errors.New("issued_before can't be in the future")
+		}
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	return normalizeReason(&r.Reason)
+}
+
+// ListRevocations returns the revocations in effect
+func ListRevocations(w http.ResponseWriter, req *http.Request) {
+	list, err := store.ListRevocations(getTimestamp())
+	if err != nil {
+		log.WithError(err).Error("could not fetch revocations")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	if list == nil {
+		list = []*revocation{}
+	}
+	response.NewDataResponse(list).Write(w)
+}
+
+// CreateRevocation revokes a token, or the tokens of a user
+func CreateRevocation(w http.ResponseWriter, req *http.Request) {
+	currentUser, err := getCurrentUser(req)
+	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+
+	var r revocation
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+	now := getTimestamp()
+	if err := validateRevocation(&r, now); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+
+	r.ID = getNewObjectID()
+	r.RevokedBy = currentUser.ID
+	r.CreatedAt = now
+	if err := store.CreateRevocation(r); err != nil {
+		log.WithError(err).Error("could not insert revocation")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	revocationCache.invalidate()
+	log.WithFields(log.Fields{"revocation": r.ID.Hex(), "token": r.TokenID, "user": r.UserID.Hex(), "by": currentUser.ID.Hex()}).Info("revoked tokens")
+	response.NewDataResponse(r).WithCode(http.StatusCreated).Write(w)
+}
+
+// DeleteRevocation lifts a revocation
+func DeleteRevocation(w http.ResponseWriter, req *http.Request, params Params) {
+	if !bson.IsObjectIdHex(params["revocationId"]) {
+		response.NewErrorResponse(http.StatusNotFound, "revocation not found").Write(w)
+		return
+	}
+	err := store.DeleteRevocation(bson.ObjectIdHex(params["revocationId"]))
+	if err == errNotFound {
+		response.NewErrorResponse(http.StatusNotFound, "revocation not found").Write(w)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("could not delete revocation")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	revocationCache.invalidate()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationList(t *testing.T) {
+	store = newMemoryStore()
+	l := &revocationList{}
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	cutoff := time.Date(2017, 11, 1, 12, 0, 0, 500, time.UTC)
+	lapsed := time.Now().Add(-time.Hour)
+	for _, r := range []revocation{
+		{ID: bson.NewObjectId(), TokenID: "stolen"},
+		{ID: bson.NewObjectId(), TokenID: "lapsed", ExpiresAt: &lapsed},
+		{ID: bson.NewObjectId(), UserID: alice, IssuedBefore: &cutoff},
+	} {
+		require.NoError(t, store.CreateRevocation(r))
+	}
+
+	assert.Equal(t, errTokenRevoked, l.check(bob, "stolen", cutoff.Add(time.Hour)))
+	assert.NoError(t, l.check(bob, "lapsed", cutoff))
+	assert.NoError(t, l.check(bob, "other", cutoff))
+	assert.Equal(t, errTokenRevoked, l.check(alice, "", cutoff.Add(-time.Hour)))
+	// Tokens without an iat claim are as old as can be
+	assert.Equal(t, errTokenRevoked, l.check(alice, "", time.Unix(0, 0)))
+	assert.Equal(t, errTokenRevoked, l.check(alice, "", cutoff.Truncate(time.Second)))
+	assert.NoError(t, l.check(alice, "", cutoff.Add(time.Second)))
+
+	// Revocations are cached until invalidated
+	require.NoError(t, store.CreateRevocation(revocation{ID: bson.NewObjectId(), TokenID: "other"}))
+	assert.NoError(t, l.check(bob, "other", cutoff))
+	l.invalidate()
+	assert.Equal(t, errTokenRevoked, l.check(bob, "other", cutoff))
+}
+
+func TestRevocationListLoadErrors(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	l := &revocationList{}
+	m.On("All", mock.Anything).Return(errors.New("connection refused")).Once()
+	err := l.check(bson.NewObjectId(), "token", time.Now())
+	assert.EqualError(t, err, "could not check token revocation: connection refused")
+
+	stolen := []*revocation{{ID: bson.NewObjectId(), TokenID: "stolen"}}
+	m.On("All", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*revocation) = stolen
+	}).Once()
+	assert.Equal(t, errTokenRevoked, l.check(bson.NewObjectId(), "stolen", time.Now()))
+
+	// Once loaded, the previous revocations are kept if reloading fails
+	l.invalidate()
+	m.On("All", mock.Anything).Return(errors.New("connection refused")).Once()
+	assert.Equal(t, errTokenRevoked, l.check(bson.NewObjectId(), "stolen", time.Now()))
+	m.AssertExpectations(t)
+}
+
+func TestValidateRevocation(t *testing.T) {
+	now := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		name string
+		r    revocation
+		err  string
+	}{
+		{"token", revocation{TokenID: "jti", ExpiresAt: &future}, ""},
+		{"user", revocation{UserID: bson.NewObjectId(), IssuedBefore: &past}, ""},
+		{"nothing", revocation{Reason: "spam"}, "token_id or user_id is required"},
+		{"both", revocation{TokenID: "jti", UserID: bson.NewObjectId()}, "token_id and user_id can't be both given"},
+		{"token cutoff", revocation{TokenID: "jti", IssuedBefore: &past}, "issued_before only applies to user_id"},
+		{"future cutoff", revocation{UserID: bson.NewObjectId(), IssuedBefore: &future}, "issued_before can't be in the future"},
+		{"lapsed", revocation{TokenID: "jti", ExpiresAt: &past}, "expires_at must be in the future"},
+		{"long reason", revocation{TokenID: "jti", Reason: string(make([]byte, maxReasonLength+1))}, "reason must be at most 500 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRevocation(&tt.r, now)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+
+	r := revocation{UserID: bson.NewObjectId()}
+	require.NoError(t, validateRevocation(&r, now))
+	require.NotNil(t, r.IssuedBefore)
+	assert.True(t, now.Equal(*r.IssuedBefore))
+}
+
+func TestRevocations(t *testing.T) {
+	store = newMemoryStore()
+	oldCache := revocationCache
+	revocationCache = &revocationList{}
+	oldVerifier := jwtVerifier
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret"), policy: claimsPolicy{Leeway: time.Minute}}
+	defer func() { revocationCache, jwtVerifier = oldCache, oldVerifier }()
+	r := newRouter()
+
+	admin := testClaims(&User{ID: bson.NewObjectId(), Name: "Admin"})
+	admin.Roles = []string{"admin"}
+	adminToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", admin)
+	rick := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	session := testClaims(rick)
+	session.TokenID = "session-1"
+	session.IssuedAt = time.Now().Add(-time.Minute).Unix()
+	sessionToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", session)
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	star := `{"id": "stable/wordpress", "has_starred": true}`
+
+	require.Equal(t, http.StatusCreated, do("PUT", "/v1/stars", sessionToken, star).Code)
+	assert.Equal(t, http.StatusForbidden, do("POST", "/v1/revocations", sessionToken, `{"token_id": "session-1"}`).Code)
+
+	w := do("POST", "/v1/revocations", adminToken, `{"token_id": "session-1", "reason": "stolen laptop"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Data revocation `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, admin.User.ID, created.Data.RevokedBy)
+	w = do("PUT", "/v1/stars", sessionToken, star)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "token has been revoked")
+
+	// Lifting the revocation restores the session
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/v1/revocations/"+created.Data.ID.Hex(), adminToken, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/v1/revocations/"+created.Data.ID.Hex(), adminToken, "").Code)
+	assert.Equal(t, http.StatusOK, do("PUT", "/v1/stars", sessionToken, star).Code)
+
+	// Revoking every token of the user covers API tokens too
+	w = do("POST", "/v1/tokens", sessionToken, `{"name": "CI", "scopes": ["stars:write"]}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var apiTok struct {
+		Data apiToken `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&apiTok))
+	require.Equal(t, http.StatusCreated, do("POST", "/v1/revocations", adminToken, `{"user_id": "`+rick.ID.Hex()+`"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, do("PUT", "/v1/stars", sessionToken, star).Code)
+	assert.Equal(t, http.StatusUnauthorized, do("PUT", "/v1/stars", apiTok.Data.Token, star).Code)
+
+	// Tokens issued later are accepted
+	session.IssuedAt = time.Now().Add(time.Second).Unix()
+	assert.Equal(t, http.StatusOK, do("PUT", "/v1/stars", signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", session), star).Code)
+
+	w = do("GET", "/v1/revocations", adminToken, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Data []revocation `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, rick.ID, list.Data[0].UserID)
+	assert.NotNil(t, list.Data[0].IssuedBefore)
+}
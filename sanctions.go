@@ -0,0 +1,353 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of sanctions
+const (
+	// Banned users can't write anything
+	sanctionBan = "ban"
+	// The comments of muted users are only shown to themselves
+	sanctionMute = "mute"
+)
+
+// sanction is a ban or mute of a user by a moderator
+type sanction struct {
+	ID     bson.ObjectId `json:"id" bson:"_id"`
+	UserID bson.ObjectId `json:"user_id" bson:"user_id"`
+	Kind   string        `json:"kind" bson:"kind"`
+	Reason string        `json:"reason,omitempty" bson:"reason,omitempty"`
+	// Sanctions without expiry last until they are lifted
+	ExpiresAt *time.Time    `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	CreatedBy bson.ObjectId `json:"created_by" bson:"created_by"`
+	// Role of the moderator or admin who created the sanction
+	CreatorRole string    `json:"creator_role,omitempty" bson:"creator_role,omitempty"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+}
+
+// inEffect returns whether the sanction hasn't lapsed at now
+func (s *sanction) inEffect(now time.Time) bool {
+	return s.ExpiresAt == nil || s.ExpiresAt.After(now)
+}
+
+// outrankedBy returns whether the user has the role of the creator of the
+// sanction or a higher one, so that the sanction doesn't apply to them.
+// Sanctions created before their creator's role was recorded always apply.
+func (s *sanction) outrankedBy(u *User) bool {
+	creator, ok := parseRole(s.CreatorRole)
+	return ok && roleOf(u) >= creator
+}
+
+// outlasts returns whether the sanction lasts longer than other
+func (s *sanction) outlasts(other *sanction) bool {
+	if other == nil || other.ExpiresAt == nil {
+		return other == nil
+	}
+	return s.ExpiresAt == nil || s.ExpiresAt.After(*other.ExpiresAt)
+}
+
+// banMessage tells a banned user about the ban. Muted users aren't told.
+func (s *sanction) banMessage() string {
+	msg := "you are banned"
+	if s.ExpiresAt != nil {
+		msg += " until " + s.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if s.Reason != "" {
+		msg += ": " + s.Reason
+	}
+	return msg
+}
+
+// sanctionList keeps the sanctions in effect in memory, since every write
+// and comment listing checks them
+type sanctionList struct {
+	storeCache
+	// The longest lasting sanction of each kind of every user
+	users map[string]map[bson.ObjectId]*sanction
+}
+
+// sanctionCache holds the sanctions enforced by the handlers
+var sanctionCache = &sanctionList{}
+
+// Refresh reloads the sanctions in effect from the store
+func (l *sanctionList) Refresh() error {
+	list, err := store.ListSanctions(getTimestamp())
+	if err != nil {
+		return err
+	}
+	users := map[string]map[bson.ObjectId]*sanction{sanctionBan: {}, sanctionMute: {}}
+	for _, s := range list {
+		if byUser, ok := users[s.Kind]; ok && s.outlasts(byUser[s.UserID]) {
+			byUser[s.UserID] = s
+		}
+	}
+	l.mu.Lock()
+	l.users = users
+	l.setLoaded()
+	l.mu.Unlock()
+	return nil
+}
+
+// lookup returns the sanction of the kind in effect for the user, or nil.
+// Sanctions fail closed like token revocations: if they can't be loaded, the
+// error is returned and callers reject the writes they guard.
+func (l *sanctionList) lookup(kind string, userID bson.ObjectId) (*sanction, error) {
+	if err := l.load(l.Refresh, "sanctions"); err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// Sanctions may lapse between reloads
+	if s := l.users[kind][userID]; s != nil && s.inEffect(getTimestamp()) {
+		return s, nil
+	}
+	return nil, nil
+}
+
+// muted returns whether the comments of the user are hidden from others,
+// which they are if the sanctions can't be loaded
+func (l *sanctionList) muted(userID bson.ObjectId) bool {
+	mute, err := l.lookup(sanctionMute, userID)
+	if err != nil {
+		log.WithError(err).Error("could not load sanctions")
+		return true
+	}
+	return mute != nil
+}
+
+// mutedUsers returns the IDs of the users muted now, sorted
+func (l *sanctionList) mutedUsers() ([]bson.ObjectId, error) {
+	if err := l.load(l.Refresh, "sanctions"); err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := getTimestamp()
+	var ids []bson.ObjectId
+	for id, s := range l.users[sanctionMute] {
+		if s.inEffect(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// commentHidden returns whether the comment is hidden from the viewer, nil
+// for anonymous requests
+func commentHidden(cm comment, viewer *User) bool {
+	if cm.Author == nil || (viewer != nil && viewer.ID == cm.Author.ID) {
+		return false
+	}
+	return sanctionCache.muted(cm.Author.ID)
+}
+
+// validSanction returns the sanction of the kind in effect for the user, or
+// nil. Only the roles file tells the roles of users who aren't authenticated,
+// so moderators may sanction users whose tokens give them the same role or a
+// higher one. Those sanctions are lifted once the user authenticates.
+func validSanction(kind string, u *User) (*sanction, error) {
+	var lifted bson.ObjectId
+	for {
+		s, err := sanctionCache.lookup(kind, u.ID)
+		if err != nil || s == nil || !s.outrankedBy(u) {
+			return s, err
+		}
+		if s.ID == lifted {
+			return nil, fmt.Errorf("sanction %s is still in effect after being lifted", s.ID.Hex())
+		}
+		if err := store.DeleteSanction(s.ID); err != nil && err != errNotFound {
+			return nil, err
+		}
+		sanctionCache.invalidate()
+		lifted = s.ID
+		log.WithFields(log.Fields{"sanction": s.ID.Hex(), "kind": s.Kind, "user": u.ID.Hex()}).Info("lifted sanction of a user outranking its creator")
+	}
+}
+
+// banOf returns the ban in effect for the user, or nil, lifting the invalid
+// sanctions of the user
+func banOf(u *User) (*sanction, error) {
+	if _, err := validSanction(sanctionMute, u); err != nil {
+		return nil, err
+	}
+	return validSanction(sanctionBan, u)
+}
+
+// requireNotBanned responds with 403 and returns false if the user is
+// banned, or with 500 if the sanctions can't be loaded
+func requireNotBanned(w http.ResponseWriter, u *User) bool {
+	ban, err := banOf(u)
+	if err != nil {
+		log.WithError(err).Error("could not load sanctions")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return false
+	}
+	if ban == nil {
+		return true
+	}
+	response.NewErrorResponse(http.StatusForbidden, ban.banMessage()).Write(w)
+	return false
+}
+
+// validateSanction checks a new sanction
+func validateSanction(s *sanction, now time.Time) error {
+	if s.UserID == "" {
+		return errors.New("user_id is required")
+	}
+	if s.Kind != sanctionBan && s.Kind != sanctionMute {
+		return fmt.Errorf("unknown kind %q, expected %s or %s", s.Kind, sanctionBan, sanctionMute)
+	}
+	if s.ExpiresAt != nil && !s.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	return normalizeReason(&s.Reason)
+}
+
+// ListSanctions returns the sanctions in effect
+func ListSanctions(w http.ResponseWriter, req *http.Request) {
+	list, err := store.ListSanctions(getTimestamp())
+	if err != nil {
+		log.WithError(err).Error("could not fetch sanctions")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	if list == nil {
+		list = []*sanction{}
+	}
+	response.NewDataResponse(list).Write(w)
+}
+
+// CreateSanction bans or mutes a user
+func CreateSanction(w http.ResponseWriter, req *http.Request) {
+	currentUser, err := getCurrentUser(req)
+	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+
+	var s sanction
+	if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+	now := getTimestamp()
+	if err := validateSanction(&s, now); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+	if !canSanction(w, currentUser, s.UserID) {
+		return
+	}
+
+	s.ID = getNewObjectID()
+	s.CreatedBy = currentUser.ID
+	s.CreatorRole = roleOf(currentUser).String()
+	s.CreatedAt = now
+	if err := store.CreateSanction(s); err != nil {
+		log.WithError(err).Error("could not insert sanction")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	sanctionCache.invalidate()
+	log.WithFields(log.Fields{"sanction": s.ID.Hex(), "kind": s.Kind, "user": s.UserID.Hex(), "by": currentUser.ID.Hex()}).Info("sanctioned user")
+	response.NewDataResponse(s).WithCode(http.StatusCreated).Write(w)
+}
+
+// canSanction responds with 403 and returns false if the user can't sanction
+// the target, or lift their sanctions: users can only sanction those with a
+// lower role. The roles of other users are only known from the roles file,
+// see validSanction.
+func canSanction(w http.ResponseWriter, u *User, target bson.ObjectId) bool {
+	if target == u.ID || roleOf(&User{ID: target}) >= roleOf(u) {
+		response.NewErrorResponse(http.StatusForbidden, "forbidden, cannot sanction yourself or users with the same role or a higher one").Write(w)
+		return false
+	}
+	return true
+}
+
+// findSanction returns the sanction with the ID, lapsed or not
+func findSanction(id bson.ObjectId) (*sanction, error) {
+	list, err := store.ListSanctions(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+// DeleteSanction lifts a sanction
+func DeleteSanction(w http.ResponseWriter, req *http.Request, params Params) {
+	currentUser, err := getCurrentUser(req)
+	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+	if !bson.IsObjectIdHex(params["sanctionId"]) {
+		response.NewErrorResponse(http.StatusNotFound, "sanction not found").Write(w)
+		return
+	}
+
+	s, err := findSanction(bson.ObjectIdHex(params["sanctionId"]))
+	if err == errNotFound {
+		response.NewErrorResponse(http.StatusNotFound, "sanction not found").Write(w)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("could not fetch sanctions")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	if !canSanction(w, currentUser, s.UserID) {
+		return
+	}
+	// Moderators can't lift the sanctions of admins
+	if creator, ok := parseRole(s.CreatorRole); ok && creator > roleOf(currentUser) {
+		response.NewErrorResponse(http.StatusForbidden, "forbidden, requires the "+creator.String()+" role").Write(w)
+		return
+	}
+
+	err = store.DeleteSanction(s.ID)
+	if err == errNotFound {
+		response.NewErrorResponse(http.StatusNotFound, "sanction not found").Write(w)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("could not delete sanction")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	sanctionCache.invalidate()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,369 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// useSanctions makes the handlers load the sanctions of the current store,
+// until the returned function restores the sanctions cache
+func useSanctions() func() {
+	old := sanctionCache
+	sanctionCache = &sanctionList{}
+	return func() { sanctionCache = old }
+}
+
+func TestSanctionList(t *testing.T) {
+	store = newMemoryStore()
+	now := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	oldGetTimestamp := getTimestamp
+	getTimestamp = func() time.Time { return now }
+	defer func() { getTimestamp = oldGetTimestamp }()
+
+	alice, bob, carol := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	day, week, lapsed := now.Add(24*time.Hour), now.Add(7*24*time.Hour), now.Add(-time.Hour)
+	for _, s := range []sanction{
+		{ID: bson.NewObjectId(), UserID: alice, Kind: sanctionBan, ExpiresAt: &day},
+		{ID: bson.NewObjectId(), UserID: alice, Kind: sanctionBan, ExpiresAt: &week, Reason: "spam"},
+		{ID: bson.NewObjectId(), UserID: bob, Kind: sanctionMute},
+		{ID: bson.NewObjectId(), UserID: bob, Kind: sanctionMute, ExpiresAt: &week},
+		{ID: bson.NewObjectId(), UserID: carol, Kind: sanctionBan, ExpiresAt: &lapsed},
+	} {
+		require.NoError(t, store.CreateSanction(s))
+	}
+
+	l := &sanctionList{}
+	lookup := func(kind string, userID bson.ObjectId) *sanction {
+		s, err := l.lookup(kind, userID)
+		require.NoError(t, err)
+		return s
+	}
+	ban := lookup(sanctionBan, alice)
+	require.NotNil(t, ban)
+	assert.Equal(t, "you are banned until 2017-11-08T00:00:00Z: spam", ban.banMessage())
+	assert.Nil(t, lookup(sanctionMute, alice))
+	assert.True(t, l.muted(bob))
+	assert.Nil(t, lookup(sanctionBan, bob))
+	assert.Nil(t, lookup(sanctionBan, carol))
+	muted, err := l.mutedUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []bson.ObjectId{bob}, muted)
+
+	// Sanctions lapse without waiting for a reload
+	now = week
+	assert.Nil(t, lookup(sanctionBan, alice))
+	assert.True(t, l.muted(bob))
+}
+
+func TestSanctionListFailsClosed(t *testing.T) {
+	var m mock.Mock
+	m.On("All", mock.Anything).Return(errors.New("no reachable servers"))
+	store = newMongoStore(testutil.NewMockSession(&m))
+	defer useSanctions()()
+	user := &User{ID: bson.NewObjectId()}
+
+	_, err := sanctionCache.lookup(sanctionBan, user.ID)
+	assert.Error(t, err)
+	_, err = sanctionCache.mutedUsers()
+	assert.Error(t, err)
+	assert.True(t, commentHidden(comment{Text: "Hello", Author: user}, nil))
+	assert.False(t, commentHidden(comment{Text: "Hello", Author: user}, user))
+	w := httptest.NewRecorder()
+	assert.False(t, requireNotBanned(w, user))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestValidateSanction(t *testing.T) {
+	now := time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := []struct {
+		name string
+		s    sanction
+		err  string
+	}{
+		{"ban", sanction{UserID: bson.NewObjectId(), Kind: sanctionBan, ExpiresAt: &future, Reason: "spam"}, ""},
+		{"mute", sanction{UserID: bson.NewObjectId(), Kind: sanctionMute}, ""},
+		{"no user", sanction{Kind: sanctionBan}, "user_id is required"},
+		{"unknown kind", sanction{UserID: bson.NewObjectId(), Kind: "kick"}, `unknown kind "kick", expected ban or mute`},
+		{"lapsed", sanction{UserID: bson.NewObjectId(), Kind: sanctionBan, ExpiresAt: &past}, "expires_at must be in the future"},
+		{"long reason", sanction{UserID: bson.NewObjectId(), Kind: sanctionBan, Reason: string(make([]byte, maxReasonLength+1))}, "reason must be at most 500 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSanction(&tt.s, now)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBansAndMutes(t *testing.T) {
+	store = newMemoryStore()
+	defer useSanctions()()
+	oldVerifier := jwtVerifier
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	defer func() { jwtVerifier = oldVerifier }()
+	r := newRouter()
+
+	moderator := testClaims(&User{ID: bson.NewObjectId(), Name: "Moderator"})
+	moderator.Roles = []string{"moderator"}
+	moderatorToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", moderator)
+	rick := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	rickToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(rick))
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	sanctionUser := func(body string) bson.ObjectId {
+		w := do("POST", "/v1/sanctions", moderatorToken, body)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var created struct {
+			Data sanction `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+		assert.Equal(t, moderator.User.ID, created.Data.CreatedBy)
+		return created.Data.ID
+	}
+	comments := func(token string) []comment {
+		w := do("GET", "/v1/comments/stable/wordpress", token, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var list struct {
+			Data []comment `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+		return list.Data
+	}
+	star := `{"id": "stable/wordpress", "has_starred": true}`
+
+	assert.Equal(t, http.StatusForbidden, do("POST", "/v1/sanctions", rickToken, `{"user_id": "`+rick.ID.Hex()+`", "kind": "ban"}`).Code)
+
+	// Banned users can't write anything, but can still read
+	ban := sanctionUser(`{"user_id": "` + rick.ID.Hex() + `", "kind": "ban", "reason": "spam", "expires_at": "2100-01-01T00:00:00Z"}`)
+	for _, req := range []struct{ method, path, body string }{
+		{"PUT", "/v1/stars", star},
+		{"POST", "/v1/comments/stable/wordpress", `{"text": "Hello"}`},
+		{"PUT", "/v1/items/chart/stable/wordpress/-/star", `{"has_starred": true}`},
+		{"POST", "/v1/tokens", `{"name": "CI", "scopes": ["stars:write"]}`},
+	} {
+		w := do(req.method, req.path, rickToken, req.body)
+		assert.Equal(t, http.StatusForbidden, w.Code, req.path)
+		assert.Contains(t, w.Body.String(), "you are banned until 2100-01-01T00:00:00Z: spam", req.path)
+	}
+	assert.Equal(t, http.StatusOK, do("GET", "/v1/stars", rickToken, "").Code)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/v1/sanctions/"+ban.Hex(), moderatorToken, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/v1/sanctions/"+ban.Hex(), moderatorToken, "").Code)
+	assert.Equal(t, http.StatusCreated, do("PUT", "/v1/stars", rickToken, star).Code)
+
+	// Muted users can still comment, but only they see their comments
+	require.Equal(t, http.StatusCreated, do("POST", "/v1/comments/stable/wordpress", moderatorToken, `{"text": "Welcome"}`).Code)
+	sanctionUser(`{"user_id": "` + rick.ID.Hex() + `", "kind": "mute"}`)
+	require.Equal(t, http.StatusCreated, do("POST", "/v1/comments/stable/wordpress", rickToken, `{"text": "Buy now"}`).Code)
+	assert.Len(t, comments(""), 1)
+	assert.Len(t, comments(moderatorToken), 1)
+	assert.Len(t, comments(rickToken), 2)
+	w := do("GET", "/v1/feeds/comments/stable/wordpress.atom", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Welcome")
+	assert.NotContains(t, w.Body.String(), "Buy now")
+	w = do("GET", "/v1/repos/stable/stats", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"comments_count":1`)
+
+	w = do("GET", "/v1/sanctions", moderatorToken, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Data []sanction `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, sanctionMute, list.Data[0].Kind)
+}
+
+func TestSanctionsOfModerators(t *testing.T) {
+	store = newMemoryStore()
+	defer useSanctions()()
+	oldVerifier := jwtVerifier
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	defer func() { jwtVerifier = oldVerifier }()
+	r := newRouter()
+
+	admin := testClaims(&User{ID: bson.NewObjectId(), Name: "Admin"})
+	admin.Roles = []string{"admin"}
+	adminToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", admin)
+	moderator := &User{ID: bson.NewObjectId(), Name: "Moderator"}
+	moderatorToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(moderator))
+	other := &User{ID: bson.NewObjectId(), Name: "Other Moderator"}
+	otherToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", testClaims(other))
+	setAssignedRoles(roleAssignments{admin.User.ID: roleAdmin, moderator.ID: roleModerator, other.ID: roleModerator})
+	defer setAssignedRoles(nil)
+	rick := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	ban := func(token string, u *User) *httptest.ResponseRecorder {
+		return do("POST", "/v1/sanctions", token, `{"user_id": "`+u.ID.Hex()+`", "kind": "ban"}`)
+	}
+
+	// Moderators can't sanction themselves or their peers
+	for _, u := range []*User{moderator, other} {
+		w := ban(moderatorToken, u)
+		assert.Equal(t, http.StatusForbidden, w.Code, u.Name)
+		assert.Contains(t, w.Body.String(), "cannot sanction yourself or users with the same role or a higher one", u.Name)
+	}
+	assert.Equal(t, http.StatusForbidden, ban(moderatorToken, admin.User).Code)
+
+	// Moderators can lift the sanctions of their peers, but not those of admins
+	w := ban(moderatorToken, rick)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/v1/sanctions/"+sanctionID(t, w).Hex(), otherToken, "").Code)
+	w = ban(adminToken, rick)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = do("DELETE", "/v1/sanctions/"+sanctionID(t, w).Hex(), otherToken, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "requires the admin role")
+
+	// Banned moderators can't write anything, moderating included
+	w = ban(adminToken, moderator)
+	require.Equal(t, http.StatusCreated, w.Code)
+	moderatorBan := sanctionID(t, w)
+	assert.Equal(t, http.StatusForbidden, do("POST", "/v1/comments/stable/wordpress", moderatorToken, `{"text": "Hello"}`).Code)
+	assert.Equal(t, http.StatusForbidden, ban(moderatorToken, rick).Code)
+	assert.Equal(t, http.StatusForbidden, do("DELETE", "/v1/sanctions/"+moderatorBan.Hex(), moderatorToken, "").Code)
+	assert.Equal(t, http.StatusForbidden, do("DELETE", "/v1/sanctions/"+moderatorBan.Hex(), otherToken, "").Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/v1/sanctions/"+moderatorBan.Hex(), adminToken, "").Code)
+}
+
+func TestSanctionsOfTokenModerators(t *testing.T) {
+	store = newMemoryStore()
+	defer useSanctions()()
+	oldVerifier := jwtVerifier
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	defer func() { jwtVerifier = oldVerifier }()
+	r := newRouter()
+
+	// Only the tokens tell the roles of these moderators
+	moderator := testClaims(&User{ID: bson.NewObjectId(), Name: "Moderator"})
+	moderator.Roles = []string{"moderator"}
+	moderatorToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", moderator)
+	other := testClaims(&User{ID: bson.NewObjectId(), Name: "Other Moderator"})
+	other.Roles = []string{"moderator"}
+	otherToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", other)
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// The ban is lifted when the banned moderator writes
+	for _, kind := range []string{sanctionBan, sanctionMute} {
+		w := do("POST", "/v1/sanctions", otherToken, `{"user_id": "`+moderator.User.ID.Hex()+`", "kind": "`+kind+`"}`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+	assert.Equal(t, http.StatusCreated, do("POST", "/v1/comments/stable/wordpress", moderatorToken, `{"text": "Hello"}`).Code)
+	list, err := store.ListSanctions(time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+// sanctionID returns the ID of the sanction created by the request
+func sanctionID(t *testing.T, w *httptest.ResponseRecorder) bson.ObjectId {
+	var created struct {
+		Data sanction `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	return created.Data.ID
+}
+
+func TestMutedCommentsBroadcast(t *testing.T) {
+	store = newMemoryStore()
+	defer useSanctions()()
+	muted, other := &User{ID: bson.NewObjectId()}, &User{ID: bson.NewObjectId()}
+	require.NoError(t, store.CreateSanction(sanction{ID: bson.NewObjectId(), UserID: muted.ID, Kind: sanctionMute}))
+
+	h := newHub(defaultHubConfig)
+	clients := map[string]*socketClient{
+		"author":    {room: "stable/wordpress", user: muted, send: make(chan commentEvent, 1)},
+		"other":     {room: "stable/wordpress", user: other, send: make(chan commentEvent, 1)},
+		"anonymous": {room: "stable/wordpress", send: make(chan commentEvent, 1)},
+	}
+	for _, c := range clients {
+		require.True(t, h.register(c))
+	}
+
+	h.broadcast("stable/wordpress", commentEvent{Type: eventCreated, Comment: &comment{Text: "Buy now", Author: muted}})
+	assert.Len(t, clients["author"].send, 1)
+	assert.Len(t, clients["other"].send, 0)
+	assert.Len(t, clients["anonymous"].send, 0)
+
+	<-clients["author"].send
+	h.broadcast("stable/wordpress", commentEvent{Type: eventCreated, Comment: &comment{Text: "Hello", Author: other}})
+	for name, c := range clients {
+		assert.Len(t, c.send, 1, name)
+	}
+}
+
+func TestCommentsSocketRejectsBannedUsers(t *testing.T) {
+	store = newMemoryStore()
+	defer useSanctions()()
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	require.NoError(t, store.CreateSanction(sanction{ID: bson.NewObjectId(), UserID: currentUser.ID, Kind: sanctionBan}))
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	ts, cleanup := newSocketServer(t, defaultHubConfig)
+	defer cleanup()
+	conn, _, err := dialSocket(t, ts)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "create", "text": "Hello"}))
+	ev := readEvent(t, conn)
+	assert.Equal(t, eventError, ev.Type)
+	assert.Equal(t, "you are banned", ev.Message)
+	_, err = store.GetItem("stable/wordpress")
+	assert.Equal(t, errNotFound, err)
+}
@@ -0,0 +1,804 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	// Registers the postgres driver
+	_ "github.com/lib/pq"
+	// Registers the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlDialect holds what differs between the supported SQL databases
+type sqlDialect struct {
+	driver string
+	// Column type of timestamps
+	timestamp string
+	// Statement run before migrating, in the migration transaction, so that
+	// concurrent instances don't migrate at the same time
+	lock string
+	// Whether the bind variables are $1, $2... instead of ?
+	numberedParams bool
+}
+
+var (
+	sqliteDialect   = sqlDialect{driver: "sqlite3", timestamp: "TIMESTAMP"}
+	postgresDialect = sqlDialect{driver: "postgres", timestamp: "TIMESTAMPTZ", lock: "LOCK TABLE schema_migrations IN EXCLUSIVE MODE", numberedParams: true}
+)
+
+// rebind replaces the ? bind variables of the query by the dialect's ones
+func (d sqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlMigrations are the schema changes applied in order on start-up, each
+// recorded in the schema_migrations table. {{timestamp}} is replaced by the
+// dialect's timestamp type. Never edit a released migration, add a new one.
+var sqlMigrations = []string{
+	`CREATE TABLE items (
+		id TEXT PRIMARY KEY,
+		type TEXT NOT NULL DEFAULT '',
+		alias_of TEXT REFERENCES items (id)
+	);
+	CREATE TABLE stars (
+		item_id TEXT NOT NULL REFERENCES items (id),
+		user_id TEXT NOT NULL,
+		version TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (item_id, user_id)
+	);
+	CREATE TABLE comments (
+		id TEXT PRIMARY KEY,
+		item_id TEXT NOT NULL REFERENCES items (id),
+		text TEXT NOT NULL,
+		version TEXT NOT NULL DEFAULT '',
+		created_at {{timestamp}} NOT NULL,
+		updated_at {{timestamp}},
+		author_id TEXT,
+		author_name TEXT NOT NULL DEFAULT '',
+		author_email TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX comments_item_id ON comments (item_id, created_at)`,
+	`CREATE INDEX stars_user_id ON stars (user_id);
+	CREATE INDEX items_type ON items (type)`,
+	`CREATE TABLE api_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		user_name TEXT NOT NULL DEFAULT '',
+		user_email TEXT NOT NULL DEFAULT '',
+		hash TEXT NOT NULL UNIQUE,
+		created_at {{timestamp}} NOT NULL,
+		last_used_at {{timestamp}}
+	);
+	CREATE INDEX api_tokens_user_id ON api_tokens (user_id, created_at)`,
+	`CREATE TABLE revocations (
+		id TEXT PRIMARY KEY,
+		token_id TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL DEFAULT '',
+		issued_before {{timestamp}},
+		expires_at {{timestamp}},
+		reason TEXT NOT NULL DEFAULT '',
+		revoked_by TEXT NOT NULL,
+		created_at {{timestamp}} NOT NULL
+	)`,
+	`CREATE TABLE sanctions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		expires_at {{timestamp}},
+		created_by TEXT NOT NULL,
+		created_at {{timestamp}} NOT NULL
+	)`,
+	`ALTER TABLE sanctions ADD COLUMN creator_role TEXT NOT NULL DEFAULT ''`,
+}
+
+// sqlStore stores items, stars and comments in their own tables of a SQLite
+// or PostgreSQL database
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// newSQLiteStore opens the SQLite database at path, creating it if needed
+func newSQLiteStore(path string) (*sqlStore, error) {
+	db, err := sql.Open(sqliteDialect.driver, "file:"+path+"?_foreign_keys=1&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer, and every connection to an
+	// in-memory database gets its own database
+	db.SetMaxOpenConns(1)
+	return newSQLStore(db, sqliteDialect)
+}
+
+// newPostgresStore connects to the PostgreSQL database at url
+func newPostgresStore(url string) (*sqlStore, error) {
+	db, err := sql.Open(postgresDialect.driver, url)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, postgresDialect)
+}
+
+func newSQLStore(db *sql.DB, dialect sqlDialect) (*sqlStore, error) {
+	s := &sqlStore{db: db, dialect: dialect}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate the database: %v", err)
+	}
+	return s, nil
+}
+
+// migrate applies the pending schema migrations
+func (s *sqlStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		if s.dialect.lock != "" {
+			if _, err := tx.Exec(s.dialect.lock); err != nil {
+				return err
+			}
+		}
+		var current int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+			return err
+		}
+		for i := current; i < len(sqlMigrations); i++ {
+			migration := strings.Replace(sqlMigrations[i], "{{timestamp}}", s.dialect.timestamp, -1)
+			// Not every driver supports several statements per Exec
+			for _, stmt := range strings.Split(migration, ";") {
+				if _, err := tx.Exec(stmt); err != nil {
+					return fmt.Errorf("migration %d: %v", i+1, err)
+				}
+			}
+			if _, err := s.exec(tx, `INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqlStore) exec(q querier, query string, args ...interface{}) (sql.Result, error) {
+	return q.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(q querier, query string, args ...interface{}) (*sql.Rows, error) {
+	return q.Query(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(q querier, query string, args ...interface{}) *sql.Row {
+	return q.QueryRow(s.dialect.rebind(query), args...)
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds
+func (s *sqlStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// getItem fetches the item with its stars and comments, following aliases
+// if follow is true
+func (s *sqlStore) getItem(q querier, id string, follow bool) (*item, error) {
+	it := &item{}
+	for i := 0; ; i++ {
+		if i == maxAliasHops {
+			return nil, fmt.Errorf("too many aliases resolving item %q", id)
+		}
+		var aliasOf sql.NullString
+		err := s.queryRow(q, `SELECT id, type, alias_of FROM items WHERE id = ?`, id).Scan(&it.ID, &it.Type, &aliasOf)
+		if err == sql.ErrNoRows {
+			return nil, errNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		it.AliasOf = aliasOf.String
+		if !follow || it.AliasOf == "" {
+			break
+		}
+		id = it.AliasOf
+	}
+
+	items, err := s.loadRelations(q, []*item{it}, `item_id = ?`, it.ID)
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// loadRelations fills the stars and comments of the items, which must be
+// all the items whose ID matches the where clause
+func (s *sqlStore) loadRelations(q querier, items []*item, where string, args ...interface{}) ([]*item, error) {
+	byID := map[string]*item{}
+	for _, it := range items {
+		byID[it.ID] = it
+	}
+
+	rows, err := s.query(q, `SELECT item_id, user_id, version FROM stars WHERE `+where+` ORDER BY item_id, user_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var itemID, userID, version string
+		if err := rows.Scan(&itemID, &userID, &version); err != nil {
+			return nil, err
+		}
+		it, ok := byID[itemID]
+		if !ok {
+			continue
+		}
+		it.StargazersIDs = append(it.StargazersIDs, bson.ObjectIdHex(userID))
+		if version != "" {
+			setStargazerVersion(it, bson.ObjectIdHex(userID), version)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.query(q, `SELECT item_id, id, text, version, created_at, updated_at, author_id, author_name, author_email
+		FROM comments WHERE `+where+` ORDER BY item_id, created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var itemID, commentID string
+		var cm comment
+		var updatedAt sql.NullTime
+		var authorID sql.NullString
+		var author User
+		if err := rows.Scan(&itemID, &commentID, &cm.Text, &cm.Version, &cm.CreatedAt, &updatedAt, &authorID, &author.Name, &author.Email); err != nil {
+			return nil, err
+		}
+		it, ok := byID[itemID]
+		if !ok {
+			continue
+		}
+		cm.ID = bson.ObjectIdHex(commentID)
+		if updatedAt.Valid {
+			cm.UpdatedAt = &updatedAt.Time
+		}
+		if authorID.Valid {
+			author.ID = bson.ObjectIdHex(authorID.String)
+			cm.Author = &author
+		}
+		it.Comments = append(it.Comments, cm)
+	}
+	return items, rows.Err()
+}
+
+func (s *sqlStore) GetItem(id string) (*item, error) {
+	return s.getItem(s.db, id, true)
+}
+
+// chartClause matches the charts in the items table, including those stored
+// before item types
+const chartClause = `type IN ('chart', '')`
+
+// repoClause returns the where clause matching the items of the repo, or
+// every item if the repo is empty
+func repoClause(repo string) (string, []interface{}) {
+	if repo == "" {
+		return `1 = 1`, nil
+	}
+	// LIKE would treat the _ of IDs as a wildcard
+	prefix := repo + "/"
+	return `substr(item_id, 1, ?) = ?`, []interface{}{len(prefix), prefix}
+}
+
+func (s *sqlStore) ListItems(repo string) ([]*item, error) {
+	where, args := repoClause(repo)
+	items := []*item{}
+	err := s.inTx(func(tx *sql.Tx) error {
+		itemsWhere := strings.Replace(where, "item_id", "id", -1)
+		if repo != "" {
+			itemsWhere += ` AND ` + chartClause
+		}
+		rows, err := s.query(tx, `SELECT id, type FROM items WHERE alias_of IS NULL AND `+itemsWhere+` ORDER BY id`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			it := &item{}
+			if err := rows.Scan(&it.ID, &it.Type); err != nil {
+				return err
+			}
+			items = append(items, it)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		items, err = s.loadRelations(tx, items, where, args...)
+		return err
+	})
+	return items, err
+}
+
+func (s *sqlStore) ListAliases() (map[string]string, error) {
+	rows, err := s.query(s.db, `SELECT id, alias_of FROM items WHERE alias_of IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := map[string]string{}
+	for rows.Next() {
+		var id, aliasOf string
+		if err := rows.Scan(&id, &aliasOf); err != nil {
+			return nil, err
+		}
+		aliases[id] = aliasOf
+	}
+	return aliases, rows.Err()
+}
+
+// insertItem inserts the item row together with its stars and comments
+func (s *sqlStore) insertItem(q querier, it *item) error {
+	if _, err := s.exec(q, `INSERT INTO items (id, type) VALUES (?, ?)`, it.ID, it.Type); err != nil {
+		return err
+	}
+	return s.insertRelations(q, it)
+}
+
+// insertRelations inserts the stars and comments of the item
+func (s *sqlStore) insertRelations(q querier, it *item) error {
+	for _, id := range it.StargazersIDs {
+		if _, err := s.exec(q, `INSERT INTO stars (item_id, user_id, version) VALUES (?, ?, ?)`, it.ID, id.Hex(), it.StargazerVersions[id.Hex()]); err != nil {
+			return err
+		}
+	}
+	for _, cm := range it.Comments {
+		if err := s.insertComment(q, it.ID, cm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) insertComment(q querier, itemID string, cm comment) error {
+	var updatedAt sql.NullTime
+	if cm.UpdatedAt != nil {
+		updatedAt = sql.NullTime{Time: *cm.UpdatedAt, Valid: true}
+	}
+	var authorID sql.NullString
+	var author User
+	if cm.Author != nil {
+		author = *cm.Author
+		authorID = sql.NullString{String: author.ID.Hex(), Valid: true}
+	}
+	_, err := s.exec(q, `INSERT INTO comments (id, item_id, text, version, created_at, updated_at, author_id, author_name, author_email)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cm.ID.Hex(), itemID, cm.Text, cm.Version, cm.CreatedAt, updatedAt, authorID, author.Name, author.Email)
+	return err
+}
+
+func (s *sqlStore) CreateItem(it item) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return s.insertItem(tx, &it)
+	})
+}
+
+// upsertItemRow creates the item if it doesn't exist and returns its ID,
+// following aliases
+func (s *sqlStore) upsertItemRow(q querier, id, itemType string) (string, error) {
+	if _, err := s.exec(q, `INSERT INTO items (id, type) VALUES (?, ?) ON CONFLICT (id) DO NOTHING`, id, itemType); err != nil {
+		return "", err
+	}
+	for i := 0; i < maxAliasHops; i++ {
+		var aliasOf sql.NullString
+		if err := s.queryRow(q, `SELECT alias_of FROM items WHERE id = ?`, id).Scan(&aliasOf); err != nil {
+			return "", err
+		}
+		if !aliasOf.Valid {
+			return id, nil
+		}
+		id = aliasOf.String
+	}
+	return "", fmt.Errorf("too many aliases resolving item %q", id)
+}
+
+func (s *sqlStore) AddStar(itemID, itemType string, userID bson.ObjectId, version string) (*item, bool, error) {
+	var it *item
+	var changed bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		id, err := s.upsertItemRow(tx, itemID, itemType)
+		if err != nil {
+			return err
+		}
+		// Concurrent inserts of the same star wait for each other, so only
+		// one of them changes a row
+		res, err := s.exec(tx, `INSERT INTO stars (item_id, user_id, version) VALUES (?, ?, ?)
+			ON CONFLICT (item_id, user_id) DO NOTHING`, id, userID.Hex(), version)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		changed = n > 0
+		if !changed && version != "" {
+			if _, err := s.exec(tx, `UPDATE stars SET version = ? WHERE item_id = ? AND user_id = ?`, version, id, userID.Hex()); err != nil {
+				return err
+			}
+		}
+		it, err = s.getItem(tx, id, false)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return it, changed, nil
+}
+
+func (s *sqlStore) RemoveStar(itemID, itemType string, userID bson.ObjectId) (*item, bool, error) {
+	var it *item
+	var changed bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		id, err := s.upsertItemRow(tx, itemID, itemType)
+		if err != nil {
+			return err
+		}
+		res, err := s.exec(tx, `DELETE FROM stars WHERE item_id = ? AND user_id = ?`, id, userID.Hex())
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		changed = n > 0
+		it, err = s.getItem(tx, id, false)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return it, changed, nil
+}
+
+func (s *sqlStore) AddComment(itemID, itemType string, cm comment) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		id, err := s.upsertItemRow(tx, itemID, itemType)
+		if err != nil {
+			return err
+		}
+		return s.insertComment(tx, id, cm)
+	})
+}
+
+// checkAffected fails with errNotFound if the statement changed no rows
+func checkAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdateComment(itemID string, commentID bson.ObjectId, text string, updatedAt time.Time) error {
+	return checkAffected(s.exec(s.db, `UPDATE comments SET text = ?, updated_at = ? WHERE item_id = ? AND id = ?`, text, updatedAt, itemID, commentID.Hex()))
+}
+
+func (s *sqlStore) DeleteComment(itemID string, commentID bson.ObjectId) error {
+	return checkAffected(s.exec(s.db, `DELETE FROM comments WHERE item_id = ? AND id = ?`, itemID, commentID.Hex()))
+}
+
+// itemStats returns the counts of the charts of the repo, or of every chart
+// if the repo is empty, not counting the comments of the hidden authors
+func (s *sqlStore) itemStats(repo string, hiddenAuthors []bson.ObjectId) ([]itemStats, error) {
+	where, repoArgs := repoClause(repo)
+	where = strings.Replace(where, "item_id", "i.id", -1)
+	var args []interface{}
+	commentsWhere := `c.item_id = i.id`
+	if len(hiddenAuthors) > 0 {
+		placeholders := make([]string, len(hiddenAuthors))
+		for i, id := range hiddenAuthors {
+			placeholders[i] = "?"
+			args = append(args, id.Hex())
+		}
+		commentsWhere += ` AND (c.author_id IS NULL OR c.author_id NOT IN (` + strings.Join(placeholders, ", ") + `))`
+	}
+	args = append(args, repoArgs...)
+	rows, err := s.query(s.db, `SELECT i.id,
+			(SELECT COUNT(*) FROM stars s WHERE s.item_id = i.id),
+			(SELECT COUNT(*) FROM comments c WHERE `+commentsWhere+`)
+		FROM items i WHERE i.alias_of IS NULL AND i.`+chartClause+` AND `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []itemStats
+	for rows.Next() {
+		var st itemStats
+		if err := rows.Scan(&st.ID, &st.StargazersCount, &st.CommentsCount); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+func (s *sqlStore) ListRepos(hiddenAuthors []bson.ObjectId) ([]repoStats, error) {
+	stats, err := s.itemStats("", hiddenAuthors)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateRepos(stats), nil
+}
+
+func (s *sqlStore) GetRepoStats(repo string, limit int, hiddenAuthors []bson.ObjectId) (*repoStats, error) {
+	stats, err := s.itemStats(repo, hiddenAuthors)
+	if err != nil {
+		return nil, err
+	}
+	rs := aggregateRepoStats(repo, stats, limit)
+	if rs == nil {
+		return nil, errNotFound
+	}
+	return rs, nil
+}
+
+func (s *sqlStore) MergeItems(fromID, toID string) (*item, error) {
+	if fromID == toID {
+		return nil, errMergeIntoItself
+	}
+
+	var to *item
+	err := s.inTx(func(tx *sql.Tx) error {
+		from, err := s.getItem(tx, fromID, false)
+		if err != nil {
+			return fmt.Errorf("could not find item %q: %v", fromID, err)
+		}
+
+		exists := true
+		to, err = s.getItem(tx, toID, true)
+		if err != nil {
+			exists = false
+			to = &item{ID: toID, Type: from.Type}
+		}
+		if err := mergeInto(from, to); err != nil {
+			return err
+		}
+
+		// The stars and comments of both items are rewritten under the target
+		for _, id := range []string{fromID, to.ID} {
+			if _, err := s.exec(tx, `DELETE FROM stars WHERE item_id = ?`, id); err != nil {
+				return err
+			}
+			if _, err := s.exec(tx, `DELETE FROM comments WHERE item_id = ?`, id); err != nil {
+				return err
+			}
+		}
+		if exists {
+			err = s.insertRelations(tx, to)
+		} else {
+			err = s.insertItem(tx, to)
+		}
+		if err != nil {
+			return fmt.Errorf("could not update item %q: %v", to.ID, err)
+		}
+
+		if _, err := s.exec(tx, `UPDATE items SET alias_of = ? WHERE id = ?`, to.ID, fromID); err != nil {
+			return fmt.Errorf("could not turn %q into an alias: %v", fromID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return to, nil
+}
+
+func (s *sqlStore) CreateAPIToken(t apiToken) error {
+	_, err := s.exec(s.db, `INSERT INTO api_tokens (id, name, scopes, user_id, user_name, user_email, hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID.Hex(), t.Name, strings.Join(t.Scopes, " "), t.User.ID.Hex(), t.User.Name, t.User.Email, t.Hash, t.CreatedAt)
+	return err
+}
+
+// scanAPIToken reads a row of apiTokenColumns
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (*apiToken, error) {
+	var id, scopes, userID string
+	var lastUsedAt sql.NullTime
+	t := &apiToken{User: &User{}}
+	if err := row.Scan(&id, &t.Name, &scopes, &userID, &t.User.Name, &t.User.Email, &t.Hash, &t.CreatedAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	t.ID = bson.ObjectIdHex(id)
+	t.User.ID = bson.ObjectIdHex(userID)
+	t.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return t, nil
+}
+
+const apiTokenColumns = `id, name, scopes, user_id, user_name, user_email, hash, created_at, last_used_at`
+
+func (s *sqlStore) ListAPITokens(userID bson.ObjectId) ([]*apiToken, error) {
+	where, args := `user_id = ?`, []interface{}{userID.Hex()}
+	if userID == "" {
+		where, args = `1 = 1`, nil
+	}
+	rows, err := s.query(s.db, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE `+where+` ORDER BY created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []*apiToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *sqlStore) FindAPIToken(hash string) (*apiToken, error) {
+	t, err := scanAPIToken(s.queryRow(s.db, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return t, err
+}
+
+func (s *sqlStore) DeleteAPIToken(userID, id bson.ObjectId) error {
+	return checkAffected(s.exec(s.db, `DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id.Hex(), userID.Hex()))
+}
+
+func (s *sqlStore) TouchAPIToken(id bson.ObjectId, usedAt time.Time) error {
+	return checkAffected(s.exec(s.db, `UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, usedAt, id.Hex()))
+}
+
+func (s *sqlStore) CreateRevocation(r revocation) error {
+	var userID string
+	if r.UserID != "" {
+		userID = r.UserID.Hex()
+	}
+	_, err := s.exec(s.db, `INSERT INTO revocations (id, token_id, user_id, issued_before, expires_at, reason, revoked_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID.Hex(), r.TokenID, userID, r.IssuedBefore, r.ExpiresAt, r.Reason, r.RevokedBy.Hex(), r.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) ListRevocations(now time.Time) ([]*revocation, error) {
+	rows, err := s.query(s.db, `SELECT id, token_id, user_id, issued_before, expires_at, reason, revoked_by, created_at
+		FROM revocations WHERE expires_at IS NULL OR expires_at > ? ORDER BY created_at, id`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*revocation
+	for rows.Next() {
+		var id, userID, revokedBy string
+		var issuedBefore, expiresAt sql.NullTime
+		r := &revocation{}
+		if err := rows.Scan(&id, &r.TokenID, &userID, &issuedBefore, &expiresAt, &r.Reason, &revokedBy, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.ID = bson.ObjectIdHex(id)
+		if userID != "" {
+			r.UserID = bson.ObjectIdHex(userID)
+		}
+		r.RevokedBy = bson.ObjectIdHex(revokedBy)
+		if issuedBefore.Valid {
+			r.IssuedBefore = &issuedBefore.Time
+		}
+		if expiresAt.Valid {
+			r.ExpiresAt = &expiresAt.Time
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) DeleteRevocation(id bson.ObjectId) error {
+	return checkAffected(s.exec(s.db, `DELETE FROM revocations WHERE id = ?`, id.Hex()))
+}
+
+func (s *sqlStore) CreateSanction(sn sanction) error {
+	_, err := s.exec(s.db, `INSERT INTO sanctions (id, user_id, kind, reason, expires_at, created_by, creator_role, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sn.ID.Hex(), sn.UserID.Hex(), sn.Kind, sn.Reason, sn.ExpiresAt, sn.CreatedBy.Hex(), sn.CreatorRole, sn.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) ListSanctions(now time.Time) ([]*sanction, error) {
+	rows, err := s.query(s.db, `SELECT id, user_id, kind, reason, expires_at, created_by, creator_role, created_at
+		FROM sanctions WHERE expires_at IS NULL OR expires_at > ? ORDER BY created_at, id`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*sanction
+	for rows.Next() {
+		var id, userID, createdBy string
+		var expiresAt sql.NullTime
+		sn := &sanction{}
+		if err := rows.Scan(&id, &userID, &sn.Kind, &sn.Reason, &expiresAt, &createdBy, &sn.CreatorRole, &sn.CreatedAt); err != nil {
+			return nil, err
+		}
+		sn.ID = bson.ObjectIdHex(id)
+		sn.UserID = bson.ObjectIdHex(userID)
+		sn.CreatedBy = bson.ObjectIdHex(createdBy)
+		if expiresAt.Valid {
+			sn.ExpiresAt = &expiresAt.Time
+		}
+		list = append(list, sn)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) DeleteSanction(id bson.ObjectId) error {
+	return checkAffected(s.exec(s.db, `DELETE FROM sanctions WHERE id = ?`, id.Hex()))
+}
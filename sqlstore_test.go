@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLiteStore(t *testing.T) *sqlStore {
+	s, err := newSQLiteStore(":memory:")
+	require.NoError(t, err)
+	return s
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return newTestSQLiteStore(t) })
+}
+
+// TestPostgresStore runs against the database in RATESVC_TEST_POSTGRES_URL,
+// which is emptied before each test
+func TestPostgresStore(t *testing.T) {
+	url := os.Getenv("RATESVC_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("RATESVC_TEST_POSTGRES_URL not set")
+	}
+	testStore(t, func(t *testing.T) Store {
+		s, err := newPostgresStore(url)
+		require.NoError(t, err)
+		_, err = s.db.Exec(`TRUNCATE items, stars, comments`)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestSQLStoreMigrationsAreApplied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratesvc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ratesvc.db")
+	s, err := newSQLiteStore(path)
+	require.NoError(t, err)
+	require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart", StargazersIDs: []bson.ObjectId{bson.NewObjectId()}}))
+	s.Close()
+
+	// Reopening the database doesn't apply the migrations again
+	s, err = newSQLiteStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+	var version int
+	require.NoError(t, s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, len(sqlMigrations), version)
+	it, err := s.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	assert.Len(t, it.StargazersIDs, 1)
+}
+
+func TestSQLStoreRepoPrefixIsLiteral(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	require.NoError(t, s.CreateItem(item{ID: "my_repo/foo", Type: "chart"}))
+	require.NoError(t, s.CreateItem(item{ID: "myxrepo/foo", Type: "chart"}))
+
+	items, err := s.ListItems("my_repo")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "my_repo/foo", items[0].ID)
+}
+
+func Test_sqlDialectRebind(t *testing.T) {
+	query := `SELECT id FROM items WHERE id = ? AND type = ?`
+	assert.Equal(t, query, sqliteDialect.rebind(query))
+	assert.Equal(t, `SELECT id FROM items WHERE id = $1 AND type = $2`, postgresDialect.rebind(query))
+}
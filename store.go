@@ -0,0 +1,198 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+)
+
+// errNotFound is returned by stores when an item or comment doesn't exist
+var errNotFound = errors.New("not found")
+
+// Store persists items together with their stars and comments. Handlers are
+// responsible for validation and authorization, stores only for the data.
+type Store interface {
+	// GetItem returns the item with the given ID, following the aliases left
+	// by merged items
+	GetItem(id string) (*item, error)
+	// ListItems returns the items that haven't been merged into another one,
+	// only those of the given repo if it isn't empty
+	ListItems(repo string) ([]*item, error)
+	// ListAliases returns the IDs of the merged items mapped to the ID of the
+	// item each one was merged into
+	ListAliases() (map[string]string, error)
+	// CreateItem stores a new item
+	CreateItem(it item) error
+	// AddStar atomically adds the user to the Stargazers of the item,
+	// recording the starred version if not empty. The item is created with
+	// the given type if it doesn't exist. It returns the updated item and
+	// whether the user wasn't a Stargazer before.
+	AddStar(itemID, itemType string, userID bson.ObjectId, version string) (*item, bool, error)
+	// RemoveStar atomically removes the user from the Stargazers of the item,
+	// creating it like AddStar. It returns the updated item and whether the
+	// user was a Stargazer before.
+	RemoveStar(itemID, itemType string, userID bson.ObjectId) (*item, bool, error)
+	// AddComment atomically appends a comment to the item, creating it like
+	// AddStar
+	AddComment(itemID, itemType string, cm comment) error
+	// UpdateComment replaces the text of a comment
+	UpdateComment(itemID string, commentID bson.ObjectId, text string, updatedAt time.Time) error
+	// DeleteComment removes a comment from the item
+	DeleteComment(itemID string, commentID bson.ObjectId) error
+	// ListRepos returns the aggregate counts of every repo, not counting the
+	// comments of the hidden authors
+	ListRepos(hiddenAuthors []bson.ObjectId) ([]repoStats, error)
+	// GetRepoStats returns the aggregate counts of a repo with its top limit
+	// most starred and most discussed items, not counting the comments of the
+	// hidden authors
+	GetRepoStats(repo string, limit int, hiddenAuthors []bson.ObjectId) (*repoStats, error)
+	// MergeItems moves the stars and comments of the item fromID into the
+	// item toID, creating it if needed, and turns fromID into an alias of toID
+	MergeItems(fromID, toID string) (*item, error)
+	// CreateAPIToken stores a new API token
+	CreateAPIToken(t apiToken) error
+	// ListAPITokens returns the API tokens of the user, or of every user if
+	// userID is empty, oldest first
+	ListAPITokens(userID bson.ObjectId) ([]*apiToken, error)
+	// FindAPIToken returns the API token with the given hash
+	FindAPIToken(hash string) (*apiToken, error)
+	// DeleteAPIToken removes an API token of the user
+	DeleteAPIToken(userID, id bson.ObjectId) error
+	// TouchAPIToken records when the API token was last used
+	TouchAPIToken(id bson.ObjectId, usedAt time.Time) error
+	// CreateRevocation stores a new token revocation
+	CreateRevocation(r revocation) error
+	// ListRevocations returns the revocations that haven't lapsed at now,
+	// oldest first
+	ListRevocations(now time.Time) ([]*revocation, error)
+	// DeleteRevocation removes a revocation
+	DeleteRevocation(id bson.ObjectId) error
+	// CreateSanction stores a new ban or mute
+	CreateSanction(s sanction) error
+	// ListSanctions returns the sanctions that haven't lapsed at now, oldest
+	// first
+	ListSanctions(now time.Time) ([]*sanction, error)
+	// DeleteSanction removes a sanction
+	DeleteSanction(id bson.ObjectId) error
+}
+
+// store is the storage backend used by the handlers
+var store Store
+
+// storeConfig holds the settings of every storage backend
+type storeConfig struct {
+	mongo       datastore.Config
+	sqlitePath  string
+	postgresURL string
+	boltPath    string
+}
+
+// newStore returns the storage backend with the given name
+func newStore(name string, cfg storeConfig) (Store, error) {
+	switch name {
+	case "mongo":
+		session, err := datastore.NewSession(cfg.mongo)
+		if err != nil {
+			return nil, err
+		}
+		return newMongoStore(session), nil
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return newSQLiteStore(cfg.sqlitePath)
+	case "postgres":
+		return newPostgresStore(cfg.postgresURL)
+	case "bolt":
+		return newBoltStore(cfg.boltPath)
+	}
+	return nil, fmt.Errorf("unknown storage %q", name)
+}
+
+// The functions below apply changes to a whole item, for stores that read and
+// write items at once
+
+// addStargazer adds the user to the Stargazers of the item, recording the
+// starred version if not empty
+func addStargazer(it *item, userID bson.ObjectId, version string) {
+	if !hasStarred(it, &User{ID: userID}) {
+		it.StargazersIDs = append(it.StargazersIDs, userID)
+	}
+	if version != "" {
+		setStargazerVersion(it, userID, version)
+	}
+}
+
+func setStargazerVersion(it *item, userID bson.ObjectId, version string) {
+	if it.StargazerVersions == nil {
+		it.StargazerVersions = map[string]string{}
+	}
+	it.StargazerVersions[userID.Hex()] = canonicalVersion(version)
+}
+
+// removeStargazer removes the user from the Stargazers of the item
+func removeStargazer(it *item, userID bson.ObjectId) {
+	for i, id := range it.StargazersIDs {
+		if id == userID {
+			it.StargazersIDs = append(it.StargazersIDs[:i], it.StargazersIDs[i+1:]...)
+			break
+		}
+	}
+	delete(it.StargazerVersions, userID.Hex())
+}
+
+// editComment replaces the text of a comment of the item
+func editComment(it *item, commentID bson.ObjectId, text string, updatedAt time.Time) error {
+	for i := range it.Comments {
+		if it.Comments[i].ID == commentID {
+			it.Comments[i].Text = text
+			it.Comments[i].UpdatedAt = &updatedAt
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// removeComment removes a comment from the item
+func removeComment(it *item, commentID bson.ObjectId) error {
+	for i, cm := range it.Comments {
+		if cm.ID == commentID {
+			it.Comments = append(it.Comments[:i], it.Comments[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// sortByCreation sorts API tokens, revocations or sanctions from the oldest,
+// for stores that can't sort them. key returns the creation time and ID of
+// the i-th element of list.
+func sortByCreation(list interface{}, key func(i int) (time.Time, bson.ObjectId)) {
+	sort.Slice(list, func(i, j int) bool {
+		createdI, idI := key(i)
+		createdJ, idJ := key(j)
+		if !createdI.Equal(createdJ) {
+			return createdI.Before(createdJ)
+		}
+		return idI < idJ
+	})
+}
@@ -0,0 +1,558 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStore checks the behaviour shared by every Store implementation,
+// calling newStore to get an empty store for each test
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	author := &User{ID: alice, Name: "Alice", Email: "alice@example.com"}
+	day := func(d int) time.Time { return time.Date(2017, 11, d, 0, 0, 0, 0, time.UTC) }
+
+	t.Run("missing item", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.GetItem("stable/wordpress")
+		assert.Equal(t, errNotFound, err)
+		assert.Error(t, s.UpdateComment("stable/wordpress", bson.NewObjectId(), "Hello", day(1)))
+	})
+
+	t.Run("create item", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart", StargazersIDs: []bson.ObjectId{alice}}))
+		assert.Error(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart"}))
+
+		it, err := s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		assert.Equal(t, "chart", it.Type)
+		assert.Equal(t, []bson.ObjectId{alice}, it.StargazersIDs)
+	})
+
+	t.Run("stars", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart"}))
+		it, changed, err := s.AddStar("stable/wordpress", "chart", alice, "1.0.0")
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, []bson.ObjectId{alice}, it.StargazersIDs)
+		_, changed, err = s.AddStar("stable/wordpress", "chart", bob, "")
+		require.NoError(t, err)
+		assert.True(t, changed)
+		// Starring again only changes the version
+		it, changed, err = s.AddStar("stable/wordpress", "chart", alice, "2.0.0")
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.ElementsMatch(t, []bson.ObjectId{alice, bob}, it.StargazersIDs)
+		assert.Equal(t, map[string]string{alice.Hex(): "2.0.0"}, it.StargazerVersions)
+
+		it, err = s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []bson.ObjectId{alice, bob}, it.StargazersIDs)
+		assert.Equal(t, map[string]string{alice.Hex(): "2.0.0"}, it.StargazerVersions)
+
+		it, changed, err = s.RemoveStar("stable/wordpress", "chart", alice)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, []bson.ObjectId{bob}, it.StargazersIDs)
+		_, changed, err = s.RemoveStar("stable/wordpress", "chart", alice)
+		require.NoError(t, err)
+		assert.False(t, changed)
+
+		it, err = s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{bob}, it.StargazersIDs)
+		assert.Empty(t, it.StargazerVersions)
+	})
+
+	t.Run("stars create items", func(t *testing.T) {
+		s := newStore(t)
+		it, changed, err := s.AddStar("hello", "function", alice, "")
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, "function", it.Type)
+		_, _, err = s.RemoveStar("stable/wordpress", "chart", alice)
+		require.NoError(t, err)
+
+		it, err = s.GetItem("hello")
+		require.NoError(t, err)
+		assert.Equal(t, "function", it.Type)
+		assert.Equal(t, []bson.ObjectId{alice}, it.StargazersIDs)
+		it, err = s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		assert.Empty(t, it.StargazersIDs)
+	})
+
+	t.Run("concurrent stars", func(t *testing.T) {
+		s := newStore(t)
+		users := make([]bson.ObjectId, 10)
+		for i := range users {
+			users[i] = bson.NewObjectId()
+		}
+
+		// Every user stars the missing item several times at once
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		changes := map[bson.ObjectId]int{}
+		for i := 0; i < 5; i++ {
+			for _, u := range users {
+				wg.Add(1)
+				go func(u bson.ObjectId) {
+					defer wg.Done()
+					_, changed, err := s.AddStar("stable/wordpress", "chart", u, "")
+					assert.NoError(t, err)
+					if changed {
+						mu.Lock()
+						changes[u]++
+						mu.Unlock()
+					}
+				}(u)
+			}
+		}
+		wg.Wait()
+
+		it, err := s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, users, it.StargazersIDs, "no duplicate stars")
+		for _, u := range users {
+			assert.Equal(t, 1, changes[u], "only one star changed the item")
+		}
+
+		// Half of the users unstar while the others star again
+		counts := make(chan int, len(users))
+		for i, u := range users {
+			wg.Add(1)
+			go func(i int, u bson.ObjectId) {
+				defer wg.Done()
+				var it *item
+				var err error
+				if i%2 == 0 {
+					it, _, err = s.RemoveStar("stable/wordpress", "chart", u)
+				} else {
+					it, _, err = s.AddStar("stable/wordpress", "chart", u, "")
+				}
+				assert.NoError(t, err)
+				counts <- len(it.StargazersIDs)
+			}(i, u)
+		}
+		wg.Wait()
+		close(counts)
+
+		it, err = s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		assert.Len(t, it.StargazersIDs, len(users)/2)
+		// The returned counts are those right after each change
+		min := len(users)
+		for n := range counts {
+			if n < min {
+				min = n
+			}
+		}
+		assert.Equal(t, len(users)/2, min)
+	})
+
+	t.Run("comments", func(t *testing.T) {
+		s := newStore(t)
+		first := comment{ID: bson.NewObjectId(), Text: "First", CreatedAt: day(1), Author: author, Version: "1.0.0"}
+		second := comment{ID: bson.NewObjectId(), Text: "Second", CreatedAt: day(2), Author: author}
+		require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart", Comments: []comment{first}}))
+		require.NoError(t, s.AddComment("stable/wordpress", "chart", second))
+		require.NoError(t, s.UpdateComment("stable/wordpress", first.ID, "Edited", day(3)))
+		assert.Equal(t, errNotFound, s.UpdateComment("stable/wordpress", bson.NewObjectId(), "Edited", day(3)))
+
+		it, err := s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		require.Len(t, it.Comments, 2)
+		assert.Equal(t, "Edited", it.Comments[0].Text)
+		assert.Equal(t, "1.0.0", it.Comments[0].Version)
+		require.NotNil(t, it.Comments[0].UpdatedAt)
+		assert.True(t, day(3).Equal(*it.Comments[0].UpdatedAt))
+		assert.True(t, day(2).Equal(it.Comments[1].CreatedAt))
+		assert.Equal(t, alice, it.Comments[1].Author.ID)
+		assert.Equal(t, "alice@example.com", it.Comments[1].Author.Email)
+
+		require.NoError(t, s.DeleteComment("stable/wordpress", first.ID))
+		it, err = s.GetItem("stable/wordpress")
+		require.NoError(t, err)
+		require.Len(t, it.Comments, 1)
+		assert.Equal(t, second.ID, it.Comments[0].ID)
+	})
+
+	t.Run("concurrent first comments", func(t *testing.T) {
+		s := newStore(t)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				cm := comment{ID: bson.NewObjectId(), Text: "Hello", CreatedAt: day(i + 1), Author: author}
+				assert.NoError(t, s.AddComment(itemKey("function", "hello"), "function", cm))
+			}(i)
+		}
+		wg.Wait()
+
+		it, err := s.GetItem(itemKey("function", "hello"))
+		require.NoError(t, err)
+		assert.Equal(t, "function", it.Type)
+		assert.Len(t, it.Comments, 10)
+	})
+
+	t.Run("list items and repos", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart", StargazersIDs: []bson.ObjectId{alice, bob}}))
+		spammer := &User{ID: bson.NewObjectId(), Name: "Spammer"}
+		require.NoError(t, s.CreateItem(item{ID: "stable/drupal", Type: "chart", StargazersIDs: []bson.ObjectId{alice},
+			Comments: []comment{{ID: bson.NewObjectId(), Text: "Hello", CreatedAt: day(1), Author: author}}}))
+		require.NoError(t, s.CreateItem(item{ID: "incubator/ghost", Type: "chart",
+			Comments: []comment{{ID: bson.NewObjectId(), Text: "Buy now", CreatedAt: day(1), Author: spammer}}}))
+		// Functions don't belong to chart repos
+		require.NoError(t, s.CreateItem(item{ID: itemKey("function", "stable/hello"), Type: "function", StargazersIDs: []bson.ObjectId{bob},
+			Comments: []comment{{ID: bson.NewObjectId(), Text: "Hello", CreatedAt: day(2), Author: author}}}))
+
+		items, err := s.ListItems("")
+		require.NoError(t, err)
+		assert.Len(t, items, 4)
+		items, err = s.ListItems("stable")
+		require.NoError(t, err)
+		assert.Len(t, items, 2)
+
+		repos, err := s.ListRepos(nil)
+		require.NoError(t, err)
+		assert.Equal(t, []repoStats{
+			{Name: "incubator", ItemsCount: 1, CommentsCount: 1},
+			{Name: "stable", ItemsCount: 2, StargazersCount: 3, CommentsCount: 1},
+		}, repos)
+		// The comments of hidden authors aren't counted
+		repos, err = s.ListRepos([]bson.ObjectId{spammer.ID})
+		require.NoError(t, err)
+		assert.Equal(t, []repoStats{
+			{Name: "incubator", ItemsCount: 1},
+			{Name: "stable", ItemsCount: 2, StargazersCount: 3, CommentsCount: 1},
+		}, repos)
+
+		stats, err := s.GetRepoStats("stable", 1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, &repoStats{
+			Name: "stable", ItemsCount: 2, StargazersCount: 3, CommentsCount: 1,
+			MostStarred:   []itemStats{{ID: "stable/wordpress", StargazersCount: 2}},
+			MostDiscussed: []itemStats{{ID: "stable/drupal", StargazersCount: 1, CommentsCount: 1}},
+		}, stats)
+		stats, err = s.GetRepoStats("incubator", 5, []bson.ObjectId{spammer.ID})
+		require.NoError(t, err)
+		assert.Equal(t, &repoStats{Name: "incubator", ItemsCount: 1}, stats)
+
+		_, err = s.GetRepoStats("unknown", 5, nil)
+		assert.Equal(t, errNotFound, err)
+	})
+
+	t.Run("merge items", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.CreateItem(item{ID: "incubator/foo", Type: "chart", StargazersIDs: []bson.ObjectId{alice, bob},
+			StargazerVersions: map[string]string{alice.Hex(): "1.0.0"},
+			Comments:          []comment{{ID: bson.NewObjectId(), Text: "second", CreatedAt: day(2), Author: author}}}))
+		require.NoError(t, s.CreateItem(item{ID: "stable/foo", Type: "chart", StargazersIDs: []bson.ObjectId{bob},
+			Comments: []comment{{ID: bson.NewObjectId(), Text: "first", CreatedAt: day(1), Author: author}}}))
+
+		_, err := s.MergeItems("incubator/foo", "incubator/foo")
+		assert.Error(t, err)
+
+		merged, err := s.MergeItems("incubator/foo", "stable/foo")
+		require.NoError(t, err)
+		assert.Equal(t, "stable/foo", merged.ID)
+
+		for _, id := range []string{"incubator/foo", "stable/foo"} {
+			it, err := s.GetItem(id)
+			require.NoError(t, err)
+			assert.Equal(t, "stable/foo", it.ID)
+			assert.ElementsMatch(t, []bson.ObjectId{alice, bob}, it.StargazersIDs)
+			assert.Equal(t, map[string]string{alice.Hex(): "1.0.0"}, it.StargazerVersions)
+			require.Len(t, it.Comments, 2)
+			assert.Equal(t, "first", it.Comments[0].Text)
+		}
+
+		items, err := s.ListItems("")
+		require.NoError(t, err)
+		assert.Len(t, items, 1)
+		aliases, err := s.ListAliases()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"incubator/foo": "stable/foo"}, aliases)
+
+		_, err = s.MergeItems("incubator/foo", "stable/bar")
+		assert.Error(t, err)
+
+		// Stars of an alias go to the item it was merged into
+		carol := bson.NewObjectId()
+		it, changed, err := s.AddStar("incubator/foo", "chart", carol, "")
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, "stable/foo", it.ID)
+		assert.Len(t, it.StargazersIDs, 3)
+		_, _, err = s.RemoveStar("incubator/foo", "chart", carol)
+		require.NoError(t, err)
+
+		// Merging into a missing item creates it
+		require.NoError(t, s.CreateItem(item{ID: "incubator/bar", Type: "chart", StargazersIDs: []bson.ObjectId{alice}}))
+		_, err = s.MergeItems("incubator/bar", "stable/bar")
+		require.NoError(t, err)
+		it, err = s.GetItem("stable/bar")
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{alice}, it.StargazersIDs)
+	})
+
+	t.Run("api tokens", func(t *testing.T) {
+		s := newStore(t)
+		first := apiToken{ID: bson.NewObjectId(), Name: "CI", Scopes: []string{scopeCommentsWrite}, User: author, Hash: "hash-1", CreatedAt: day(1)}
+		second := apiToken{ID: bson.NewObjectId(), Name: "Release bot", Scopes: []string{scopeStarsWrite, scopeCommentsWrite},
+			User: author, Hash: "hash-2", CreatedAt: day(2)}
+		other := apiToken{ID: bson.NewObjectId(), Name: "CI", Scopes: []string{scopeStarsWrite}, User: &User{ID: bob, Name: "Bob"}, Hash: "hash-3", CreatedAt: day(1)}
+		for _, tok := range []apiToken{second, first, other} {
+			require.NoError(t, s.CreateAPIToken(tok))
+		}
+		assert.Error(t, s.CreateAPIToken(first))
+
+		tokens, err := s.ListAPITokens(alice)
+		require.NoError(t, err)
+		require.Len(t, tokens, 2)
+		assert.Equal(t, []string{"CI", "Release bot"}, []string{tokens[0].Name, tokens[1].Name})
+		assert.Equal(t, []string{scopeStarsWrite, scopeCommentsWrite}, tokens[1].Scopes)
+		assert.True(t, day(2).Equal(tokens[1].CreatedAt))
+		assert.Nil(t, tokens[1].LastUsedAt)
+		tokens, err = s.ListAPITokens("")
+		require.NoError(t, err)
+		assert.Len(t, tokens, 3)
+
+		found, err := s.FindAPIToken("hash-2")
+		require.NoError(t, err)
+		assert.Equal(t, second.ID, found.ID)
+		assert.Equal(t, "Alice", found.User.Name)
+		assert.Equal(t, "alice@example.com", found.User.Email)
+		_, err = s.FindAPIToken("unknown")
+		assert.Equal(t, errNotFound, err)
+
+		require.NoError(t, s.TouchAPIToken(second.ID, day(3)))
+		found, err = s.FindAPIToken("hash-2")
+		require.NoError(t, err)
+		require.NotNil(t, found.LastUsedAt)
+		assert.True(t, day(3).Equal(*found.LastUsedAt))
+
+		// Users can only delete their own tokens
+		assert.Equal(t, errNotFound, s.DeleteAPIToken(bob, second.ID))
+		require.NoError(t, s.DeleteAPIToken(alice, second.ID))
+		assert.Equal(t, errNotFound, s.DeleteAPIToken(alice, second.ID))
+		_, err = s.FindAPIToken("hash-2")
+		assert.Equal(t, errNotFound, err)
+		tokens, err = s.ListAPITokens(bob)
+		require.NoError(t, err)
+		assert.Len(t, tokens, 1)
+	})
+
+	t.Run("revocations", func(t *testing.T) {
+		s := newStore(t)
+		cutoff, expiry := day(2), day(10)
+		session := revocation{ID: bson.NewObjectId(), TokenID: "session-1", ExpiresAt: &expiry, Reason: "stolen laptop", RevokedBy: bob, CreatedAt: day(3)}
+		user := revocation{ID: bson.NewObjectId(), UserID: alice, IssuedBefore: &cutoff, RevokedBy: bob, CreatedAt: day(2)}
+		for _, r := range []revocation{session, user} {
+			require.NoError(t, s.CreateRevocation(r))
+		}
+		assert.Error(t, s.CreateRevocation(user))
+
+		list, err := s.ListRevocations(day(5))
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.Equal(t, user.ID, list[0].ID)
+		assert.Equal(t, alice, list[0].UserID)
+		require.NotNil(t, list[0].IssuedBefore)
+		assert.True(t, cutoff.Equal(*list[0].IssuedBefore))
+		assert.Nil(t, list[0].ExpiresAt)
+		assert.Equal(t, "session-1", list[1].TokenID)
+		assert.Empty(t, list[1].UserID)
+		assert.Equal(t, "stolen laptop", list[1].Reason)
+		assert.Equal(t, bob, list[1].RevokedBy)
+		require.NotNil(t, list[1].ExpiresAt)
+		assert.True(t, expiry.Equal(*list[1].ExpiresAt))
+
+		// Lapsed revocations aren't listed
+		list, err = s.ListRevocations(day(10))
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, user.ID, list[0].ID)
+
+		require.NoError(t, s.DeleteRevocation(user.ID))
+		assert.Equal(t, errNotFound, s.DeleteRevocation(user.ID))
+		list, err = s.ListRevocations(day(5))
+		require.NoError(t, err)
+		assert.Len(t, list, 1)
+	})
+
+	t.Run("sanctions", func(t *testing.T) {
+		s := newStore(t)
+		expiry := day(10)
+		mute := sanction{ID: bson.NewObjectId(), UserID: alice, Kind: sanctionMute, ExpiresAt: &expiry, Reason: "spam", CreatedBy: bob, CreatedAt: day(3)}
+		ban := sanction{ID: bson.NewObjectId(), UserID: alice, Kind: sanctionBan, CreatedBy: bob, CreatedAt: day(2)}
+		for _, sn := range []sanction{mute, ban} {
+			require.NoError(t, s.CreateSanction(sn))
+		}
+		assert.Error(t, s.CreateSanction(ban))
+
+		list, err := s.ListSanctions(day(5))
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.Equal(t, ban.ID, list[0].ID)
+		assert.Equal(t, sanctionBan, list[0].Kind)
+		assert.Nil(t, list[0].ExpiresAt)
+		assert.Equal(t, alice, list[1].UserID)
+		assert.Equal(t, sanctionMute, list[1].Kind)
+		assert.Equal(t, "spam", list[1].Reason)
+		assert.Equal(t, bob, list[1].CreatedBy)
+		assert.True(t, day(3).Equal(list[1].CreatedAt))
+		require.NotNil(t, list[1].ExpiresAt)
+		assert.True(t, expiry.Equal(*list[1].ExpiresAt))
+
+		// Lapsed sanctions aren't listed
+		list, err = s.ListSanctions(day(10))
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, ban.ID, list[0].ID)
+
+		require.NoError(t, s.DeleteSanction(ban.ID))
+		assert.Equal(t, errNotFound, s.DeleteSanction(ban.ID))
+		list, err = s.ListSanctions(day(5))
+		require.NoError(t, err)
+		assert.Len(t, list, 1)
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return newMemoryStore() })
+}
+
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+	s := newMemoryStore()
+	author := &User{ID: bson.NewObjectId(), Email: "alice@example.com"}
+	require.NoError(t, s.CreateItem(item{ID: "stable/wordpress", Type: "chart", Comments: []comment{{ID: bson.NewObjectId(), Text: "Hello", Author: author}}}))
+
+	it, err := s.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	setAvatarURL(it.Comments[0].Author)
+	it.Comments[0].Text = "Changed"
+
+	it, err = s.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", it.Comments[0].Text)
+	assert.Empty(t, it.Comments[0].Author.AvatarURL)
+}
+
+func TestHandlersWithMemoryStore(t *testing.T) {
+	store = newMemoryStore()
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+	r := newRouter()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusCreated, do("PUT", "/v1/stars", `{"id": "stable/wordpress", "has_starred": true}`).Code)
+	require.Equal(t, http.StatusCreated, do("POST", "/v1/comments/stable/wordpress", `{"text": "Hello"}`).Code)
+
+	var stars struct {
+		Data []item `json:"data"`
+	}
+	json.NewDecoder(do("GET", "/v1/stars", "").Body).Decode(&stars)
+	require.Len(t, stars.Data, 1)
+	assert.Equal(t, 1, stars.Data[0].StargazersCount)
+	assert.True(t, stars.Data[0].HasStarred)
+
+	var comments struct {
+		Data []comment `json:"data"`
+	}
+	json.NewDecoder(do("GET", "/v1/comments/stable/wordpress", "").Body).Decode(&comments)
+	require.Len(t, comments.Data, 1)
+	assert.Equal(t, "Hello", comments.Data[0].Text)
+
+	require.Equal(t, http.StatusAccepted, do("DELETE", "/v1/comments/stable/wordpress/"+comments.Data[0].ID.Hex(), "").Code)
+	require.Equal(t, http.StatusCreated, do("PUT", "/v1/stars", `{"id": "stable/wordpress", "has_starred": false}`).Code)
+
+	it, err := store.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	assert.Empty(t, it.StargazersIDs)
+	assert.Empty(t, it.Comments)
+}
+
+func TestItemsOfDifferentTypesWithMemoryStore(t *testing.T) {
+	store = newMemoryStore()
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+	r := newRouter()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusCreated, do("PUT", "/v1/items/chart/stable/wordpress/-/star", `{"has_starred": true}`).Code)
+	require.Equal(t, http.StatusCreated, do("PUT", "/v1/items/function/stable/wordpress/-/star", `{"has_starred": true}`).Code)
+	require.Equal(t, http.StatusCreated, do("POST", "/v1/items/function/stable/wordpress/-/comments", `{"text": "Hello"}`).Code)
+	// Chart IDs the legacy routes accepted before item types
+	require.Equal(t, http.StatusCreated, do("PUT", "/v1/stars", `{"id": "wordpress", "has_starred": true}`).Code)
+
+	var it struct {
+		Data item `json:"data"`
+	}
+	json.NewDecoder(do("GET", "/v1/items/function/stable/wordpress", "").Body).Decode(&it)
+	assert.Equal(t, "stable/wordpress", it.Data.ID)
+	assert.Equal(t, "function", it.Data.Type)
+	assert.Equal(t, 1, it.Data.StargazersCount)
+
+	var comments struct {
+		Data []comment `json:"data"`
+	}
+	json.NewDecoder(do("GET", "/v1/comments/stable/wordpress", "").Body).Decode(&comments)
+	assert.Empty(t, comments.Data)
+	feed := do("GET", "/v1/items/function/stable/wordpress/-/comments.atom", "")
+	require.Equal(t, http.StatusOK, feed.Code)
+	assert.Contains(t, feed.Body.String(), "Rick Sanchez commented on stable/wordpress")
+	badge := do("GET", "/v1/items/function/stable/wordpress/-/badges/stars.svg", "")
+	require.Equal(t, http.StatusOK, badge.Code)
+	assert.Contains(t, badge.Body.String(), "★ 1")
+
+	var repo struct {
+		Data repoStats `json:"data"`
+	}
+	json.NewDecoder(do("GET", "/v1/repos/stable/stats", "").Body).Decode(&repo)
+	assert.Equal(t, 1, repo.Data.ItemsCount)
+	assert.Equal(t, 0, repo.Data.CommentsCount)
+}
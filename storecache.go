@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheRefreshInterval is how long revocations and sanctions made by other
+// replicas of the service may take to be enforced
+var cacheRefreshInterval = 30 * time.Second
+
+// storeCache keeps data of the store in memory, so that requests don't query
+// it. The data is reloaded every cacheRefreshInterval, and right after this
+// replica changes it. Embedders guard their data with mu.
+type storeCache struct {
+	// Serializes reloads, so that concurrent requests load the data once
+	refreshMu sync.Mutex
+
+	mu     sync.RWMutex
+	loaded time.Time
+	// Whether the data was ever loaded
+	ready bool
+}
+
+// setLoaded records that the data was reloaded. It must be called with mu
+// held.
+func (c *storeCache) setLoaded() {
+	c.loaded, c.ready = time.Now(), true
+}
+
+// invalidate makes the next request reload the data
+func (c *storeCache) invalidate() {
+	c.mu.Lock()
+	c.loaded = time.Time{}
+	c.mu.Unlock()
+}
+
+func (c *storeCache) fresh() (fresh, ready bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.loaded.IsZero() && time.Since(c.loaded) < cacheRefreshInterval, c.ready
+}
+
+// load calls refresh if the data is stale. The previous data is kept if that
+// fails, failing only if it was never loaded.
+func (c *storeCache) load(refresh func() error, what string) error {
+	if fresh, _ := c.fresh(); fresh {
+		return nil
+	}
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	// Another request may have reloaded it meanwhile
+	fresh, ready := c.fresh()
+	if fresh {
+		return nil
+	}
+	if err := refresh(); err != nil {
+		if !ready {
+			return err
+		}
+		log.WithError(err).Error("could not refresh " + what)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	// Most tests use mock stores that don't expect revocations and sanctions
+	// to be loaded, so the caches start empty and are only reloaded when
+	// invalidated. Tests of the caches use their own.
+	cacheRefreshInterval = time.Hour
+	revocationCache = &revocationList{
+		storeCache: storeCache{loaded: time.Now(), ready: true},
+		tokens:     map[string]bool{},
+		users:      map[bson.ObjectId]time.Time{},
+	}
+	sanctionCache = &sanctionList{
+		storeCache: storeCache{loaded: time.Now(), ready: true},
+		users:      map[string]map[bson.ObjectId]*sanction{},
+	}
+}
+
+func TestStoreCacheLoadsOnce(t *testing.T) {
+	var c storeCache
+	var loads int32
+	refresh := func() error {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(10 * time.Millisecond)
+		c.mu.Lock()
+		c.setLoaded()
+		c.mu.Unlock()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.load(refresh, "test data"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), loads)
+
+	c.invalidate()
+	assert.NoError(t, c.load(refresh, "test data"))
+	assert.Equal(t, int32(2), loads)
+
+	// Stale data is kept if it can't be reloaded
+	c.invalidate()
+	assert.NoError(t, c.load(func() error { return errors.New("connection refused") }, "test data"))
+	assert.EqualError(t, new(storeCache).load(func() error { return errors.New("connection refused") }, "test data"), "connection refused")
+}
@@ -47,11 +47,18 @@ func (c mockCollection) FindId(id interface{}) datastore.Query {
 }
 
 func (c mockCollection) Insert(docs ...interface{}) error {
-	c.Called(docs...)
+	args := c.Called(docs...)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
 	return nil
 }
 
 func (c mockCollection) Upsert(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	args := c.Called(selector, update)
+	if len(args) > 0 {
+		return nil, args.Error(0)
+	}
 	return nil, nil
 }
 
@@ -68,7 +75,45 @@ func (c mockCollection) UpdateId(selector, update interface{}) error {
 	return nil
 }
 
+// UpdateAll isn't part of datastore.Collection but is reachable through the
+// mgo collection it wraps
+func (c mockCollection) UpdateAll(selector, update interface{}) (*mgo.ChangeInfo, error) {
+	args := c.Called(selector, update)
+	if len(args) > 0 {
+		return nil, args.Error(0)
+	}
+	return nil, nil
+}
+
+// EnsureIndex, DropIndexName and Indexes aren't part of datastore.Collection
+// either
+func (c mockCollection) EnsureIndex(index mgo.Index) error {
+	args := c.Called(index)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
+	return nil
+}
+
+func (c mockCollection) DropIndexName(name string) error {
+	args := c.Called(name)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
+	return nil
+}
+
+func (c mockCollection) Indexes() ([]mgo.Index, error) {
+	args := c.Called()
+	indexes, _ := args.Get(0).([]mgo.Index)
+	return indexes, args.Error(1)
+}
+
 func (c mockCollection) Remove(selector interface{}) error {
+	args := c.Called(selector)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
 	return nil
 }
 
@@ -108,7 +153,10 @@ type mockQuery struct {
 }
 
 func (q mockQuery) All(result interface{}) error {
-	q.Called(result)
+	args := q.Called(result)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
 	return nil
 }
 
@@ -120,6 +168,17 @@ func (q mockQuery) One(result interface{}) error {
 	return nil
 }
 
+// Apply isn't part of datastore.Query but is reachable through the mgo query
+// it wraps
+func (q mockQuery) Apply(change mgo.Change, result interface{}) (*mgo.ChangeInfo, error) {
+	args := q.Called(change, result)
+	if len(args) == 0 {
+		return &mgo.ChangeInfo{Updated: 1, Matched: 1}, nil
+	}
+	info, _ := args.Get(0).(*mgo.ChangeInfo)
+	return info, args.Error(1)
+}
+
 func (q mockQuery) Sort(fields ...string) datastore.Query {
 	return q
 }
@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver"
+)
+
+// normalizeVersion checks that an optional version is a valid semantic
+// version and replaces it by its canonical form, so that "v1.2" and "1.2.0"
+// are stored the same way
+func normalizeVersion(version *string) error {
+	if *version == "" {
+		return nil
+	}
+	v, err := semver.NewVersion(*version)
+	if err != nil {
+		return fmt.Errorf("invalid version %q", *version)
+	}
+	*version = v.String()
+	return nil
+}
+
+// canonicalVersion returns the canonical form of the version, or the version
+// itself if it isn't a valid semantic version
+func canonicalVersion(version string) string {
+	if v, err := semver.NewVersion(version); err == nil {
+		return v.String()
+	}
+	return version
+}
+
+// versionMatcher returns a function matching versions against spec, which is
+// either a single version (e.g. "1.2.3") or a range (e.g. ">=1.0, <2.0"). An
+// empty spec matches every version.
+func versionMatcher(spec string) (func(string) bool, error) {
+	if spec == "" {
+		return func(string) bool { return true }, nil
+	}
+
+	if want, err := semver.NewVersion(spec); err == nil {
+		return func(version string) bool {
+			v, err := semver.NewVersion(version)
+			return err == nil && v.Equal(want)
+		}, nil
+	}
+
+	constraint, err := semver.NewConstraint(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version or version range %q", spec)
+	}
+	return func(version string) bool {
+		v, err := semver.NewVersion(version)
+		return err == nil && constraint.Check(v)
+	}, nil
+}
+
+// countByVersion returns the number of Stargazers of each version of the
+// item, ignoring stars without a version. Versions stored before they were
+// normalized are counted with their canonical form.
+func countByVersion(it *item) map[string]int {
+	if len(it.StargazerVersions) == 0 {
+		return nil
+	}
+	counts := map[string]int{}
+	for _, id := range it.StargazersIDs {
+		if version, ok := it.StargazerVersions[id.Hex()]; ok {
+			counts[canonicalVersion(version)]++
+		}
+	}
+	return counts
+}
+
+// latestVersion returns the highest version starred by a Stargazer of the
+// item, or an empty string if no star has a version
+func latestVersion(it *item) string {
+	var latest *semver.Version
+	for version := range countByVersion(it) {
+		v, err := semver.NewVersion(version)
+		if err == nil && (latest == nil || v.GreaterThan(latest)) {
+			latest = v
+		}
+	}
+	if latest == nil {
+		return ""
+	}
+	return latest.Original()
+}
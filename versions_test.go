@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_versionMatcher(t *testing.T) {
+	tests := []struct {
+		spec      string
+		matches   []string
+		unmatches []string
+		wantErr   bool
+	}{
+		{"", []string{"1.0.0", "not a version"}, nil, false},
+		{"1.2.3", []string{"1.2.3", "v1.2.3"}, []string{"1.2.4", "not a version"}, false},
+		{"1.2", []string{"1.2.0"}, []string{"1.2.1"}, false},
+		{">=1.0, <2.0", []string{"1.0.0", "1.9.9"}, []string{"0.9.0", "2.0.0"}, false},
+		{"~1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0"}, false},
+		{"not a range", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			match, err := versionMatcher(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for _, v := range tt.matches {
+				assert.True(t, match(v), v)
+			}
+			for _, v := range tt.unmatches {
+				assert.False(t, match(v), v)
+			}
+		})
+	}
+}
+
+func Test_normalizeVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"1.2.3", "1.2.3", false},
+		{"v1.2.3", "1.2.3", false},
+		{"1.2", "1.2.0", false},
+		{"v1.2.3-beta.1+build", "1.2.3-beta.1+build", false},
+		{"latest", "latest", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			version := tt.version
+			err := normalizeVersion(&version)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, version)
+		})
+	}
+}
+
+func Test_countByVersion(t *testing.T) {
+	alice, bob, carol, dave := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	it := &item{
+		StargazersIDs: []bson.ObjectId{alice, bob, carol},
+		StargazerVersions: map[string]string{
+			alice.Hex(): "1.0.0",
+			// Stored before versions were normalized
+			bob.Hex(): "v1.0.0",
+			// Left over by a star that was removed
+			dave.Hex(): "2.0.0",
+		},
+	}
+	assert.Equal(t, map[string]int{"1.0.0": 2}, countByVersion(it))
+	assert.Nil(t, countByVersion(&item{StargazersIDs: []bson.ObjectId{alice}}))
+}
+
+func TestGetCommentsByVersion(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	author := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez"}
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress", Type: "chart", Comments: []comment{
+			{ID: bson.NewObjectId(), Text: "any version", Author: author},
+			{ID: bson.NewObjectId(), Text: "v1", Version: "1.0.0", Author: author},
+			{ID: bson.NewObjectId(), Text: "v2", Version: "2.0.0", Author: author},
+		}}
+	})
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []string
+	}{
+		{"all", "", http.StatusOK, []string{"any version", "v1", "v2"}},
+		{"exact version", "?version=1.0.0", http.StatusOK, []string{"any version", "v1"}},
+		{"range", "?version=%3E%3D1.5", http.StatusOK, []string{"any version", "v2"}},
+		{"invalid", "?version=latest", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/v1/comments/stable/wordpress"+tt.query, nil)
+			GetComments(w, req, Params{"repo": "stable", "chartName": "wordpress"})
+			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var b struct {
+				Data []comment `json:"data"`
+			}
+			json.NewDecoder(w.Body).Decode(&b)
+			var texts []string
+			for _, cm := range b.Data {
+				texts = append(texts, cm.Text)
+			}
+			assert.Equal(t, tt.want, texts)
+		})
+	}
+}
+
+func TestCreateCommentInvalidVersion(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return &User{ID: bson.NewObjectId()}, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/comments/stable/wordpress", bytes.NewBufferString(`{"text": "Hello", "version": "latest"}`))
+	CreateComment(w, req, Params{"repo": "stable", "chartName": "wordpress"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUpdateStarWithVersion(t *testing.T) {
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+	versionField := "stargazer_versions." + currentUser.ID.Hex()
+
+	tests := []struct {
+		name        string
+		stored      item
+		requestBody string
+		wantCode    int
+		wantUpdate  bson.M
+	}{
+		{"star version", item{ID: "stable/wordpress"}, `{"id": "stable/wordpress", "has_starred": true, "version": "1.0.0"}`, http.StatusCreated,
+			bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}, "$set": bson.M{versionField: "1.0.0"}}},
+		{"star prefixed version", item{ID: "stable/wordpress"}, `{"id": "stable/wordpress", "has_starred": true, "version": "v1.0.0"}`, http.StatusCreated,
+			bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}, "$set": bson.M{versionField: "1.0.0"}}},
+		{"change starred version", item{ID: "stable/wordpress", StargazersIDs: []bson.ObjectId{currentUser.ID}, StargazerVersions: map[string]string{currentUser.ID.Hex(): "1.0.0"}},
+			`{"id": "stable/wordpress", "has_starred": true, "version": "2.0.0"}`, http.StatusOK,
+			bson.M{"$addToSet": bson.M{"stargazers_ids": currentUser.ID}, "$set": bson.M{versionField: "2.0.0"}}},
+		{"unstar version", item{ID: "stable/wordpress", StargazersIDs: []bson.ObjectId{currentUser.ID}, StargazerVersions: map[string]string{currentUser.ID.Hex(): "1.0.0"}},
+			`{"id": "stable/wordpress", "has_starred": false}`, http.StatusCreated,
+			bson.M{"$pull": bson.M{"stargazers_ids": currentUser.ID}, "$unset": bson.M{versionField: ""}}},
+		{"invalid version", item{ID: "stable/wordpress"}, `{"id": "stable/wordpress", "has_starred": true, "version": "latest"}`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m mock.Mock
+			store = newMongoStore(testutil.NewMockSession(&m))
+			m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+				*args.Get(0).(*item) = tt.stored
+			})
+			if tt.wantUpdate != nil {
+				onUpsertItem(&m, "chart", tt.wantUpdate, &tt.stored)
+			}
+
+			w := httptest.NewRecorder()
+			UpdateStar(w, httptest.NewRequest("PUT", "/v1/stars", bytes.NewBufferString(tt.requestBody)))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantUpdate != nil {
+				m.AssertExpectations(t)
+			} else {
+				m.AssertNotCalled(t, "Apply", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestGetStarsByVersion(t *testing.T) {
+	var m mock.Mock
+	store = newMongoStore(testutil.NewMockSession(&m))
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	m.On("All", &itemsList).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*item) = []*item{{
+			ID:                "stable/wordpress",
+			StargazersIDs:     []bson.ObjectId{alice, bob},
+			StargazerVersions: map[string]string{alice.Hex(): "1.0.0", bob.Hex(): "2.0.0"},
+		}}
+	})
+
+	w := httptest.NewRecorder()
+	GetStars(w, httptest.NewRequest("GET", "/v1/stars", nil))
+	var b body
+	json.NewDecoder(w.Body).Decode(&b)
+	require.Len(t, b.Data, 1)
+	assert.Equal(t, map[string]int{"1.0.0": 1, "2.0.0": 1}, b.Data[0].StargazersByVersion)
+}
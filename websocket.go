@@ -0,0 +1,331 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of events pushed to comment thread subscribers
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+	eventError   = "error"
+)
+
+// commentEvent is a message pushed to the clients subscribed to an item
+type commentEvent struct {
+	Type    string   `json:"type"`
+	Comment *comment `json:"comment,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// socketMessage is a message sent by a client over the socket. The only
+// supported type is "create", which posts a new comment.
+type socketMessage struct {
+	Type string `json:"type"`
+	comment
+}
+
+// hubConfig configures the limits and timeouts of WebSocket connections
+type hubConfig struct {
+	// Maximum number of open connections, 0 means unlimited
+	MaxConnections int
+	// Maximum number of open connections per item, 0 means unlimited
+	MaxConnectionsPerItem int
+	// Interval between pings sent to the client
+	PingInterval time.Duration
+	// Time to wait for a pong (or any other message) before closing the connection
+	PongTimeout time.Duration
+	// Time allowed to write a message to the client
+	WriteTimeout time.Duration
+	// Maximum size in bytes of a message sent by the client
+	MaxMessageSize int64
+}
+
+var defaultHubConfig = hubConfig{
+	MaxConnections:        1000,
+	MaxConnectionsPerItem: 100,
+	PingInterval:          30 * time.Second,
+	PongTimeout:           60 * time.Second,
+	WriteTimeout:          10 * time.Second,
+	MaxMessageSize:        4096,
+}
+
+// hub keeps track of the clients subscribed to each item's comment thread
+type hub struct {
+	config hubConfig
+
+	mu      sync.Mutex
+	clients map[string]map[*socketClient]struct{}
+	count   int
+}
+
+// socketClient is a single WebSocket connection subscribed to an item
+type socketClient struct {
+	itemType string
+	itemID   string
+	// room is the key the hub groups the subscribers of the item by
+	room string
+	user *User
+	// req authenticates the user again before each of their comments, as the
+	// token may be revoked or expire while the socket is open
+	req  *http.Request
+	conn *websocket.Conn
+	send chan commentEvent
+}
+
+var commentsHub = newHub(defaultHubConfig)
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkSocketOrigin}
+
+func newHub(config hubConfig) *hub {
+	return &hub{config: config, clients: map[string]map[*socketClient]struct{}{}}
+}
+
+// register adds the client to its item's subscribers and returns false if a
+// connection limit has been reached
+func (h *hub) register(c *socketClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.config.MaxConnections > 0 && h.count >= h.config.MaxConnections {
+		return false
+	}
+	if h.config.MaxConnectionsPerItem > 0 && len(h.clients[c.room]) >= h.config.MaxConnectionsPerItem {
+		return false
+	}
+	if h.clients[c.room] == nil {
+		h.clients[c.room] = map[*socketClient]struct{}{}
+	}
+	h.clients[c.room][c] = struct{}{}
+	h.count++
+	return true
+}
+
+// unregister removes the client and closes its send channel
+func (h *hub) unregister(c *socketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c.room][c]; !ok {
+		return
+	}
+	delete(h.clients[c.room], c)
+	if len(h.clients[c.room]) == 0 {
+		delete(h.clients, c.room)
+	}
+	h.count--
+	close(c.send)
+}
+
+// broadcast pushes the event to every client subscribed to the item stored
+// under the key, except those the comment is hidden from. Clients that are too
+// slow to keep up are disconnected.
+func (h *hub) broadcast(key string, ev commentEvent) {
+	var muted *User
+	if ev.Comment != nil && ev.Comment.Author != nil && sanctionCache.muted(ev.Comment.Author.ID) {
+		muted = ev.Comment.Author
+	}
+
+	h.mu.Lock()
+	var slow []*socketClient
+	for c := range h.clients[key] {
+		if muted != nil && (c.user == nil || c.user.ID != muted.ID) {
+			continue
+		}
+		select {
+		case c.send <- ev:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.Unlock()
+	for _, c := range slow {
+		h.unregister(c)
+	}
+}
+
+// commentsRoom returns the hub room of the item's comments, which is the key
+// of the item it was merged into if any, so that the subscribers of an alias
+// and of its target receive the same events
+func commentsRoom(itemType, itemID string) string {
+	key := itemKey(itemType, itemID)
+	if it, err := store.GetItem(key); err == nil {
+		return it.ID
+	}
+	return key
+}
+
+// CommentsSocket upgrades the request to a WebSocket that receives the
+// comment events of an item and accepts new comments from authenticated users
+func CommentsSocket(w http.ResponseWriter, req *http.Request, params Params) {
+	itemType, itemID := itemFromParams(params)
+	if err := validateLegacyItemID(itemType, itemID); err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, err.Error()).Write(w)
+		return
+	}
+	// Anonymous users can follow the thread but not post to it
+	currentUser, _ := getCurrentUser(req)
+
+	c := &socketClient{itemType: itemType, itemID: itemID, room: commentsRoom(itemType, itemID), user: currentUser, send: make(chan commentEvent, 16)}
+	// Without the user requirePermission may have stored in the context
+	c.req = req.WithContext(context.Background())
+	if !commentsHub.register(c) {
+		response.NewErrorResponse(http.StatusServiceUnavailable, "too many connections").Write(w)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade already replied to the client
+		log.WithError(err).Error("could not upgrade connection")
+		commentsHub.unregister(c)
+		return
+	}
+	c.conn = conn
+
+	go c.writePump(commentsHub.config)
+	c.readPump(commentsHub)
+}
+
+// readPump handles the messages sent by the client until the connection is
+// closed or times out
+func (c *socketClient) readPump(h *hub) {
+	defer func() {
+		h.unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(h.config.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(h.config.PongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(h.config.PongTimeout))
+	})
+
+	for {
+		var msg socketMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				log.WithError(err).Debug("closing comments socket")
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(h.config.PongTimeout))
+
+		if msg.Type != "create" {
+			h.reply(c, commentEvent{Type: eventError, Message: "unsupported message type"})
+			continue
+		}
+		if c.user == nil {
+			h.reply(c, commentEvent{Type: eventError, Message: "unauthorized"})
+			continue
+		}
+		// Close the sockets of users whose token has been revoked since
+		if _, err := getCurrentUser(c.req); err != nil {
+			message := "unauthorized"
+			if ae, ok := err.(*authError); ok {
+				message = ae.reason
+			}
+			h.reply(c, commentEvent{Type: eventError, Message: message})
+			// writePump sends the error and closes the connection, which
+			// ends the reads
+			h.unregister(c)
+			for {
+				if _, _, err := c.conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}
+		if !c.user.hasScope(scopeCommentsWrite) {
+			h.reply(c, commentEvent{Type: eventError, Message: "API token lacks the " + scopeCommentsWrite + " scope"})
+			continue
+		}
+		ban, err := banOf(c.user)
+		if err != nil {
+			log.WithError(err).Error("could not load sanctions")
+			h.reply(c, commentEvent{Type: eventError, Message: "internal server error"})
+			continue
+		}
+		if ban != nil {
+			h.reply(c, commentEvent{Type: eventError, Message: ban.banMessage()})
+			continue
+		}
+		if err := validateComment(&msg.comment); err != nil {
+			h.reply(c, commentEvent{Type: eventError, Message: err.Error()})
+			continue
+		}
+		cm, err := addComment(c.itemType, c.itemID, c.user, comment{Text: msg.Text, Version: msg.Version})
+		if err == errItemTypeConflict || err == errUnknownItem {
+			h.reply(c, commentEvent{Type: eventError, Message: err.Error()})
+			continue
+		}
+		if err != nil {
+			h.reply(c, commentEvent{Type: eventError, Message: "internal server error"})
+			continue
+		}
+		h.broadcast(c.room, commentEvent{Type: eventCreated, Comment: &cm})
+	}
+}
+
+// reply sends an event to a single client, dropping it if the client is not
+// keeping up
+func (h *hub) reply(c *socketClient, ev commentEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c.room][c]; !ok {
+		return
+	}
+	select {
+	case c.send <- ev:
+	default:
+	}
+}
+
+// writePump sends queued events and periodic pings to the client
+func (c *socketClient) writePump(config hubConfig) {
+	ticker := time.NewTicker(config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case ev, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
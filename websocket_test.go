@@ -0,0 +1,281 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/kubeapps/ratesvc/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newSocketServer starts a server exposing the comments socket and swaps the
+// global hub for one with the given config
+func newSocketServer(t *testing.T, config hubConfig) (*httptest.Server, func()) {
+	oldHub := commentsHub
+	commentsHub = newHub(config)
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/v1/ws/comments/{repo}/{chartName}").Handler(WithParams(CommentsSocket))
+	ts := httptest.NewServer(r)
+	return ts, func() {
+		ts.Close()
+		commentsHub = oldHub
+	}
+}
+
+func dialSocket(t *testing.T, ts *httptest.Server) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/ws/comments/stable/wordpress"
+	return websocket.DefaultDialer.Dial(url, nil)
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) commentEvent {
+	var ev commentEvent
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	require.NoError(t, conn.ReadJSON(&ev))
+	return ev
+}
+
+// waitForClients waits until the hub has registered n clients
+func waitForClients(t *testing.T, n int) {
+	for i := 0; i < 100; i++ {
+		commentsHub.mu.Lock()
+		count := commentsHub.count
+		commentsHub.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d clients to be connected", n)
+}
+
+func TestCommentsSocketCreateComment(t *testing.T) {
+	var m mock.Mock
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress"}
+	})
+	m.On("Apply", mock.Anything, mock.Anything)
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	ts, cleanup := newSocketServer(t, defaultHubConfig)
+	defer cleanup()
+
+	author, _, err := dialSocket(t, ts)
+	require.NoError(t, err)
+	defer author.Close()
+	follower, _, err := dialSocket(t, ts)
+	require.NoError(t, err)
+	defer follower.Close()
+	waitForClients(t, 2)
+
+	require.NoError(t, author.WriteJSON(map[string]string{"type": "create", "text": "Hello, World"}))
+	for _, conn := range []*websocket.Conn{author, follower} {
+		ev := readEvent(t, conn)
+		assert.Equal(t, eventCreated, ev.Type)
+		require.NotNil(t, ev.Comment)
+		assert.Equal(t, "Hello, World", ev.Comment.Text)
+		assert.Equal(t, currentUser.ID, ev.Comment.Author.ID)
+	}
+	m.AssertCalled(t, "Apply", mock.Anything, mock.Anything)
+}
+
+func TestCommentsSocketFollowsAliases(t *testing.T) {
+	store = newMemoryStore()
+	require.NoError(t, store.CreateItem(item{ID: "incubator/wordpress", Type: "chart"}))
+	_, err := store.MergeItems("incubator/wordpress", "stable/wordpress")
+	require.NoError(t, err)
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	ts, cleanup := newSocketServer(t, defaultHubConfig)
+	defer cleanup()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/ws/comments/incubator/wordpress"
+	follower, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer follower.Close()
+	waitForClients(t, 1)
+
+	w := httptest.NewRecorder()
+	CreateComment(w, httptest.NewRequest("POST", "/v1/comments/stable/wordpress", strings.NewReader(`{"text": "Hello"}`)),
+		Params{"repo": "stable", "chartName": "wordpress"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	ev := readEvent(t, follower)
+	assert.Equal(t, eventCreated, ev.Type)
+	assert.Equal(t, "Hello", ev.Comment.Text)
+}
+
+func TestCommentsSocketRevokedToken(t *testing.T) {
+	store = newMemoryStore()
+	oldVerifier, oldCache := jwtVerifier, revocationCache
+	jwtVerifier = &tokenVerifier{algorithms: hmacAlgorithms, hmacKey: []byte("secret")}
+	revocationCache = &revocationList{}
+	defer func() { jwtVerifier, revocationCache = oldVerifier, oldCache }()
+
+	ts, cleanup := newSocketServer(t, defaultHubConfig)
+	defer cleanup()
+
+	claims := testClaims(&User{ID: bson.NewObjectId(), Name: "Rick Sanchez"})
+	claims.TokenID = "session-1"
+	header := http.Header{"Authorization": {"Bearer " + signToken(t, jwt.SigningMethodHS256, []byte("secret"), "", claims)}}
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/ws/comments/stable/wordpress"
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	defer conn.Close()
+	waitForClients(t, 1)
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "create", "text": "Hello"}))
+	assert.Equal(t, eventCreated, readEvent(t, conn).Type)
+
+	require.NoError(t, store.CreateRevocation(revocation{ID: bson.NewObjectId(), TokenID: "session-1", CreatedAt: time.Now()}))
+	revocationCache.invalidate()
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "create", "text": "Hello again"}))
+	ev := readEvent(t, conn)
+	assert.Equal(t, eventError, ev.Type)
+	assert.Equal(t, "token has been revoked", ev.Message)
+	waitForClients(t, 0)
+
+	it, err := store.GetItem("stable/wordpress")
+	require.NoError(t, err)
+	assert.Len(t, it.Comments, 1)
+}
+
+func TestCommentsSocketInvalidMessages(t *testing.T) {
+	var m mock.Mock
+	m.On("One", &item{}).Return(errors.New("not found"))
+	store = newMongoStore(testutil.NewMockSession(&m))
+	oldGetCurrentUser := getCurrentUser
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	ts, cleanup := newSocketServer(t, defaultHubConfig)
+	defer cleanup()
+
+	tests := []struct {
+		name        string
+		user        *User
+		message     map[string]string
+		wantMessage string
+	}{
+		{"anonymous", nil, map[string]string{"type": "create", "text": "Hello"}, "unauthorized"},
+		{"no text", &User{ID: bson.NewObjectId()}, map[string]string{"type": "create"}, "text missing in request body"},
+		{"unknown type", &User{ID: bson.NewObjectId()}, map[string]string{"type": "star"}, "unsupported message type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getCurrentUser = func(_ *http.Request) (*User, error) {
+				if tt.user == nil {
+					return nil, errors.New("no user")
+				}
+				return tt.user, nil
+			}
+			conn, _, err := dialSocket(t, ts)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			require.NoError(t, conn.WriteJSON(tt.message))
+			ev := readEvent(t, conn)
+			assert.Equal(t, eventError, ev.Type)
+			assert.Equal(t, tt.wantMessage, ev.Message)
+		})
+	}
+	m.AssertNotCalled(t, "Apply", mock.Anything, mock.Anything)
+}
+
+func TestCommentsSocketConnectionLimit(t *testing.T) {
+	config := defaultHubConfig
+	config.MaxConnectionsPerItem = 1
+	ts, cleanup := newSocketServer(t, config)
+	defer cleanup()
+
+	first, _, err := dialSocket(t, ts)
+	require.NoError(t, err)
+	defer first.Close()
+	waitForClients(t, 1)
+
+	_, res, err := dialSocket(t, ts)
+	assert.Error(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	first.Close()
+	waitForClients(t, 0)
+}
+
+func TestCommentsSocketPongTimeout(t *testing.T) {
+	config := defaultHubConfig
+	config.PingInterval = 10 * time.Millisecond
+	config.PongTimeout = 50 * time.Millisecond
+	ts, cleanup := newSocketServer(t, config)
+	defer cleanup()
+
+	// The default ping handler replies with a pong, but only while reading
+	conn, _, err := dialSocket(t, ts)
+	require.NoError(t, err)
+	defer conn.Close()
+	waitForClients(t, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	waitForClients(t, 0)
+}
+
+func TestCreateCommentBroadcasts(t *testing.T) {
+	var m mock.Mock
+	m.On("One", &item{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*item) = item{ID: "stable/wordpress"}
+	})
+	m.On("Apply", mock.Anything, mock.Anything)
+	store = newMongoStore(testutil.NewMockSession(&m))
+	currentUser := &User{ID: bson.NewObjectId(), Name: "Rick Sanchez", Email: "rick@sanchez.com"}
+	oldGetCurrentUser := getCurrentUser
+	getCurrentUser = func(_ *http.Request) (*User, error) { return currentUser, nil }
+	defer func() { getCurrentUser = oldGetCurrentUser }()
+
+	ts, cleanup := newSocketServer(t, defaultHubConfig)
+	defer cleanup()
+
+	conn, _, err := dialSocket(t, ts)
+	require.NoError(t, err)
+	defer conn.Close()
+	waitForClients(t, 1)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/comments/stable/wordpress", bytes.NewBufferString(`{"text": "Hello, World"}`))
+	CreateComment(w, req, Params{"repo": "stable", "chartName": "wordpress"})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	ev := readEvent(t, conn)
+	assert.Equal(t, eventCreated, ev.Type)
+	assert.Equal(t, "Hello, World", ev.Comment.Text)
+}